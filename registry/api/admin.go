@@ -0,0 +1,247 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aliharirian/TerraPeak/logger"
+	"github.com/aliharirian/TerraPeak/store"
+	"github.com/aliharirian/TerraPeak/store/metadata"
+	"github.com/go-chi/chi/v5"
+)
+
+// defaultAdminListLimit caps the entries one listing returns unless the
+// request asks for another limit
+const defaultAdminListLimit = 1000
+
+// adminEntry describes one cached object in admin listings
+type adminEntry struct {
+	Key        string    `json:"key"`
+	Size       int64     `json:"size"`
+	Modified   time.Time `json:"modified"`
+	AgeSeconds int64     `json:"age_seconds"`
+}
+
+// adminUsage counts cached objects and their bytes
+type adminUsage struct {
+	Objects int   `json:"objects"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// registerAdminRoutes mounts the cache administration API under /admin. It
+// is only available when an admin token is configured.
+func (s *Service) registerAdminRoutes(router chi.Router) {
+	if s.cfg.Admin.Token == "" {
+		// Keep /admin out of the cache dispatcher, which would answer 403
+		router.HandleFunc("/admin", http.NotFound)
+		router.HandleFunc("/admin/*", http.NotFound)
+		return
+	}
+
+	router.Route("/admin", func(r chi.Router) {
+		r.Use(requireBearerToken(s.cfg.Admin.Token))
+		r.Get("/entries", s.AdminListEntries)
+		r.Delete("/entries", s.AdminPurge)
+		r.Get("/entries/metadata", s.AdminEntryMetadata)
+		r.Get("/stats", s.AdminStats)
+	})
+}
+
+// requireBearerToken rejects requests without "Authorization: Bearer <token>"
+func requireBearerToken(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				logger.Warnf("Rejected unauthenticated admin request %s %s", r.Method, r.URL.Path)
+				w.Header().Set("WWW-Authenticate", `Bearer realm="terrapeak-admin"`)
+				writeAdminJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// AdminListEntries lists the cached objects under ?prefix= with their size
+// and age, up to ?limit= entries after the key ?start_after=. The response
+// carries the start_after of the next page while there is one.
+func (s *Service) AdminListEntries(w http.ResponseWriter, r *http.Request) {
+	prefix, startAfter := r.URL.Query().Get("prefix"), r.URL.Query().Get("start_after")
+	limit := defaultAdminListLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			writeAdminJSON(w, http.StatusBadRequest, map[string]string{"error": "limit must be a positive number"})
+			return
+		}
+		limit = n
+	}
+
+	objects, next, err := s.store.ListPage(r.Context(), prefix, startAfter, limit)
+	if err != nil {
+		logger.Errorf("Failed to list cache entries under %q: %v", prefix, err)
+		writeAdminJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	now := time.Now()
+	entries := make([]adminEntry, 0, len(objects))
+	for _, info := range objects {
+		entries = append(entries, adminEntry{
+			Key:        info.Key,
+			Size:       info.Size,
+			Modified:   info.Modified.UTC(),
+			AgeSeconds: int64(now.Sub(info.Modified).Seconds()),
+		})
+	}
+
+	writeAdminJSON(w, http.StatusOK, map[string]any{
+		"prefix":           prefix,
+		"entries":          entries,
+		"truncated":        next != "",
+		"next_start_after": next,
+	})
+}
+
+// AdminEntryMetadata returns the metadata record of the object ?key=
+func (s *Service) AdminEntryMetadata(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		writeAdminJSON(w, http.StatusBadRequest, map[string]string{"error": "key is required"})
+		return
+	}
+
+	record, err := s.store.Metadata(r.Context(), key)
+	if err != nil {
+		writeAdminJSON(w, http.StatusNotFound, map[string]string{"error": "no metadata for " + key})
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, record)
+}
+
+// AdminPurge removes the object ?key=, or every object under ?prefix=, with
+// their metadata records, and the upstream 404s remembered for them. The
+// verification expectations of provider archives are not cached content and
+// are never purged.
+func (s *Service) AdminPurge(w http.ResponseWriter, r *http.Request) {
+	key, prefix := r.URL.Query().Get("key"), r.URL.Query().Get("prefix")
+	if (key == "") == (prefix == "") {
+		writeAdminJSON(w, http.StatusBadRequest, map[string]string{"error": "exactly one of key and prefix is required"})
+		return
+	}
+
+	keys := []string{key}
+	if prefix != "" {
+		listed, err := s.store.List(r.Context(), prefix)
+		if err != nil {
+			logger.Errorf("Failed to list cache entries under %q: %v", prefix, err)
+			writeAdminJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		keys = listed[:0]
+		for _, k := range listed {
+			if !isVerificationKey(k) {
+				keys = append(keys, k)
+			}
+		}
+	} else if isVerificationKey(key) {
+		writeAdminJSON(w, http.StatusForbidden, map[string]string{"error": "verification records cannot be purged"})
+		return
+	}
+
+	// Remembered upstream 404s are dropped too, so a purge also retries
+	// what was not found
+	forgotten := s.notFound.forget(key, prefix)
+	if prefix == "" && !s.store.FileExists(r.Context(), key) {
+		if forgotten == 0 {
+			writeAdminJSON(w, http.StatusNotFound, map[string]string{"error": key + " is not cached"})
+			return
+		}
+		keys = nil
+	}
+
+	purged := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if err := s.store.Delete(r.Context(), k); err != nil {
+			logger.Errorf("Failed to purge %s: %v", k, err)
+			writeAdminJSON(w, http.StatusInternalServerError, map[string]any{"error": err.Error(), "purged": purged})
+			return
+		}
+		purged = append(purged, k)
+	}
+
+	logger.Infof("Purged %d cache entries and %d remembered 404s (key %q, prefix %q)", len(purged), forgotten, key, prefix)
+	writeAdminJSON(w, http.StatusOK, map[string]any{"purged": purged, "not_found_purged": forgotten})
+}
+
+// AdminStats reports the number of cached objects and their bytes, in total,
+// per upstream host and for the verification records. The sizes come from
+// the listing, one page at a time, rather than from a Stat per object.
+func (s *Service) AdminStats(w http.ResponseWriter, r *http.Request) {
+	var total, verification adminUsage
+	hosts := make(map[string]*adminUsage)
+	for startAfter := ""; ; {
+		objects, next, err := s.store.ListPage(r.Context(), "", startAfter, defaultAdminListLimit)
+		if err != nil {
+			logger.Errorf("Failed to list cache entries: %v", err)
+			writeAdminJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		for _, info := range objects {
+			usage := &verification
+			if !isVerificationKey(info.Key) {
+				host := entryHost(info.Key)
+				if hosts[host] == nil {
+					hosts[host] = &adminUsage{}
+				}
+				usage = hosts[host]
+			}
+			usage.Objects++
+			usage.Bytes += info.Size
+			total.Objects++
+			total.Bytes += info.Size
+		}
+		if next == "" {
+			break
+		}
+		startAfter = next
+	}
+
+	writeAdminJSON(w, http.StatusOK, map[string]any{
+		"objects":      total.Objects,
+		"bytes":        total.Bytes,
+		"hosts":        hosts,
+		"verification": verification,
+	})
+}
+
+// isVerificationKey reports whether key names a verification expectation
+func isVerificationKey(key string) bool {
+	canonical, err := store.NormalizeKey(key)
+	return err == nil && strings.HasPrefix(canonical, metadata.VerificationPrefix)
+}
+
+// entryHost returns the upstream a cache key belongs to: the registry name
+// for registry responses and the host for artifacts, whether fetched over
+// https or plain http
+func entryHost(key string) string {
+	parts := strings.SplitN(key, "/", 3)
+	if (parts[0] == "registry" || parts[0] == "http") && len(parts) > 1 {
+		return parts[1]
+	}
+	return parts[0]
+}
+
+// writeAdminJSON answers an admin request with a JSON body
+func writeAdminJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		logger.Errorf("Failed to write admin response: %v", err)
+	}
+}
@@ -0,0 +1,268 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestAdminAPI(t *testing.T) {
+	cfg := createTestConfig()
+	cfg.Storage.File.Path = t.TempDir()
+	cfg.Admin.Token = "secret"
+
+	service, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	reg := service.registries[0]
+
+	seed := map[string]string{
+		reg.cacheKey("v1/versions/hashicorp/aws"):                                 `{"versions":[]}`,
+		reg.cacheKey("v1/versions/hashicorp/google"):                              `{"versions":[]}`,
+		"releases.hashicorp.com/terraform-provider-aws/5.0.0/provider.zip":        "zip-data",
+		"verification/releases.hashicorp.com/terraform-provider-aws/5.0.0/x.json": `{}`,
+		"github.com/hashicorp/terraform-aws-consul/archive/v0.1.0.tar.gz":         "tarball",
+	}
+	for key, data := range seed {
+		if err := service.store.Save(context.Background(), key, []byte(data)); err != nil {
+			t.Fatalf("Failed to seed %s: %v", key, err)
+		}
+	}
+
+	router := chi.NewRouter()
+	service.RegisterRoutes(router)
+
+	do := func(method, target, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("requires the token", func(t *testing.T) {
+		for _, token := range []string{"", "wrong"} {
+			w := do("GET", "/admin/stats", token)
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("Expected status 401 with token %q, got %d", token, w.Code)
+			}
+		}
+	})
+
+	t.Run("lists entries by prefix", func(t *testing.T) {
+		w := do("GET", "/admin/entries?prefix=releases.hashicorp.com/", "secret")
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", w.Code)
+		}
+		var body struct {
+			Entries []adminEntry `json:"entries"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("Failed to decode listing: %v", err)
+		}
+		if len(body.Entries) != 1 || body.Entries[0].Size != int64(len("zip-data")) {
+			t.Errorf("Expected the archive without its metadata record, got %s", w.Body.String())
+		}
+	})
+
+	t.Run("returns metadata", func(t *testing.T) {
+		w := do("GET", "/admin/entries/metadata?key=releases.hashicorp.com/terraform-provider-aws/5.0.0/provider.zip", "secret")
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", w.Code)
+		}
+		var record struct {
+			Size   int64  `json:"size"`
+			SHA256 string `json:"sha256"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &record); err != nil || record.Size != 8 || record.SHA256 == "" {
+			t.Errorf("Expected the metadata record, got %s", w.Body.String())
+		}
+
+		if w := do("GET", "/admin/entries/metadata?key=missing", "secret"); w.Code != http.StatusNotFound {
+			t.Errorf("Expected status 404 for a missing key, got %d", w.Code)
+		}
+	})
+
+	t.Run("reports usage per host", func(t *testing.T) {
+		w := do("GET", "/admin/stats", "secret")
+		var body struct {
+			Objects      int                    `json:"objects"`
+			Hosts        map[string]*adminUsage `json:"hosts"`
+			Verification adminUsage             `json:"verification"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("Failed to decode stats: %v", err)
+		}
+		if body.Objects != len(seed) {
+			t.Errorf("Expected %d objects, got %d", len(seed), body.Objects)
+		}
+		if usage := body.Hosts["releases.hashicorp.com"]; usage == nil || usage.Objects != 1 {
+			t.Errorf("Expected 1 object for releases.hashicorp.com, got %+v", usage)
+		}
+		if body.Verification.Objects != 1 || body.Verification.Bytes != int64(len(`{}`)) {
+			t.Errorf("Expected the verification record in its own bucket, got %+v", body.Verification)
+		}
+		if usage := body.Hosts[reg.name]; usage == nil || usage.Objects != 2 {
+			t.Errorf("Expected 2 objects for registry %s, got %+v", reg.name, usage)
+		}
+	})
+
+	t.Run("purges a key and a prefix", func(t *testing.T) {
+		versions := reg.cacheKey("v1/versions/hashicorp/aws")
+		if w := do("DELETE", "/admin/entries?key="+versions, "secret"); w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if service.store.FileExists(context.Background(), versions) || service.store.FileExists(context.Background(), versions+".metadata.json") {
+			t.Error("Expected the version list and its metadata to be purged")
+		}
+		if !service.store.FileExists(context.Background(), reg.cacheKey("v1/versions/hashicorp/google")) {
+			t.Error("Expected other version lists to be kept")
+		}
+
+		if w := do("DELETE", "/admin/entries?prefix=github.com/", "secret"); w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", w.Code)
+		}
+		if service.store.FileExists(context.Background(), "github.com/hashicorp/terraform-aws-consul/archive/v0.1.0.tar.gz") {
+			t.Error("Expected the prefix to be purged")
+		}
+
+		expectation := "verification/releases.hashicorp.com/terraform-provider-aws/5.0.0/x.json"
+		if w := do("DELETE", "/admin/entries?key="+expectation, "secret"); w.Code != http.StatusForbidden {
+			t.Errorf("Expected status 403 for a verification record, got %d", w.Code)
+		}
+		if w := do("DELETE", "/admin/entries?prefix=verification/", "secret"); w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", w.Code)
+		}
+		if !service.store.FileExists(context.Background(), expectation) {
+			t.Error("Expected verification records to survive a purge")
+		}
+
+		if w := do("DELETE", "/admin/entries", "secret"); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400 without key or prefix, got %d", w.Code)
+		}
+	})
+
+	t.Run("purges remembered 404s", func(t *testing.T) {
+		notFound := &registryResponse{StatusCode: http.StatusNotFound, Body: []byte("not found")}
+		typo := reg.cacheKey("v1/versions/hashicorp/awss")
+		other := reg.cacheKey("v1/versions/hashicorp/googel")
+		kept := "github.com/hashicorp/missing"
+		for _, key := range []string{typo, other, kept} {
+			service.notFound.put(key, notFound, time.Hour)
+		}
+
+		if w := do("DELETE", "/admin/entries?key="+typo, "secret"); w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200 for a remembered 404, got %d: %s", w.Code, w.Body.String())
+		}
+		if service.getNegativeResponse(typo) != nil {
+			t.Error("Expected the remembered 404 of the key to be purged")
+		}
+
+		if w := do("DELETE", "/admin/entries?prefix="+reg.cacheKey("v1/"), "secret"); w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", w.Code)
+		}
+		if service.getNegativeResponse(other) != nil {
+			t.Error("Expected the remembered 404s under the prefix to be purged")
+		}
+		if service.getNegativeResponse(kept) == nil {
+			t.Error("Expected remembered 404s outside the prefix to be kept")
+		}
+
+		if w := do("DELETE", "/admin/entries?key="+typo, "secret"); w.Code != http.StatusNotFound {
+			t.Errorf("Expected status 404 once nothing is left to purge, got %d", w.Code)
+		}
+	})
+}
+
+func TestAdminListEntriesPages(t *testing.T) {
+	cfg := createTestConfig()
+	cfg.Storage.File.Path = t.TempDir()
+	cfg.Admin.Token = "secret"
+
+	service, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	var expected []string
+	for i := 0; i < 7; i++ {
+		key := fmt.Sprintf("example.com/archives/%02d.zip", i)
+		if err := service.store.Save(context.Background(), key, []byte("data")); err != nil {
+			t.Fatalf("Failed to seed %s: %v", key, err)
+		}
+		expected = append(expected, key)
+	}
+
+	router := chi.NewRouter()
+	service.RegisterRoutes(router)
+
+	var listed []string
+	startAfter := ""
+	for pages := 1; ; pages++ {
+		if pages > len(expected) {
+			t.Fatalf("Listing kept returning pages, got %v so far", listed)
+		}
+		req := httptest.NewRequest("GET", "/admin/entries?prefix=example.com/&limit=3&start_after="+url.QueryEscape(startAfter), nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		var body struct {
+			Entries   []adminEntry `json:"entries"`
+			Truncated bool         `json:"truncated"`
+			Next      string       `json:"next_start_after"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("Failed to decode listing: %v", err)
+		}
+		if len(body.Entries) > 3 {
+			t.Fatalf("Expected at most 3 entries per page, got %s", w.Body.String())
+		}
+		for _, entry := range body.Entries {
+			if entry.Size != 4 {
+				t.Errorf("Expected %s to be 4 bytes, got %d", entry.Key, entry.Size)
+			}
+			listed = append(listed, entry.Key)
+		}
+		if body.Truncated != (body.Next != "") {
+			t.Errorf("Expected truncated only with a next page, got %s", w.Body.String())
+		}
+		if body.Next == "" {
+			if pages != 3 {
+				t.Errorf("Expected 3 pages, got %d", pages)
+			}
+			break
+		}
+		startAfter = body.Next
+	}
+	if fmt.Sprint(listed) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v, got %v", expected, listed)
+	}
+}
+
+func TestAdminAPIDisabledWithoutToken(t *testing.T) {
+	cfg := createTestConfig()
+	cfg.Storage.File.Path = t.TempDir()
+
+	service, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	router := chi.NewRouter()
+	service.RegisterRoutes(router)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/admin/stats", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d", w.Code)
+	}
+}
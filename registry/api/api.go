@@ -2,14 +2,19 @@ package api
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"sync"
 
 	"github.com/aliharirian/TerraPeak/cache"
+	"github.com/aliharirian/TerraPeak/coalesce"
 	"github.com/aliharirian/TerraPeak/config"
 	"github.com/aliharirian/TerraPeak/logger"
 	"github.com/aliharirian/TerraPeak/metrics"
+	"github.com/aliharirian/TerraPeak/policy"
 	"github.com/aliharirian/TerraPeak/proxy"
 	"github.com/aliharirian/TerraPeak/store"
+	"github.com/aliharirian/TerraPeak/verify"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 )
@@ -19,9 +24,27 @@ type Service struct {
 	store        *store.Store
 	proxyHandler *proxy.Handler
 	cacheHandler *cache.Handler
+	verifier     *verify.Verifier
+	policy       *policy.Policy
+	registries   []*upstreamRegistry               // the first entry is the default registry
+	refreshing   sync.Map                          // cache keys with a background refresh in flight
+	notFound     negativeCache                     // recent upstream 404 answers
+	inflight     coalesce.Group[*registryResponse] // upstream fetches of cache misses
 }
 
 func New(cfg *config.Config) (*Service, error) {
+	registries, err := newRegistries(cfg)
+	if err != nil {
+		logger.Errorf("Invalid registry configuration: %v", err)
+		return nil, err
+	}
+
+	providerPolicy, err := policy.New(cfg.Policy)
+	if err != nil {
+		logger.Errorf("Invalid policy configuration: %v", err)
+		return nil, err
+	}
+
 	// Initialize store with config
 	st, err := store.New(cfg)
 	if err != nil {
@@ -37,20 +60,51 @@ func New(cfg *config.Config) (*Service, error) {
 	}
 
 	// Initialize cache handler with injected proxy HTTP client
+	ttlRules := make([]cache.TTLRule, 0, len(cfg.Cache.TTL))
+	for _, rule := range cfg.Cache.TTL {
+		ttlRules = append(ttlRules, cache.TTLRule{Host: rule.Host, Path: rule.Path, TTL: rule.TTL})
+	}
+	rewrites := make([]cache.Rewrite, 0, len(cfg.Cache.Rewrites))
+	for _, rw := range cfg.Cache.Rewrites {
+		rewrites = append(rewrites, cache.Rewrite{Prefix: rw.Prefix, Host: rw.Host, Scheme: rw.Scheme, Port: rw.Port, PathPrefix: rw.PathPrefix})
+	}
+	mirrors := make([]cache.Mirror, 0, len(cfg.Cache.Mirrors))
+	for _, m := range cfg.Cache.Mirrors {
+		mirrors = append(mirrors, cache.Mirror{Host: m.Host, Upstreams: m.Upstreams, HedgeAfter: m.HedgeAfter, Compare: m.CompareChecksums})
+	}
 	cacheHandler, err := cache.NewCacheHandlerWithClient(st, &cache.Config{
-		AllowedHosts:  cfg.Cache.AllowedHosts,
-		SkipSSLVerify: cfg.Cache.SkipSSLVerify,
+		AllowedHosts:      cfg.Cache.AllowedHosts,
+		SkipSSLVerify:     cfg.Cache.SkipSSLVerify,
+		Offline:           cfg.Offline,
+		TTLRules:          ttlRules,
+		HonorCacheControl: cfg.Cache.HonorCacheControl,
+		Rewrites:          rewrites,
+		Mirrors:           mirrors,
+		RedirectHosts:     cfg.Cache.Redirects.AllowedHosts,
+		MaxRedirects:      cfg.Cache.Redirects.MaxHops,
 	}, proxyHandler.GetClient().GetClient())
 	if err != nil {
 		logger.Errorf("Failed to initialize cache handler: %v", err)
 		return nil, err
 	}
 
+	// Provider archives are checked against the SHASUMS and signing keys
+	// recorded from their download details before they are cached
+	verifier := verify.New(st, proxyHandler.GetClient().GetClient())
+	cacheHandler.SetVerifier(verifier)
+
+	if cfg.Offline {
+		logger.Infof("Offline mode: serving from the store only, upstream is never contacted")
+	}
+
 	return &Service{
 		cfg:          cfg,
 		store:        st,
 		proxyHandler: proxyHandler,
 		cacheHandler: cacheHandler,
+		verifier:     verifier,
+		policy:       providerPolicy,
+		registries:   registries,
 	}, nil
 }
 
@@ -62,30 +116,42 @@ func (s *Service) RegisterRoutes(router chi.Router) {
 
 	// Health & Metrics endpoint
 	router.Get("/healthz", func(w http.ResponseWriter, r *http.Request) { metrics.Health(w) })
-	router.Get("/metrics", func(w http.ResponseWriter, r *http.Request) { metrics.Metrics() })
-
-	// Terraform registry endpoints
-	router.Get("/.well-known/terraform.json", s.WellKnown)
-	router.Get("/v1/providers/{namespace}/{name}/versions", s.GetVersionList)
-	router.Get("/v1/providers/{namespace}/{name}/{version}/download/{os}/{arch}", s.GetProviderDownloadDetails)
-	//router.Get("/v1/modules/{name}", s.GetModule)
+	router.Get("/metrics", func(w http.ResponseWriter, r *http.Request) { metrics.Metrics(w) })
+
+	// Terraform registry endpoints: the default (or virtual host) registry at
+	// the root, every prefixed registry below its own prefix
+	s.registerRegistryRoutes(router)
+	for _, reg := range s.registries {
+		if reg.prefix == "" {
+			continue
+		}
+		router.Route("/"+reg.prefix, func(r chi.Router) {
+			r.Use(withRegistry(reg))
+			s.registerRegistryRoutes(r)
+		})
+	}
+	router.Get("/v1/mirror/{hostname}/{namespace}/{type}/{file}", s.GetMirrorDocument)
 
 	// Proxy endpoints
 	router.HandleFunc("/proxy/http/*", s.proxyHandler.HandleHTTPProxy)
 	router.HandleFunc("/proxy/socks", s.HandleSOCKSProxy)
 	router.Get("/proxy/info", s.GetProxyInfo)
 
-	// Mount cache handler for allowed hosts only
-	for _, host := range s.cfg.Cache.AllowedHosts {
-		router.HandleFunc("/"+host, s.cacheHandler.Handle)
-		router.HandleFunc("/"+host+"/*", s.cacheHandler.Handle)
-	}
+	// Cache administration, when an admin token is configured
+	s.registerAdminRoutes(router)
+
+	// Everything else goes to the cache handler, which dispatches on the
+	// first path segment to a rewrite or an allowed host and answers 403
+	// for any other host
+	router.HandleFunc("/*", s.cacheHandler.Handle)
 }
 
+// WellKnown serves the service discovery document of the requested registry
 func (s *Service) WellKnown(responseWriter http.ResponseWriter, request *http.Request) {
+	base := s.registryFor(request).basePath
 	responseWriter.Header().Set("Content-Type", "application/json")
 	responseWriter.WriteHeader(http.StatusOK)
-	_, err := responseWriter.Write([]byte(`{"modules.v1": "/v1/modules/", "providers.v1": "/v1/providers/"}`))
+	_, err := responseWriter.Write([]byte(fmt.Sprintf(`{"modules.v1": "%s/v1/modules/", "providers.v1": "%s/v1/providers/"}`, base, base)))
 	if err != nil {
 		return
 	}
@@ -135,6 +201,3 @@ func (s *Service) GetProxyInfo(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
-
-// GetCacheStatus returns the current cache configuration and status
-// (Removed cache-specific endpoints that were previously added.)
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -11,64 +12,14 @@ import (
 )
 
 func createTestConfig() *config.Config {
-	return &config.Config{
-		Server: struct {
-			Addr         string `yaml:"addr"`
-			ReadTimeout  int    `yaml:"read_timeout"`
-			WriteTimeout int    `yaml:"write_timeout"`
-			IdleTimeout  int    `yaml:"idle_timeout"`
-			Domain       string `yaml:"domain"`
-		}{
-			Domain: "https://test.example.com",
-		},
-		Terraform: struct {
-			RegistryUrl string `yaml:"registry_url"`
-		}{
-			RegistryUrl: "https://registry.terraform.io",
-		},
-		Storage: struct {
-			S3 struct {
-				Enabled   bool   `yaml:"enabled"`
-				Endpoint  string `yaml:"endpoint"`
-				Region    string `yaml:"region"`
-				AccessKey string `yaml:"access_key"`
-				SecretKey string `yaml:"secret_key"`
-				Bucket    string `yaml:"bucket"`
-				SkipSSL   bool   `yaml:"skip_ssl_verify"`
-			} `yaml:"s3"`
-			File struct {
-				Path string `yaml:"path"`
-			} `yaml:"file"`
-		}{
-			S3: struct {
-				Enabled   bool   `yaml:"enabled"`
-				Endpoint  string `yaml:"endpoint"`
-				Region    string `yaml:"region"`
-				AccessKey string `yaml:"access_key"`
-				SecretKey string `yaml:"secret_key"`
-				Bucket    string `yaml:"bucket"`
-				SkipSSL   bool   `yaml:"skip_ssl_verify"`
-			}{
-				Enabled: false,
-			},
-			File: struct {
-				Path string `yaml:"path"`
-			}{
-				Path: "./test-registry",
-			},
-		},
-		Cache: struct {
-			AllowedHosts  []string `yaml:"allowed_hosts"`
-			SkipSSLVerify bool     `yaml:"skip_ssl_verify"`
-			Rewrites      []struct {
-				Prefix string `yaml:"prefix"`
-				Host   string `yaml:"host"`
-			} `yaml:"rewrites"`
-		}{
-			AllowedHosts:  []string{"github.com", "registry.terraform.io", "gitlab.com"},
-			SkipSSLVerify: true,
-		},
-	}
+	cfg := &config.Config{}
+	cfg.Server.Domain = "https://test.example.com"
+	cfg.Terraform.RegistryUrl = "https://registry.terraform.io"
+	cfg.Storage.S3.Enabled = false
+	cfg.Storage.File.Path = "./test-registry"
+	cfg.Cache.AllowedHosts = []string{"github.com", "registry.terraform.io", "gitlab.com"}
+	cfg.Cache.SkipSSLVerify = true
+	return cfg
 }
 
 func TestNew(t *testing.T) {
@@ -166,6 +117,32 @@ func TestRegisterRoutes(t *testing.T) {
 	testEndpoint(t, router, "GET", "/metrics", http.StatusOK)
 }
 
+func TestRegisterRoutes_HostPatterns(t *testing.T) {
+	cfg := createTestConfig()
+	cfg.Storage.File.Path = t.TempDir()
+	cfg.Cache.AllowedHosts = []string{"*.githubusercontent.com", "!gist.githubusercontent.com", "nexus.corp.local:8443"}
+	// Offline, allowed hosts answer 404 for anything not cached
+	cfg.Offline = true
+
+	service, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	router := chi.NewRouter()
+	service.RegisterRoutes(router)
+
+	testEndpoint(t, router, "GET", "/objects.githubusercontent.com/asset.zip", http.StatusNotFound)
+	testEndpoint(t, router, "GET", "/release-assets.githubusercontent.com/a/b.zip", http.StatusNotFound)
+	testEndpoint(t, router, "GET", "/nexus.corp.local:8443/repo/file.zip", http.StatusNotFound)
+	testEndpoint(t, router, "GET", "/gist.githubusercontent.com/raw/file", http.StatusForbidden)
+	testEndpoint(t, router, "GET", "/githubusercontent.com/file", http.StatusForbidden)
+	testEndpoint(t, router, "GET", "/nexus.corp.local/repo/file.zip", http.StatusForbidden)
+	testEndpoint(t, router, "GET", "/example.com/file", http.StatusForbidden)
+
+	// Explicit routes still win over the dispatcher
+	testEndpoint(t, router, "GET", "/healthz", http.StatusOK)
+}
+
 func testEndpoint(t *testing.T, router chi.Router, method, path string, expectedStatus int) {
 	req := httptest.NewRequest(method, path, nil)
 	w := httptest.NewRecorder()
@@ -195,20 +172,20 @@ func TestGetCachedResponse(t *testing.T) {
 
 	// Test non-existent cache
 	cacheKey := "test/cache/key"
-	response := service.getCachedResponse(cacheKey)
+	response := service.getCachedResponse(context.Background(), cacheKey)
 	if response != nil {
 		t.Error("Expected nil for non-existent cache")
 	}
 
 	// Create a cached response
 	testData := []byte(`{"test": "data"}`)
-	err = service.store.Save(cacheKey, testData)
+	err = service.store.Save(context.Background(), cacheKey, testData)
 	if err != nil {
 		t.Fatalf("Failed to save test cache: %v", err)
 	}
 
 	// Test existing cache
-	response = service.getCachedResponse(cacheKey)
+	response = service.getCachedResponse(context.Background(), cacheKey)
 	if response == nil {
 		t.Error("Expected non-nil for existing cache")
 	}
@@ -238,15 +215,15 @@ func TestCacheResponse(t *testing.T) {
 	testData := []byte(`{"cached": "response"}`)
 
 	// Cache the response
-	service.cacheResponse(cacheKey, testData)
+	service.cacheResponse(cacheKey, "https://registry.example.com/test", testData)
 
 	// Verify it was cached
-	if !service.store.FileExists(cacheKey) {
+	if !service.store.FileExists(context.Background(), cacheKey) {
 		t.Error("Expected file to exist after caching")
 	}
 
 	// Read it back
-	cached, err := service.store.ReadFromStorage(cacheKey)
+	cached, err := service.store.ReadFromStorage(context.Background(), cacheKey)
 	if err != nil {
 		t.Fatalf("Failed to read cached response: %v", err)
 	}
@@ -254,6 +231,11 @@ func TestCacheResponse(t *testing.T) {
 	if string(cached) != string(testData) {
 		t.Errorf("Expected cached data %s, got %s", testData, cached)
 	}
+
+	record, err := service.store.Metadata(context.Background(), cacheKey)
+	if err != nil || record.SourceURL != "https://registry.example.com/test" {
+		t.Errorf("Expected the source URL to be recorded, got %+v, %v", record, err)
+	}
 }
 
 // Helper function to check if string contains substring
@@ -0,0 +1,227 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/aliharirian/TerraPeak/logger"
+	"github.com/go-chi/chi/v5"
+)
+
+// providerVersions is the subset of the registry version listing the mirror
+// protocol needs
+type providerVersions struct {
+	Versions []struct {
+		Version   string   `json:"version"`
+		Protocols []string `json:"protocols"`
+		Platforms []struct {
+			OS   string `json:"os"`
+			Arch string `json:"arch"`
+		} `json:"platforms"`
+	} `json:"versions"`
+}
+
+// mirrorIndex is the provider network mirror index.json document
+type mirrorIndex struct {
+	Versions map[string]struct{} `json:"versions"`
+}
+
+// mirrorArchive describes one platform package in a mirror {version}.json
+type mirrorArchive struct {
+	URL    string   `json:"url"`
+	Hashes []string `json:"hashes,omitempty"`
+}
+
+// mirrorVersion is the provider network mirror {version}.json document
+type mirrorVersion struct {
+	Archives map[string]mirrorArchive `json:"archives"`
+}
+
+// GetMirrorDocument implements the provider network mirror protocol, serving
+// /:hostname/:namespace/:type/index.json and /:hostname/:namespace/:type/:version.json
+// so clients can keep canonical provider addresses and still download through TerraPeak
+func (s *Service) GetMirrorDocument(w http.ResponseWriter, r *http.Request) {
+	hostname := chi.URLParam(r, "hostname")
+	namespace := chi.URLParam(r, "namespace")
+	name := chi.URLParam(r, "type")
+	file := chi.URLParam(r, "file")
+
+	reg := s.registryByHost(hostname)
+	if reg == nil {
+		logger.Debugf("Mirror request for unknown registry host %s", hostname)
+		http.Error(w, fmt.Sprintf("registry host %s is not mirrored", hostname), http.StatusNotFound)
+		return
+	}
+
+	if !strings.HasSuffix(file, ".json") {
+		http.NotFound(w, r)
+		return
+	}
+
+	var (
+		document any
+		err      error
+		status   int
+	)
+	if file == "index.json" {
+		var index *mirrorIndex
+		if index, status, err = s.mirrorIndex(r.Context(), reg, namespace, name); index != nil {
+			// Hide the versions the policy blocks
+			for version := range index.Versions {
+				if !s.checkPolicy(r, namespace, name, version).Allowed {
+					delete(index.Versions, version)
+				}
+			}
+			document = index
+		}
+	} else {
+		version := strings.TrimSuffix(file, ".json")
+		if decision := s.checkPolicy(r, namespace, name, version); !decision.Allowed {
+			writePolicyDenied(w, namespace, name, version, decision)
+			return
+		}
+
+		var archives *mirrorVersion
+		if archives, status, err = s.mirrorVersion(r.Context(), reg, namespace, name, version); archives != nil {
+			document = archives
+		}
+	}
+	if err != nil {
+		writeFetchError(w, err)
+		return
+	}
+	if document == nil {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(document); err != nil {
+		logger.Errorf("Failed to encode mirror document: %v", err)
+	}
+}
+
+// loadProviderVersions fetches and decodes the provider version listing. A
+// nil result with a status code means upstream answered with an error.
+func (s *Service) loadProviderVersions(ctx context.Context, reg *upstreamRegistry, namespace, name string) (*providerVersions, int, error) {
+	resp, err := s.fetchVersionList(ctx, reg, namespace, name)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode, nil
+	}
+
+	var versions providerVersions
+	if err := json.Unmarshal(resp.Body, &versions); err != nil {
+		return nil, 0, fmt.Errorf("failed to parse version list: %w", err)
+	}
+	return &versions, http.StatusOK, nil
+}
+
+// mirrorIndex builds the index.json document listing every available version
+func (s *Service) mirrorIndex(ctx context.Context, reg *upstreamRegistry, namespace, name string) (*mirrorIndex, int, error) {
+	versions, status, err := s.loadProviderVersions(ctx, reg, namespace, name)
+	if versions == nil {
+		return nil, status, err
+	}
+
+	index := &mirrorIndex{Versions: make(map[string]struct{}, len(versions.Versions))}
+	for _, v := range versions.Versions {
+		index.Versions[v.Version] = struct{}{}
+	}
+	return index, http.StatusOK, nil
+}
+
+// mirrorVersion builds the {version}.json document from the download details
+// of every platform the version is published for
+func (s *Service) mirrorVersion(ctx context.Context, reg *upstreamRegistry, namespace, name, version string) (*mirrorVersion, int, error) {
+	versions, status, err := s.loadProviderVersions(ctx, reg, namespace, name)
+	if versions == nil {
+		return nil, status, err
+	}
+
+	type platform struct{ os, arch string }
+	var platforms []platform
+	for _, v := range versions.Versions {
+		if v.Version != version {
+			continue
+		}
+		for _, p := range v.Platforms {
+			platforms = append(platforms, platform{os: p.OS, arch: p.Arch})
+		}
+	}
+	if len(platforms) == 0 {
+		return nil, http.StatusNotFound, nil
+	}
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		firstErr error
+		document = &mirrorVersion{Archives: make(map[string]mirrorArchive, len(platforms))}
+	)
+	for _, p := range platforms {
+		wg.Add(1)
+		go func(p platform) {
+			defer wg.Done()
+
+			archive, err := s.mirrorArchive(ctx, reg, namespace, name, version, p.os, p.arch)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			if archive != nil {
+				document.Archives[p.os+"_"+p.arch] = *archive
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, 0, firstErr
+	}
+	return document, http.StatusOK, nil
+}
+
+// mirrorArchive turns the download details of one platform into a mirror
+// archive entry. Platforms upstream does not serve are skipped (nil, nil).
+func (s *Service) mirrorArchive(ctx context.Context, reg *upstreamRegistry, namespace, name, version, os, arch string) (*mirrorArchive, error) {
+	resp, err := s.fetchDownloadDetails(ctx, reg, namespace, name, version, os, arch)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		logger.Warnf("Skipping %s/%s %s %s_%s in mirror document: upstream status %d", namespace, name, version, os, arch, resp.StatusCode)
+		return nil, nil
+	}
+
+	var details struct {
+		DownloadURL string `json:"download_url"`
+		Shasum      string `json:"shasum"`
+	}
+	if err := json.Unmarshal(resp.Body, &details); err != nil {
+		return nil, fmt.Errorf("failed to parse download details: %w", err)
+	}
+	if details.DownloadURL == "" {
+		return nil, nil
+	}
+
+	archive := &mirrorArchive{URL: details.DownloadURL}
+	if details.Shasum != "" {
+		// "zh:" hashes are the SHA256 of the zip archive, which is exactly
+		// what the registry reports as shasum
+		archive.Hashes = []string{"zh:" + details.Shasum}
+	}
+	return archive, nil
+}
@@ -0,0 +1,156 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func newMirrorTestService(t *testing.T) (*Service, chi.Router, string) {
+	t.Helper()
+
+	mockUpstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/v1/providers/hashicorp/aws/versions":
+			fmt.Fprint(w, `{"versions":[
+				{"version":"5.0.0","protocols":["5.0"],"platforms":[{"os":"linux","arch":"amd64"},{"os":"darwin","arch":"arm64"}]},
+				{"version":"5.1.0","protocols":["5.0"],"platforms":[{"os":"linux","arch":"amd64"}]}
+			]}`)
+		case strings.HasPrefix(r.URL.Path, "/v1/providers/hashicorp/aws/5.0.0/download/"):
+			parts := strings.Split(r.URL.Path, "/")
+			platform := parts[len(parts)-2] + "_" + parts[len(parts)-1]
+			fmt.Fprintf(w, `{
+				"download_url": "https://releases.hashicorp.com/terraform-provider-aws/5.0.0/terraform-provider-aws_5.0.0_%s.zip",
+				"shasum": "sum-%s"
+			}`, platform, platform)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errors":["Not Found"]}`)
+		}
+	}))
+	t.Cleanup(mockUpstream.Close)
+
+	tempDir := t.TempDir()
+
+	cfg := createTestConfig()
+	cfg.Storage.File.Path = tempDir
+	cfg.Terraform.RegistryUrl = mockUpstream.URL
+	cfg.Server.Domain = "https://cache.example.com"
+
+	service, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+
+	router := chi.NewRouter()
+	router.Get("/v1/mirror/{hostname}/{namespace}/{type}/{file}", service.GetMirrorDocument)
+
+	upstreamURL, _ := url.Parse(mockUpstream.URL)
+	return service, router, upstreamURL.Host
+}
+
+func TestGetMirrorIndex(t *testing.T) {
+	_, router, host := newMirrorTestService(t)
+
+	req := httptest.NewRequest("GET", "/v1/mirror/"+host+"/hashicorp/aws/index.json", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var index mirrorIndex
+	if err := json.Unmarshal(w.Body.Bytes(), &index); err != nil {
+		t.Fatalf("Failed to decode index: %v", err)
+	}
+	for _, v := range []string{"5.0.0", "5.1.0"} {
+		if _, ok := index.Versions[v]; !ok {
+			t.Errorf("Expected version %s in index, got %v", v, index.Versions)
+		}
+	}
+}
+
+func TestGetMirrorVersion(t *testing.T) {
+	_, router, host := newMirrorTestService(t)
+
+	req := httptest.NewRequest("GET", "/v1/mirror/"+host+"/hashicorp/aws/5.0.0.json", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var document mirrorVersion
+	if err := json.Unmarshal(w.Body.Bytes(), &document); err != nil {
+		t.Fatalf("Failed to decode version document: %v", err)
+	}
+	if len(document.Archives) != 2 {
+		t.Fatalf("Expected 2 archives, got %d", len(document.Archives))
+	}
+
+	archive := document.Archives["linux_amd64"]
+	expectedURL := "https://cache.example.com/releases.hashicorp.com/terraform-provider-aws/5.0.0/terraform-provider-aws_5.0.0_linux_amd64.zip"
+	if archive.URL != expectedURL {
+		t.Errorf("Expected URL %s, got %s", expectedURL, archive.URL)
+	}
+	if len(archive.Hashes) != 1 || archive.Hashes[0] != "zh:sum-linux_amd64" {
+		t.Errorf("Expected zh: hash, got %v", archive.Hashes)
+	}
+}
+
+func TestGetMirrorDocumentNotFound(t *testing.T) {
+	_, router, host := newMirrorTestService(t)
+
+	tests := []struct {
+		name string
+		path string
+	}{
+		{"unknown registry host", "/v1/mirror/registry.example.com/hashicorp/aws/index.json"},
+		{"unknown version", "/v1/mirror/" + host + "/hashicorp/aws/9.9.9.json"},
+		{"unknown provider", "/v1/mirror/" + host + "/hashicorp/nope/index.json"},
+		{"not a json document", "/v1/mirror/" + host + "/hashicorp/aws/index.html"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != http.StatusNotFound {
+				t.Errorf("Expected status 404, got %d", w.Code)
+			}
+		})
+	}
+}
+
+func TestGetMirrorDocumentUpstreamError(t *testing.T) {
+	cfg := createTestConfig()
+	cfg.Storage.File.Path = t.TempDir()
+	cfg.Terraform.RegistryUrl = "http://nonexistent-upstream.example.com"
+
+	service, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+
+	router := chi.NewRouter()
+	router.Get("/v1/mirror/{hostname}/{namespace}/{type}/{file}", service.GetMirrorDocument)
+
+	req := httptest.NewRequest("GET", "/v1/mirror/nonexistent-upstream.example.com/hashicorp/aws/index.json", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("Expected status 502, got %d", w.Code)
+	}
+}
@@ -1 +1,229 @@
 package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/aliharirian/TerraPeak/cache"
+	"github.com/aliharirian/TerraPeak/logger"
+	"github.com/aliharirian/TerraPeak/modarchive"
+	"github.com/go-chi/chi/v5"
+)
+
+// GetModuleVersions serves the module registry version listing
+func (s *Service) GetModuleVersions(w http.ResponseWriter, r *http.Request) {
+	namespace := chi.URLParam(r, "namespace")
+	name := chi.URLParam(r, "name")
+	provider := chi.URLParam(r, "provider")
+	reg := s.registryFor(r).registry
+
+	upstreamURL := reg.url + "/v1/modules/" + namespace + "/" + name + "/" + provider + "/versions"
+
+	// Generate cache key for this request
+	cacheKey := reg.cacheKey("v1/modules/versions/%s/%s/%s", namespace, name, provider)
+
+	// Check if response exists in cache, refreshing it once it is older than the TTL
+	refresh := func() { s.fetchModuleVersions(upstreamURL, cacheKey) }
+	if cachedResponse, cacheStatus := s.getCachedEntry(r.Context(), cacheKey, s.cfg.Terraform.CacheTTL.ModuleVersions, refresh); cachedResponse != nil {
+		logger.Infof("Cache %s: Serving cached module versions for %s/%s/%s", cacheStatus, namespace, name, provider)
+		if s.cfg.Offline {
+			var err error
+			if cachedResponse, err = s.offlineModuleVersions(r.Context(), reg, namespace, name, provider, cachedResponse); err != nil {
+				writeFetchError(w, err)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Cache-Status", cacheStatus)
+		w.WriteHeader(http.StatusOK)
+		w.Write(cachedResponse)
+		return
+	}
+
+	if notFound := s.getNegativeResponse(cacheKey); notFound != nil {
+		logger.Infof("Cache NEGATIVE: Module versions for %s/%s/%s were recently not found", namespace, name, provider)
+		notFound.write(w)
+		return
+	}
+
+	if s.cfg.Offline {
+		logger.Infof("Cache MISS: Module versions for %s/%s/%s are not stored (offline mode)", namespace, name, provider)
+		offlineMiss(fmt.Sprintf("module %s/%s/%s", namespace, name, provider)).write(w)
+		return
+	}
+
+	// Cache miss - fetch from upstream
+	logger.Infof("Cache MISS: Fetching module versions for %s/%s/%s from upstream", namespace, name, provider)
+	resp, err := s.fetchCoalesced(cacheKey, func() (*registryResponse, error) {
+		return s.fetchModuleVersions(upstreamURL, cacheKey)
+	})
+	if err != nil {
+		writeFetchError(w, err)
+		return
+	}
+	resp.write(w)
+}
+
+// fetchModuleVersions fetches a module version listing from upstream and
+// caches it under cacheKey
+func (s *Service) fetchModuleVersions(upstreamURL, cacheKey string) (*registryResponse, error) {
+	resp, err := s.proxyHandler.GetClient().Get(upstreamURL)
+	if err != nil {
+		logger.Errorf("Failed to fetch module versions from upstream %s: %v", upstreamURL, err)
+		return nil, &upstreamError{URL: upstreamURL, Err: err}
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.New("failed to read response")
+	}
+
+	response := &registryResponse{
+		StatusCode:  resp.StatusCode,
+		ContentType: resp.Header.Get("Content-Type"),
+		Body:        respBody,
+		CacheStatus: "MISS",
+	}
+
+	// Only valid listings are worth keeping
+	if resp.StatusCode == http.StatusOK && json.Valid(respBody) {
+		s.cacheResponse(cacheKey, upstreamURL, respBody)
+	} else {
+		s.cacheNegativeResponse(cacheKey, response)
+	}
+
+	return response, nil
+}
+
+// GetModuleDownload resolves the download location of a module version and
+// points the X-Terraform-Get header back at TerraPeak
+func (s *Service) GetModuleDownload(w http.ResponseWriter, r *http.Request) {
+	namespace := chi.URLParam(r, "namespace")
+	name := chi.URLParam(r, "name")
+	provider := chi.URLParam(r, "provider")
+	version := chi.URLParam(r, "version")
+	reg := s.registryFor(r).registry
+
+	upstreamURL := reg.url + "/v1/modules/" + namespace + "/" + name + "/" + provider + "/" + version + "/download"
+
+	// The cached entry holds the upstream location; it is rewritten on every
+	// response so a change of server.domain does not invalidate the cache
+	cacheKey := reg.cacheKey("v1/modules/download/%s/%s/%s/%s", namespace, name, provider, version)
+
+	refresh := func() { s.fetchModuleLocation(upstreamURL, cacheKey) }
+	if cachedResponse, cacheStatus := s.getCachedEntry(r.Context(), cacheKey, s.cfg.Terraform.CacheTTL.ModuleDownload, refresh); cachedResponse != nil {
+		logger.Infof("Cache %s: Serving cached module location for %s/%s/%s/%s", cacheStatus, namespace, name, provider, version)
+		w.Header().Set("X-Terraform-Get", s.moduleSourceURL(string(cachedResponse), upstreamURL))
+		w.Header().Set("X-Cache-Status", cacheStatus)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if notFound := s.getNegativeResponse(cacheKey); notFound != nil {
+		logger.Infof("Cache NEGATIVE: Module location for %s/%s/%s/%s was recently not found", namespace, name, provider, version)
+		notFound.write(w)
+		return
+	}
+
+	if s.cfg.Offline {
+		logger.Infof("Cache MISS: Module location for %s/%s/%s/%s is not stored (offline mode)", namespace, name, provider, version)
+		offlineMiss(fmt.Sprintf("module %s/%s/%s %s", namespace, name, provider, version)).write(w)
+		return
+	}
+
+	logger.Infof("Cache MISS: Fetching module location for %s/%s/%s/%s from upstream", namespace, name, provider, version)
+
+	location, errResp, err := s.fetchModuleLocation(upstreamURL, cacheKey)
+	if err != nil {
+		writeFetchError(w, err)
+		return
+	}
+	if errResp != nil {
+		// Pass upstream errors (unknown module, version, ...) through untouched
+		errResp.write(w)
+		return
+	}
+
+	w.Header().Set("X-Terraform-Get", s.moduleSourceURL(location, upstreamURL))
+	w.Header().Set("X-Cache-Status", "MISS")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// fetchModuleLocation asks upstream for the X-Terraform-Get location of a
+// module version and caches it under cacheKey. Upstream error answers are
+// returned as a response to pass on to the client.
+func (s *Service) fetchModuleLocation(upstreamURL, cacheKey string) (string, *registryResponse, error) {
+	resp, err := s.proxyHandler.GetClient().Get(upstreamURL)
+	if err != nil {
+		logger.Errorf("Failed to fetch module location from upstream %s: %v", upstreamURL, err)
+		return "", nil, &upstreamError{URL: upstreamURL, Err: err}
+	}
+	defer resp.Body.Close()
+
+	location := resp.Header.Get("X-Terraform-Get")
+	if location == "" {
+		respBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return "", nil, errors.New("failed to read response")
+		}
+		if resp.StatusCode < 300 {
+			logger.Errorf("Upstream %s returned no X-Terraform-Get header", upstreamURL)
+			return "", nil, &upstreamError{URL: upstreamURL, Err: errors.New("no module location returned")}
+		}
+		errResp := &registryResponse{
+			StatusCode:  resp.StatusCode,
+			ContentType: resp.Header.Get("Content-Type"),
+			Body:        respBody,
+			CacheStatus: "MISS",
+		}
+		s.cacheNegativeResponse(cacheKey, errResp)
+		return "", errResp, nil
+	}
+
+	s.cacheResponse(cacheKey, upstreamURL, []byte(location))
+	return location, nil, nil
+}
+
+// moduleSourceURL rewrites a module location to be downloaded through the
+// cache handler. Locations whose archive host is not in cache.allowed_hosts,
+// or that cannot be fetched as an https archive, are returned unchanged.
+func (s *Service) moduleSourceURL(location, upstreamURL string) string {
+	archiveURL, subdir, ok := modarchive.URL(location, upstreamURL)
+	if !ok {
+		logger.Debugf("Module location %s cannot be cached, passing it through", location)
+		return location
+	}
+
+	// The cache handler fetches /{host}/{path} over https, so plain http
+	// archives are passed through rather than fetched with another scheme
+	if archiveURL.Scheme != "https" {
+		logger.Debugf("Module archive %s is not served over https, passing it through", archiveURL.Redacted())
+		return location
+	}
+
+	// Port 443 is the https default and counts as no port
+	if !cache.MatchHost(s.cfg.Cache.AllowedHosts, archiveURL.Host, "443") {
+		logger.Debugf("Module archive host %s is not in allowed hosts, passing %s through", archiveURL.Host, location)
+		return location
+	}
+
+	cacherURL, err := url.Parse(s.cfg.Server.Domain)
+	if err != nil || cacherURL.Host == "" {
+		return location
+	}
+
+	// Same layout as AppFirstURL: cacher host + original host + original path
+	rewritten := cacherURL.Scheme + "://" + cacherURL.Host + "/" + archiveURL.Host + archiveURL.EscapedPath()
+	if subdir != "" {
+		rewritten += "//" + subdir
+	}
+	if archiveURL.RawQuery != "" {
+		rewritten += "?" + archiveURL.RawQuery
+	}
+	return rewritten
+}
@@ -0,0 +1,183 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestGetModuleVersionsWithMockUpstream(t *testing.T) {
+	requestCount := 0
+	mockUpstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestCount++
+		if r.URL.Path != "/v1/modules/terraform-aws-modules/vpc/aws/versions" {
+			t.Errorf("Unexpected upstream path %s", r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, `{"modules":[{"versions":[{"version":"5.0.0"}]}]}`)
+	}))
+	defer mockUpstream.Close()
+
+	tempDir, err := os.MkdirTemp("", "module-test-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cfg := createTestConfig()
+	cfg.Storage.File.Path = tempDir
+	cfg.Terraform.RegistryUrl = mockUpstream.URL
+
+	service, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+
+	router := chi.NewRouter()
+	router.Get("/v1/modules/{namespace}/{name}/{provider}/versions", service.GetModuleVersions)
+
+	req := httptest.NewRequest("GET", "/v1/modules/terraform-aws-modules/vpc/aws/versions", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", w.Code)
+	}
+	if w.Header().Get("X-Cache-Status") != "MISS" {
+		t.Errorf("Expected X-Cache-Status: MISS, got %s", w.Header().Get("X-Cache-Status"))
+	}
+
+	w2 := httptest.NewRecorder()
+	router.ServeHTTP(w2, req)
+
+	if w2.Header().Get("X-Cache-Status") != "HIT" {
+		t.Errorf("Expected X-Cache-Status: HIT, got %s", w2.Header().Get("X-Cache-Status"))
+	}
+	if w2.Body.String() != w.Body.String() {
+		t.Errorf("Expected cached body %s, got %s", w.Body.String(), w2.Body.String())
+	}
+	if requestCount != 1 {
+		t.Errorf("Expected upstream to be called once, got %d", requestCount)
+	}
+}
+
+func TestGetModuleDownloadWithMockUpstream(t *testing.T) {
+	requestCount := 0
+	mockUpstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestCount++
+		w.Header().Set("X-Terraform-Get", "git::https://github.com/terraform-aws-modules/terraform-aws-vpc?ref=v5.0.0")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer mockUpstream.Close()
+
+	tempDir, err := os.MkdirTemp("", "module-test-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cfg := createTestConfig()
+	cfg.Storage.File.Path = tempDir
+	cfg.Terraform.RegistryUrl = mockUpstream.URL
+	cfg.Server.Domain = "https://cache.example.com"
+	cfg.Cache.AllowedHosts = append(cfg.Cache.AllowedHosts, "codeload.github.com")
+
+	service, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+
+	router := chi.NewRouter()
+	router.Get("/v1/modules/{namespace}/{name}/{provider}/{version}/download", service.GetModuleDownload)
+
+	expected := "https://cache.example.com/codeload.github.com/terraform-aws-modules/terraform-aws-vpc/tar.gz/v5.0.0//*?archive=tar.gz"
+
+	for i, cacheStatus := range []string{"MISS", "HIT"} {
+		req := httptest.NewRequest("GET", "/v1/modules/terraform-aws-modules/vpc/aws/5.0.0/download", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusNoContent {
+			t.Errorf("Request %d: expected status 204, got %d", i, w.Code)
+		}
+		if got := w.Header().Get("X-Terraform-Get"); got != expected {
+			t.Errorf("Request %d: expected X-Terraform-Get %s, got %s", i, expected, got)
+		}
+		if got := w.Header().Get("X-Cache-Status"); got != cacheStatus {
+			t.Errorf("Request %d: expected X-Cache-Status %s, got %s", i, cacheStatus, got)
+		}
+	}
+
+	if requestCount != 1 {
+		t.Errorf("Expected upstream to be called once, got %d", requestCount)
+	}
+}
+
+func TestGetModuleDownloadDisallowedArchiveHost(t *testing.T) {
+	location := "git::https://github.com/terraform-aws-modules/terraform-aws-vpc?ref=v5.0.0"
+	mockUpstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Terraform-Get", location)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer mockUpstream.Close()
+
+	tempDir, err := os.MkdirTemp("", "module-test-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cfg := createTestConfig()
+	cfg.Storage.File.Path = tempDir
+	cfg.Terraform.RegistryUrl = mockUpstream.URL
+
+	service, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+
+	router := chi.NewRouter()
+	router.Get("/v1/modules/{namespace}/{name}/{provider}/{version}/download", service.GetModuleDownload)
+
+	req := httptest.NewRequest("GET", "/v1/modules/terraform-aws-modules/vpc/aws/5.0.0/download", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	// codeload.github.com is not allowed in the test config, so the
+	// original location must be handed back untouched
+	if got := w.Header().Get("X-Terraform-Get"); got != location {
+		t.Errorf("Expected X-Terraform-Get %s, got %s", location, got)
+	}
+}
+
+func TestModuleSourceURL(t *testing.T) {
+	cfg := createTestConfig()
+	cfg.Server.Domain = "https://cache.example.com"
+	cfg.Cache.AllowedHosts = []string{"example.com", "example.com:8443"}
+	service := &Service{cfg: cfg}
+	downloadURL := "https://registry.example.com/v1/modules/acme/vpc/aws/1.0.0/download"
+
+	tests := []struct {
+		name     string
+		location string
+		expected string
+	}{
+		{"https archive", "https://example.com/vpc.tar.gz", "https://cache.example.com/example.com/vpc.tar.gz"},
+		{"https archive on an allowed port", "https://example.com:8443/vpc.tar.gz", "https://cache.example.com/example.com:8443/vpc.tar.gz"},
+		{"http archive", "http://example.com/vpc.tar.gz", "http://example.com/vpc.tar.gz"},
+		{"http archive on port 443", "http://example.com:443/vpc.tar.gz", "http://example.com:443/vpc.tar.gz"},
+		{"disallowed host", "https://other.example.com/vpc.tar.gz", "https://other.example.com/vpc.tar.gz"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := service.moduleSourceURL(tt.location, downloadURL); got != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aliharirian/TerraPeak/logger"
+	"github.com/aliharirian/TerraPeak/store"
+)
+
+// negativeCache remembers upstream "not found" answers for a short time, so
+// retries of a typo'd provider or module do not reach upstream every time.
+// It lives in memory only: the store holds nothing but valid responses.
+type negativeCache struct {
+	mu      sync.Mutex
+	entries map[string]negativeEntry
+}
+
+type negativeEntry struct {
+	response registryResponse
+	expires  time.Time
+}
+
+// get returns the remembered answer for cacheKey, if it has not expired
+func (nc *negativeCache) get(cacheKey string) *registryResponse {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	entry, ok := nc.entries[cacheKey]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(entry.expires) {
+		delete(nc.entries, cacheKey)
+		return nil
+	}
+
+	resp := entry.response
+	resp.CacheStatus = "NEGATIVE"
+	return &resp
+}
+
+// put remembers resp for ttl
+func (nc *negativeCache) put(cacheKey string, resp *registryResponse, ttl time.Duration) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	now := time.Now()
+	if nc.entries == nil {
+		nc.entries = make(map[string]negativeEntry)
+	}
+	// Drop expired entries so addresses that are never asked for again do
+	// not pile up
+	for key, entry := range nc.entries {
+		if now.After(entry.expires) {
+			delete(nc.entries, key)
+		}
+	}
+	nc.entries[cacheKey] = negativeEntry{response: *resp, expires: now.Add(ttl)}
+}
+
+// forget drops the remembered answers for key, or for every key under prefix
+// when prefix is set, and returns how many were dropped. Keys are compared in
+// their canonical form too, which is how the store and the admin API see them.
+func (nc *negativeCache) forget(key, prefix string) int {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	key = canonicalOr(key)
+	dropped := 0
+	for cacheKey := range nc.entries {
+		for _, k := range []string{cacheKey, canonicalOr(cacheKey)} {
+			if (prefix != "" && strings.HasPrefix(k, prefix)) || (prefix == "" && k == key) {
+				delete(nc.entries, cacheKey)
+				dropped++
+				break
+			}
+		}
+	}
+	return dropped
+}
+
+// canonicalOr returns the canonical form of key, or key itself when it has
+// none
+func canonicalOr(key string) string {
+	if canonical, err := store.NormalizeKey(key); err == nil {
+		return canonical
+	}
+	return key
+}
+
+// getNegativeResponse returns a remembered upstream "not found" answer
+func (s *Service) getNegativeResponse(cacheKey string) *registryResponse {
+	return s.notFound.get(cacheKey)
+}
+
+// cacheNegativeResponse remembers an upstream 404 for terraform.cache_ttl.not_found.
+// Other statuses are never cached.
+func (s *Service) cacheNegativeResponse(cacheKey string, resp *registryResponse) {
+	ttl := s.cfg.Terraform.CacheTTL.NotFound
+	if resp.StatusCode != http.StatusNotFound || ttl <= 0 {
+		return
+	}
+	s.notFound.put(cacheKey, resp, ttl)
+	logger.Debugf("Remembering upstream 404 for %s for %s", cacheKey, ttl)
+}
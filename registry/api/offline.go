@@ -0,0 +1,138 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/aliharirian/TerraPeak/logger"
+	"github.com/aliharirian/TerraPeak/modarchive"
+)
+
+// offlineMiss answers a cache miss in offline mode without contacting upstream
+func offlineMiss(what string) *registryResponse {
+	body, _ := json.Marshal(map[string][]string{
+		"errors": {fmt.Sprintf("%s is not in the cache and TerraPeak is running in offline mode", what)},
+	})
+	return &registryResponse{
+		StatusCode:  http.StatusNotFound,
+		ContentType: "application/json",
+		Body:        body,
+		CacheStatus: "MISS",
+	}
+}
+
+// offlineVersionList trims a cached provider version listing down to the
+// versions and platforms whose download details and archive are both stored
+func (s *Service) offlineVersionList(ctx context.Context, reg *upstreamRegistry, namespace, name string, resp *registryResponse) (*registryResponse, error) {
+	var body map[string]any
+	if err := json.Unmarshal(resp.Body, &body); err != nil {
+		return nil, fmt.Errorf("failed to parse version list: %w", err)
+	}
+
+	versions, _ := body["versions"].([]any)
+	available := make([]any, 0, len(versions))
+	for _, v := range versions {
+		entry, _ := v.(map[string]any)
+		version, _ := entry["version"].(string)
+		platforms, _ := entry["platforms"].([]any)
+
+		stored := make([]any, 0, len(platforms))
+		for _, p := range platforms {
+			platform, _ := p.(map[string]any)
+			os, _ := platform["os"].(string)
+			arch, _ := platform["arch"].(string)
+			if s.isProviderStored(ctx, reg, namespace, name, version, os, arch) {
+				stored = append(stored, p)
+			}
+		}
+		if len(stored) == 0 {
+			continue
+		}
+		entry["platforms"] = stored
+		available = append(available, entry)
+	}
+	body["versions"] = available
+
+	filtered, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode version list: %w", err)
+	}
+	logger.Debugf("Offline mode: %d of %d versions of %s/%s are stored", len(available), len(versions), namespace, name)
+
+	result := *resp
+	result.Body = filtered
+	return &result, nil
+}
+
+// isProviderStored reports whether the download details of a provider
+// platform and the archive they point at are both in the store
+func (s *Service) isProviderStored(ctx context.Context, reg *upstreamRegistry, namespace, name, version, os, arch string) bool {
+	data := s.getCachedResponse(ctx, reg.cacheKey("v1/download/%s/%s/%s/%s/%s", namespace, name, version, os, arch))
+	if data == nil {
+		return false
+	}
+
+	var details struct {
+		DownloadURL string `json:"download_url"`
+	}
+	if err := json.Unmarshal(data, &details); err != nil {
+		return false
+	}
+
+	// Cached download details point at TerraPeak: /{host}/{path} is exactly
+	// the cache key of the archive
+	u, err := url.Parse(details.DownloadURL)
+	if err != nil {
+		return false
+	}
+	return s.store.FileExists(ctx, strings.TrimPrefix(u.Path, "/"))
+}
+
+// offlineModuleVersions trims a cached module version listing down to the
+// versions whose location and archive are both stored
+func (s *Service) offlineModuleVersions(ctx context.Context, reg *upstreamRegistry, namespace, name, provider string, data []byte) ([]byte, error) {
+	var body map[string]any
+	if err := json.Unmarshal(data, &body); err != nil {
+		return nil, fmt.Errorf("failed to parse module versions: %w", err)
+	}
+
+	modules, _ := body["modules"].([]any)
+	for _, m := range modules {
+		module, _ := m.(map[string]any)
+		if module == nil {
+			continue
+		}
+		versions, _ := module["versions"].([]any)
+		available := make([]any, 0, len(versions))
+		for _, v := range versions {
+			entry, _ := v.(map[string]any)
+			version, _ := entry["version"].(string)
+			if s.isModuleStored(ctx, reg, namespace, name, provider, version) {
+				available = append(available, v)
+			}
+		}
+		module["versions"] = available
+	}
+
+	return json.Marshal(body)
+}
+
+// isModuleStored reports whether the location of a module version and the
+// archive it resolves to are both in the store
+func (s *Service) isModuleStored(ctx context.Context, reg *upstreamRegistry, namespace, name, provider, version string) bool {
+	location := s.getCachedResponse(ctx, reg.cacheKey("v1/modules/download/%s/%s/%s/%s", namespace, name, provider, version))
+	if location == nil {
+		return false
+	}
+
+	upstreamURL := reg.url + "/v1/modules/" + namespace + "/" + name + "/" + provider + "/" + version + "/download"
+	archiveURL, _, ok := modarchive.URL(string(location), upstreamURL)
+	if !ok {
+		return false
+	}
+	return s.store.FileExists(ctx, modarchive.Key(archiveURL))
+}
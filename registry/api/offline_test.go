@@ -0,0 +1,140 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aliharirian/TerraPeak/cache"
+	"github.com/go-chi/chi/v5"
+)
+
+func TestOfflineMode(t *testing.T) {
+	var upstreamHits atomic.Int32
+	mockUpstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHits.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer mockUpstream.Close()
+
+	cfg := createTestConfig()
+	cfg.Storage.File.Path = t.TempDir()
+	cfg.Terraform.RegistryUrl = mockUpstream.URL
+	cfg.Cache.AllowedHosts = []string{"releases.hashicorp.com"}
+	cfg.Offline = true
+
+	service, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	reg := service.registries[0]
+
+	// Only 5.0.0 for linux_amd64 has both its download details and archive stored
+	seed := map[string]string{
+		reg.cacheKey("v1/versions/hashicorp/aws"): `{"versions":[
+			{"version":"5.0.0","platforms":[{"os":"linux","arch":"amd64"},{"os":"darwin","arch":"arm64"}]},
+			{"version":"5.1.0","platforms":[{"os":"linux","arch":"amd64"}]}
+		]}`,
+		reg.cacheKey("v1/download/hashicorp/aws/5.0.0/linux/amd64"):                                        `{"download_url":"https://cache.example.com/releases.hashicorp.com/terraform-provider-aws/5.0.0/terraform-provider-aws_5.0.0_linux_amd64.zip"}`,
+		reg.cacheKey("v1/download/hashicorp/aws/5.1.0/linux/amd64"):                                        `{"download_url":"https://cache.example.com/releases.hashicorp.com/terraform-provider-aws/5.1.0/terraform-provider-aws_5.1.0_linux_amd64.zip"}`,
+		"releases.hashicorp.com/terraform-provider-aws/5.0.0/terraform-provider-aws_5.0.0_linux_amd64.zip": "zip",
+		reg.cacheKey("v1/modules/versions/terraform-aws-modules/vpc/aws"):                                  `{"modules":[{"versions":[{"version":"5.0.0"},{"version":"5.1.0"}]}]}`,
+		reg.cacheKey("v1/modules/download/terraform-aws-modules/vpc/aws/5.0.0"):                            "git::https://github.com/terraform-aws-modules/terraform-aws-vpc?ref=v5.0.0",
+		reg.cacheKey("v1/modules/download/terraform-aws-modules/vpc/aws/5.1.0"):                            "git::https://github.com/terraform-aws-modules/terraform-aws-vpc?ref=v5.1.0",
+	}
+	// The module archive as the cache handler stores it when go-getter
+	// downloads it, without the archive query of the module source
+	archiveReq, err := cache.ParseRequest(httptest.NewRequest("GET", "/codeload.github.com/terraform-aws-modules/terraform-aws-vpc/tar.gz/v5.0.0", nil))
+	if err != nil {
+		t.Fatalf("Failed to parse archive request: %v", err)
+	}
+	seed[cache.GenerateCacheKey(archiveReq)] = "tarball"
+	for key, data := range seed {
+		if err := service.store.Save(context.Background(), key, []byte(data)); err != nil {
+			t.Fatalf("Failed to seed %s: %v", key, err)
+		}
+	}
+
+	router := chi.NewRouter()
+	service.RegisterRoutes(router)
+
+	t.Run("version list only shows stored platforms", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/v1/providers/hashicorp/aws/versions", nil))
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", w.Code)
+		}
+		var body providerVersions
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("Failed to decode version list: %v", err)
+		}
+		if len(body.Versions) != 1 || body.Versions[0].Version != "5.0.0" {
+			t.Fatalf("Expected only version 5.0.0, got %s", w.Body.String())
+		}
+		if platforms := body.Versions[0].Platforms; len(platforms) != 1 || platforms[0].OS != "linux" {
+			t.Errorf("Expected only linux_amd64, got %+v", platforms)
+		}
+	})
+
+	t.Run("module version list only shows stored archives", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/v1/modules/terraform-aws-modules/vpc/aws/versions", nil))
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", w.Code)
+		}
+		var body struct {
+			Modules []struct {
+				Versions []struct {
+					Version string `json:"version"`
+				} `json:"versions"`
+			} `json:"modules"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("Failed to decode module versions: %v", err)
+		}
+		if len(body.Modules) != 1 || len(body.Modules[0].Versions) != 1 || body.Modules[0].Versions[0].Version != "5.0.0" {
+			t.Errorf("Expected only version 5.0.0, got %s", w.Body.String())
+		}
+	})
+
+	misses := []struct {
+		name string
+		path string
+	}{
+		{"unknown provider", "/v1/providers/hashicorp/google/versions"},
+		{"platform not stored", "/v1/providers/hashicorp/aws/5.0.0/download/darwin/arm64"},
+		{"module not stored", "/v1/modules/hashicorp/consul/aws/versions"},
+		{"artifact not stored", "/releases.hashicorp.com/terraform-provider-aws/5.1.0/terraform-provider-aws_5.1.0_linux_amd64.zip"},
+	}
+	for _, tt := range misses {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+
+			if w.Code != http.StatusNotFound {
+				t.Errorf("Expected status 404, got %d", w.Code)
+			}
+			if !contains(w.Body.String(), "offline mode") {
+				t.Errorf("Expected an offline mode explanation, got %s", w.Body.String())
+			}
+		})
+	}
+
+	t.Run("stored download details", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/v1/providers/hashicorp/aws/5.0.0/download/linux/amd64", nil))
+
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected status 200, got %d", w.Code)
+		}
+	})
+
+	if hits := upstreamHits.Load(); hits != 0 {
+		t.Errorf("Expected upstream never to be contacted, got %d requests", hits)
+	}
+}
@@ -0,0 +1,76 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/aliharirian/TerraPeak/logger"
+	"github.com/aliharirian/TerraPeak/policy"
+)
+
+// checkPolicy evaluates the provider policy for one version and logs the
+// decision through the request-scoped logger
+func (s *Service) checkPolicy(r *http.Request, namespace, name, version string) policy.Decision {
+	decision := s.policy.Evaluate(namespace, name, version)
+
+	l := logger.ForRequest(r)
+	event := l.Debug()
+	if !decision.Allowed {
+		event = l.Info()
+	}
+	event.
+		Str("namespace", namespace).
+		Str("type", name).
+		Str("version", version).
+		Bool("allowed", decision.Allowed).
+		Int("rule", decision.Rule).
+		Str("reason", decision.Reason).
+		Msg("Provider policy decision")
+
+	return decision
+}
+
+// writePolicyDenied answers a blocked provider version with 403 and the
+// reason, in the registry protocol error format
+func writePolicyDenied(w http.ResponseWriter, namespace, name, version string, decision policy.Decision) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(map[string][]string{
+		"errors": {fmt.Sprintf("%s/%s %s is blocked by policy: %s", namespace, name, version, decision.Reason)},
+	})
+}
+
+// filterVersionList removes the versions the policy denies from a registry
+// version listing. The cached listing stays complete, so policy changes apply
+// immediately.
+func (s *Service) filterVersionList(r *http.Request, namespace, name string, resp *registryResponse) (*registryResponse, error) {
+	if s.policy.Empty() || resp.StatusCode != http.StatusOK {
+		return resp, nil
+	}
+
+	var body map[string]any
+	if err := json.Unmarshal(resp.Body, &body); err != nil {
+		return nil, fmt.Errorf("failed to parse version list: %w", err)
+	}
+
+	versions, _ := body["versions"].([]any)
+	allowed := make([]any, 0, len(versions))
+	for _, v := range versions {
+		entry, _ := v.(map[string]any)
+		version, _ := entry["version"].(string)
+		if s.checkPolicy(r, namespace, name, version).Allowed {
+			allowed = append(allowed, v)
+		}
+	}
+	body["versions"] = allowed
+
+	filtered, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode version list: %w", err)
+	}
+
+	result := *resp
+	result.Body = filtered
+	return &result, nil
+}
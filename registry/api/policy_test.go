@@ -0,0 +1,81 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aliharirian/TerraPeak/config"
+	"github.com/go-chi/chi/v5"
+)
+
+func TestProviderPolicy(t *testing.T) {
+	mockUpstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/v1/providers/hashicorp/aws/versions" {
+			fmt.Fprint(w, `{"versions":[{"version":"5.1.1"},{"version":"5.1.2"},{"version":"5.2.0"}]}`)
+			return
+		}
+		fmt.Fprint(w, `{"download_url": "https://releases.hashicorp.com/terraform-provider-aws/5.1.1/terraform-provider-aws_5.1.1_linux_amd64.zip"}`)
+	}))
+	defer mockUpstream.Close()
+
+	cfg := createTestConfig()
+	cfg.Storage.File.Path = t.TempDir()
+	cfg.Terraform.RegistryUrl = mockUpstream.URL
+	cfg.Policy.Rules = []config.PolicyRule{
+		{Namespace: "hashicorp", Type: "aws", Versions: "5.1.2", Action: "deny", Reason: "known bad release"},
+	}
+
+	service, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+
+	router := chi.NewRouter()
+	router.Get("/v1/providers/{namespace}/{name}/versions", service.GetVersionList)
+	router.Get("/v1/providers/{namespace}/{name}/{version}/download/{os}/{arch}", service.GetProviderDownloadDetails)
+
+	t.Run("version list is filtered", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/v1/providers/hashicorp/aws/versions", nil))
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", w.Code)
+		}
+		var body providerVersions
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("Failed to decode version list: %v", err)
+		}
+		var versions []string
+		for _, v := range body.Versions {
+			versions = append(versions, v.Version)
+		}
+		if fmt.Sprint(versions) != "[5.1.1 5.2.0]" {
+			t.Errorf("Expected [5.1.1 5.2.0], got %v", versions)
+		}
+	})
+
+	t.Run("blocked version download", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/v1/providers/hashicorp/aws/5.1.2/download/linux/amd64", nil))
+
+		if w.Code != http.StatusForbidden {
+			t.Fatalf("Expected status 403, got %d", w.Code)
+		}
+		if !contains(w.Body.String(), "known bad release") {
+			t.Errorf("Expected the policy reason in the response, got %s", w.Body.String())
+		}
+	})
+
+	t.Run("allowed version download", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/v1/providers/hashicorp/aws/5.1.1/download/linux/amd64", nil))
+
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected status 200, got %d", w.Code)
+		}
+	})
+}
@@ -1,108 +1,257 @@
 package api
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"path"
+	"time"
 
+	"github.com/aliharirian/TerraPeak/cache"
 	"github.com/aliharirian/TerraPeak/logger"
+	"github.com/aliharirian/TerraPeak/metrics"
+	"github.com/aliharirian/TerraPeak/proxy"
+	"github.com/aliharirian/TerraPeak/store"
+	"github.com/aliharirian/TerraPeak/verify"
 	"github.com/go-chi/chi/v5"
 )
 
+// registryResponse is an upstream registry answer, either fresh or from cache
+type registryResponse struct {
+	StatusCode  int
+	ContentType string
+	Body        []byte
+	CacheStatus string
+}
+
+// write sends the registry response to the client
+func (rr *registryResponse) write(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", rr.ContentType)
+	w.Header().Set("X-Cache-Status", rr.CacheStatus)
+	w.WriteHeader(rr.StatusCode)
+	w.Write(rr.Body)
+}
+
 func (s *Service) GetVersionList(w http.ResponseWriter, r *http.Request) {
 	namespace := chi.URLParam(r, "namespace")
 	name := chi.URLParam(r, "name")
 
-	// Generate cache key for this request
-	cacheKey := fmt.Sprintf("registry/v1/versions/%s/%s", namespace, name)
-
-	// Check if response exists in cache
-	if cachedResponse := s.getCachedResponse(cacheKey); cachedResponse != nil {
-		logger.Infof("Cache HIT: Serving cached version list for %s/%s", namespace, name)
-		w.Header().Set("Content-Type", "application/json")
-		w.Header().Set("X-Cache-Status", "HIT")
-		w.WriteHeader(http.StatusOK)
-		w.Write(cachedResponse)
+	resp, err := s.fetchVersionList(r.Context(), s.registryFor(r).registry, namespace, name)
+	if err != nil {
+		writeFetchError(w, err)
+		return
+	}
+
+	// Hide the versions the policy blocks
+	resp, err = s.filterVersionList(r, namespace, name, resp)
+	if err != nil {
+		writeFetchError(w, err)
+		return
+	}
+	resp.write(w)
+}
+
+func (s *Service) GetProviderDownloadDetails(w http.ResponseWriter, r *http.Request) {
+	namespace := chi.URLParam(r, "namespace")
+	name := chi.URLParam(r, "name")
+	version := chi.URLParam(r, "version")
+	os := chi.URLParam(r, "os")
+	arch := chi.URLParam(r, "arch")
+
+	if decision := s.checkPolicy(r, namespace, name, version); !decision.Allowed {
+		writePolicyDenied(w, namespace, name, version, decision)
+		return
+	}
+
+	resp, err := s.fetchDownloadDetails(r.Context(), s.registryFor(r).registry, namespace, name, version, os, arch)
+	if err != nil {
+		writeFetchError(w, err)
 		return
 	}
+	resp.write(w)
+}
+
+// writeFetchError maps a registry fetch failure to an HTTP error response.
+// Cached entries are served without asking upstream, so an open circuit
+// breaker only fails requests with nothing stored.
+func writeFetchError(w http.ResponseWriter, err error) {
+	if proxy.WriteCircuitOpen(w, err) {
+		return
+	}
+	var upstreamErr *upstreamError
+	if errors.As(err, &upstreamErr) {
+		http.Error(w, "upstream unreachable", http.StatusBadGateway)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// upstreamError reports that the upstream registry could not be reached
+type upstreamError struct {
+	URL string
+	Err error
+}
+
+func (e *upstreamError) Error() string {
+	return fmt.Sprintf("upstream %s unreachable: %v", e.URL, e.Err)
+}
+
+func (e *upstreamError) Unwrap() error { return e.Err }
+
+// fetchVersionList returns the provider version listing, from cache when present
+func (s *Service) fetchVersionList(ctx context.Context, reg *upstreamRegistry, namespace, name string) (*registryResponse, error) {
+	// Generate cache key for this request
+	cacheKey := reg.cacheKey("v1/versions/%s/%s", namespace, name)
+
+	// Check if response exists in cache, refreshing it once it is older than the TTL
+	refresh := func() { s.fetchVersionListUpstream(reg, namespace, name, cacheKey) }
+	if cachedResponse, cacheStatus := s.getCachedEntry(ctx, cacheKey, s.cfg.Terraform.CacheTTL.Versions, refresh); cachedResponse != nil {
+		logger.Infof("Cache %s: Serving cached version list for %s/%s from %s", cacheStatus, namespace, name, reg.name)
+		resp := &registryResponse{
+			StatusCode:  http.StatusOK,
+			ContentType: "application/json",
+			Body:        cachedResponse,
+			CacheStatus: cacheStatus,
+		}
+		if s.cfg.Offline {
+			return s.offlineVersionList(ctx, reg, namespace, name, resp)
+		}
+		return resp, nil
+	}
+
+	if notFound := s.getNegativeResponse(cacheKey); notFound != nil {
+		logger.Infof("Cache NEGATIVE: Version list for %s/%s was recently not found on %s", namespace, name, reg.name)
+		return notFound, nil
+	}
+
+	if s.cfg.Offline {
+		logger.Infof("Cache MISS: Version list for %s/%s from %s is not stored (offline mode)", namespace, name, reg.name)
+		return offlineMiss(fmt.Sprintf("version list of %s/%s", namespace, name)), nil
+	}
 
 	// Cache miss - fetch from upstream
-	logger.Infof("Cache MISS: Fetching version list for %s/%s from upstream", namespace, name)
-	upstreamURL := s.cfg.Terraform.RegistryUrl + "/v1/providers/" + namespace + "/" + name + "/versions"
+	logger.Infof("Cache MISS: Fetching version list for %s/%s from upstream %s", namespace, name, reg.name)
+	return s.fetchCoalesced(cacheKey, func() (*registryResponse, error) {
+		return s.fetchVersionListUpstream(reg, namespace, name, cacheKey)
+	})
+}
+
+// fetchVersionListUpstream fetches the provider version listing from upstream
+// and caches it under cacheKey
+func (s *Service) fetchVersionListUpstream(reg *upstreamRegistry, namespace, name, cacheKey string) (*registryResponse, error) {
+	upstreamURL := reg.url + "/v1/providers/" + namespace + "/" + name + "/versions"
 
 	// Use proxy-aware client for upstream request
 	resp, err := s.proxyHandler.GetClient().Get(upstreamURL)
 	if err != nil {
 		logger.Errorf("Failed to fetch version list from upstream %s: %v", upstreamURL, err)
-		http.Error(w, "upstream unreachable", http.StatusBadGateway)
-		return
+		return nil, &upstreamError{URL: upstreamURL, Err: err}
 	}
 	defer resp.Body.Close()
 
 	// Read response body
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		http.Error(w, "failed to read response", http.StatusInternalServerError)
-		return
+		return nil, errors.New("failed to read response")
 	}
 
-	// Cache the response
-	s.cacheResponse(cacheKey, respBody)
+	response := &registryResponse{
+		StatusCode:  resp.StatusCode,
+		ContentType: resp.Header.Get("Content-Type"),
+		Body:        respBody,
+		CacheStatus: "MISS",
+	}
 
-	// Send response to client
-	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
-	w.Header().Set("X-Cache-Status", "MISS")
-	w.WriteHeader(resp.StatusCode)
-	w.Write(respBody)
-}
+	// Cache only valid listings; upstream errors must not be served as hits
+	if resp.StatusCode == http.StatusOK && json.Valid(respBody) {
+		s.cacheResponse(cacheKey, upstreamURL, respBody)
+	} else {
+		logger.Warnf("Not caching version list from %s: upstream status %d", upstreamURL, resp.StatusCode)
+		s.cacheNegativeResponse(cacheKey, response)
+	}
 
-func (s *Service) GetProviderDownloadDetails(w http.ResponseWriter, r *http.Request) {
-	namespace := chi.URLParam(r, "namespace")
-	name := chi.URLParam(r, "name")
-	version := chi.URLParam(r, "version")
-	os := chi.URLParam(r, "os")
-	arch := chi.URLParam(r, "arch")
+	return response, nil
+}
 
+// fetchDownloadDetails returns the provider download details with their URLs
+// pointing at TerraPeak, from cache when present
+func (s *Service) fetchDownloadDetails(ctx context.Context, reg *upstreamRegistry, namespace, name, version, os, arch string) (*registryResponse, error) {
 	// Generate cache key for this request
-	cacheKey := fmt.Sprintf("registry/v1/download/%s/%s/%s/%s/%s", namespace, name, version, os, arch)
-
-	// Check if response exists in cache
-	if cachedResponse := s.getCachedResponse(cacheKey); cachedResponse != nil {
-		logger.Infof("Cache HIT: Serving cached download details for %s/%s/%s/%s/%s", namespace, name, version, os, arch)
-		w.Header().Set("Content-Type", "application/json")
-		w.Header().Set("X-Cache-Status", "HIT")
-		w.WriteHeader(http.StatusOK)
-		w.Write(cachedResponse)
-		return
+	cacheKey := reg.cacheKey("v1/download/%s/%s/%s/%s/%s", namespace, name, version, os, arch)
+
+	// Check if response exists in cache, refreshing it once it is older than the TTL
+	refresh := func() { s.fetchDownloadDetailsUpstream(reg, namespace, name, version, os, arch, cacheKey) }
+	if cachedResponse, cacheStatus := s.getCachedEntry(ctx, cacheKey, s.cfg.Terraform.CacheTTL.Download, refresh); cachedResponse != nil {
+		logger.Infof("Cache %s: Serving cached download details for %s/%s/%s/%s/%s from %s", cacheStatus, namespace, name, version, os, arch, reg.name)
+		return &registryResponse{
+			StatusCode:  http.StatusOK,
+			ContentType: "application/json",
+			Body:        cachedResponse,
+			CacheStatus: cacheStatus,
+		}, nil
+	}
+
+	if notFound := s.getNegativeResponse(cacheKey); notFound != nil {
+		logger.Infof("Cache NEGATIVE: Download details for %s/%s/%s/%s/%s were recently not found on %s", namespace, name, version, os, arch, reg.name)
+		return notFound, nil
+	}
+
+	if s.cfg.Offline {
+		logger.Infof("Cache MISS: Download details for %s/%s/%s/%s/%s from %s are not stored (offline mode)", namespace, name, version, os, arch, reg.name)
+		return offlineMiss(fmt.Sprintf("%s/%s %s for %s_%s", namespace, name, version, os, arch)), nil
 	}
 
 	// Cache miss - fetch from upstream
-	logger.Infof("Cache MISS: Fetching download details for %s/%s/%s/%s/%s from upstream", namespace, name, version, os, arch)
-	upstreamURL := s.cfg.Terraform.RegistryUrl + "/v1/providers/" + namespace + "/" + name + "/" + version + "/download/" + os + "/" + arch
+	logger.Infof("Cache MISS: Fetching download details for %s/%s/%s/%s/%s from upstream %s", namespace, name, version, os, arch, reg.name)
+	return s.fetchCoalesced(cacheKey, func() (*registryResponse, error) {
+		return s.fetchDownloadDetailsUpstream(reg, namespace, name, version, os, arch, cacheKey)
+	})
+}
+
+// fetchDownloadDetailsUpstream fetches the provider download details from
+// upstream, points their URLs at TerraPeak and caches them under cacheKey
+func (s *Service) fetchDownloadDetailsUpstream(reg *upstreamRegistry, namespace, name, version, os, arch, cacheKey string) (*registryResponse, error) {
+	upstreamURL := reg.url + "/v1/providers/" + namespace + "/" + name + "/" + version + "/download/" + os + "/" + arch
 
 	// Use proxy-aware client for upstream request
 	resp, err := s.proxyHandler.GetClient().Get(upstreamURL)
 	if err != nil {
 		logger.Errorf("Failed to fetch download details from upstream %s: %v", upstreamURL, err)
-		http.Error(w, "upstream unreachable", http.StatusBadGateway)
-		return
+		return nil, &upstreamError{URL: upstreamURL, Err: err}
 	}
 	defer resp.Body.Close()
 
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		http.Error(w, "failed to read response", http.StatusInternalServerError)
-		return
+		return nil, errors.New("failed to read response")
+	}
+
+	// Pass upstream errors through untouched and never cache them
+	if resp.StatusCode != http.StatusOK {
+		logger.Warnf("Not caching download details from %s: upstream status %d", upstreamURL, resp.StatusCode)
+		response := &registryResponse{
+			StatusCode:  resp.StatusCode,
+			ContentType: resp.Header.Get("Content-Type"),
+			Body:        respBody,
+			CacheStatus: "MISS",
+		}
+		s.cacheNegativeResponse(cacheKey, response)
+		return response, nil
 	}
 
 	var body map[string]any
 	if err := json.Unmarshal(respBody, &body); err != nil {
-		http.Error(w, "failed to parse response", http.StatusInternalServerError)
-		return
+		return nil, errors.New("failed to parse response")
 	}
 
+	// Remember what the archive must look like before the URLs are rewritten
+	s.recordArchiveExpectation(body)
+
 	// Modify URLs to point to our cacher
 	body["download_url"] = AppFirstURL(body["download_url"], s.cfg.Server.Domain)
 	body["shasums_signature_url"] = AppFirstURL(body["shasums_signature_url"], s.cfg.Server.Domain)
@@ -111,18 +260,60 @@ func (s *Service) GetProviderDownloadDetails(w http.ResponseWriter, r *http.Requ
 	// Encode modified response
 	modifiedResponse, err := json.Marshal(body)
 	if err != nil {
-		http.Error(w, "failed to encode response", http.StatusInternalServerError)
-		return
+		return nil, errors.New("failed to encode response")
 	}
 
 	// Cache the modified response
-	s.cacheResponse(cacheKey, modifiedResponse)
+	s.cacheResponse(cacheKey, upstreamURL, modifiedResponse)
+
+	return &registryResponse{
+		StatusCode:  resp.StatusCode,
+		ContentType: resp.Header.Get("Content-Type"),
+		Body:        modifiedResponse,
+		CacheStatus: "MISS",
+	}, nil
+}
+
+// recordArchiveExpectation stores the checksum, SHASUMS location and signing
+// keys from provider download details, keyed like the cache handler will key
+// the archive download
+func (s *Service) recordArchiveExpectation(details map[string]any) {
+	if s.verifier == nil {
+		return
+	}
+
+	downloadURL, _ := details["download_url"].(string)
+	u, err := url.Parse(downloadURL)
+	if err != nil || u.Host == "" {
+		return
+	}
+	artifactKey := cache.GenerateCacheKey(&cache.ProxyRequest{Host: u.Host, Path: u.Path, QueryString: u.RawQuery})
+
+	expectation := &verify.Expectation{}
+	expectation.Filename, _ = details["filename"].(string)
+	if expectation.Filename == "" {
+		expectation.Filename = path.Base(u.Path)
+	}
+	expectation.Shasum, _ = details["shasum"].(string)
+	expectation.ShasumsURL, _ = details["shasums_url"].(string)
+	expectation.ShasumsSignatureURL, _ = details["shasums_signature_url"].(string)
+
+	if signingKeys, ok := details["signing_keys"].(map[string]any); ok {
+		keys, _ := signingKeys["gpg_public_keys"].([]any)
+		for _, key := range keys {
+			if k, ok := key.(map[string]any); ok {
+				if armored, _ := k["ascii_armor"].(string); armored != "" {
+					expectation.SigningKeys = append(expectation.SigningKeys, armored)
+				}
+			}
+		}
+	}
 
-	// Send response to client
-	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
-	w.Header().Set("X-Cache-Status", "MISS")
-	w.WriteHeader(resp.StatusCode)
-	w.Write(modifiedResponse)
+	// Like the details themselves, the expectation is saved for every
+	// request sharing the upstream fetch, not just the one that started it
+	if err := s.verifier.Expect(context.Background(), artifactKey, expectation); err != nil {
+		logger.Warnf("Failed to record verification data for %s: %v", artifactKey, err)
+	}
 }
 
 func AppFirstURL(base any, cacherURL string) any {
@@ -156,18 +347,18 @@ func AppFirstURL(base any, cacherURL string) any {
 }
 
 // getCachedResponse retrieves cached API response from storage
-func (s *Service) getCachedResponse(cacheKey string) []byte {
+func (s *Service) getCachedResponse(ctx context.Context, cacheKey string) []byte {
 	if s.store == nil {
 		return nil
 	}
 
 	// Check if file exists in storage
-	if !s.store.FileExists(cacheKey) {
+	if !s.store.FileExists(ctx, cacheKey) {
 		return nil
 	}
 
 	// Read from storage
-	data, err := s.store.ReadFromStorage(cacheKey)
+	data, err := s.store.ReadFromStorage(ctx, cacheKey)
 	if err != nil {
 		logger.Debugf("Failed to read cached response for %s: %v", cacheKey, err)
 		return nil
@@ -176,13 +367,61 @@ func (s *Service) getCachedResponse(cacheKey string) []byte {
 	return data
 }
 
-// cacheResponse stores API response in storage
-func (s *Service) cacheResponse(cacheKey string, data []byte) {
+// getCachedEntry retrieves a cached API response and reports it as HIT, or as
+// STALE once it was last refreshed more than ttl ago (a zero ttl never
+// expires). Stale entries are still served while refresh fetches a new copy
+// in the background, at most one refresh per key at a time; ctx only bounds
+// the reads, the refresh outlives the request.
+func (s *Service) getCachedEntry(ctx context.Context, cacheKey string, ttl time.Duration, refresh func()) ([]byte, string) {
+	data := s.getCachedResponse(ctx, cacheKey)
+	if data == nil {
+		return nil, ""
+	}
+	if ttl <= 0 || s.cfg.Offline {
+		return data, "HIT"
+	}
+
+	// Entries without a readable metadata record predate TTL support and
+	// are treated as expired
+	metadata, err := s.store.Metadata(ctx, cacheKey)
+	if err == nil && time.Since(metadata.Timestamp) < ttl {
+		return data, "HIT"
+	}
+
+	if _, running := s.refreshing.LoadOrStore(cacheKey, struct{}{}); !running {
+		go func() {
+			defer s.refreshing.Delete(cacheKey)
+			logger.Debugf("Refreshing stale cache entry %s in the background", cacheKey)
+			refresh()
+		}()
+	}
+	return data, "STALE"
+}
+
+// fetchCoalesced runs fetch for a cache miss on cacheKey, or waits for the
+// fetch another request already started for it. Waiting requests are
+// reported as COALESCED.
+func (s *Service) fetchCoalesced(cacheKey string, fetch func() (*registryResponse, error)) (*registryResponse, error) {
+	resp, shared, err := s.inflight.Do(cacheKey, fetch)
+	if !shared || err != nil {
+		return resp, err
+	}
+
+	metrics.CoalescedRequests.Inc("registry")
+	logger.Infof("Cache COALESCED: Serving %s from the upstream fetch already in flight", cacheKey)
+	coalesced := *resp
+	coalesced.CacheStatus = "COALESCED"
+	return &coalesced, nil
+}
+
+// cacheResponse stores API response in storage, recording the upstream URL
+// it came from, which relative locations in it are resolved against
+func (s *Service) cacheResponse(cacheKey, sourceURL string, data []byte) {
 	if s.store == nil {
 		return
 	}
 
-	err := s.store.Save(cacheKey, data)
+	err := s.store.SaveStream(context.Background(), cacheKey, bytes.NewReader(data), int64(len(data)), &store.Metadata{SourceURL: sourceURL})
 	if err != nil {
 		logger.Warnf("Failed to cache response for %s: %v", cacheKey, err)
 	} else {
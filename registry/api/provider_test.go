@@ -1,12 +1,22 @@
 package api
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/aliharirian/TerraPeak/config"
+	"github.com/aliharirian/TerraPeak/metrics"
+	"github.com/aliharirian/TerraPeak/verify"
 	"github.com/go-chi/chi/v5"
 )
 
@@ -134,8 +144,9 @@ func TestGetVersionListWithMockUpstream(t *testing.T) {
 	}
 
 	// Check that response is cached
-	cacheKey := "registry/v1/versions/hashicorp/aws"
-	if !service.store.FileExists(cacheKey) {
+	upstreamURL, _ := url.Parse(mockUpstream.URL)
+	cacheKey := "registry/" + upstreamURL.Host + "/v1/versions/hashicorp/aws"
+	if !service.store.FileExists(context.Background(), cacheKey) {
 		t.Error("Expected response to be cached")
 	}
 
@@ -154,6 +165,368 @@ func TestGetVersionListWithMockUpstream(t *testing.T) {
 	}
 }
 
+func TestGetVersionListStaleWhileRevalidate(t *testing.T) {
+	var releases atomic.Int32
+	releases.Store(1)
+	mockUpstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"versions":[{"version":"5.%d.0"}]}`, releases.Load())
+	}))
+	defer mockUpstream.Close()
+
+	cfg := createTestConfig()
+	cfg.Storage.File.Path = t.TempDir()
+	cfg.Terraform.RegistryUrl = mockUpstream.URL
+	// Every entry is expired as soon as it is written
+	cfg.Terraform.CacheTTL.Versions = time.Nanosecond
+
+	service, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+
+	router := chi.NewRouter()
+	router.Get("/v1/providers/{namespace}/{name}/versions", service.GetVersionList)
+
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/v1/providers/hashicorp/aws/versions", nil))
+		return w
+	}
+
+	if w := get(); w.Header().Get("X-Cache-Status") != "MISS" {
+		t.Fatalf("Expected X-Cache-Status: MISS, got %s", w.Header().Get("X-Cache-Status"))
+	}
+
+	// A new release upstream: the stale list is served and refreshed behind the scenes
+	releases.Store(2)
+	w := get()
+	if w.Header().Get("X-Cache-Status") != "STALE" {
+		t.Errorf("Expected X-Cache-Status: STALE, got %s", w.Header().Get("X-Cache-Status"))
+	}
+	if !contains(w.Body.String(), `"5.1.0"`) {
+		t.Errorf("Expected the stale version list, got %s", w.Body.String())
+	}
+
+	upstreamURL, _ := url.Parse(mockUpstream.URL)
+	cacheKey := "registry/" + upstreamURL.Host + "/v1/versions/hashicorp/aws"
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		data, _ := service.store.ReadFromStorage(context.Background(), cacheKey)
+		if contains(string(data), `"5.2.0"`) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Cache entry was not refreshed, still %s", data)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if w := get(); !contains(w.Body.String(), `"5.2.0"`) {
+		t.Errorf("Expected the refreshed version list, got %s", w.Body.String())
+	}
+	if _, err := service.store.Metadata(context.Background(), cacheKey); err != nil {
+		t.Errorf("Expected a metadata record for the refreshed entry: %v", err)
+	}
+
+	// Let the refresh started by the last request finish before cleanup
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, running := service.refreshing.Load(cacheKey); !running {
+			break
+		}
+	}
+}
+
+func TestGetVersionListWithoutMetadata(t *testing.T) {
+	var fetches atomic.Int32
+	mockUpstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"versions":[{"version":"5.2.0"}]}`))
+	}))
+	defer mockUpstream.Close()
+
+	cfg := createTestConfig()
+	cfg.Storage.File.Path = t.TempDir()
+	cfg.Terraform.RegistryUrl = mockUpstream.URL
+	cfg.Terraform.CacheTTL.Versions = time.Hour
+
+	service, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+
+	// Cached by a version that did not keep metadata records
+	upstreamURL, _ := url.Parse(mockUpstream.URL)
+	cacheKey := "registry/" + upstreamURL.Host + "/v1/versions/hashicorp/aws"
+	if err := service.store.Backend().Write(context.Background(), cacheKey, []byte(`{"versions":[{"version":"5.1.0"}]}`)); err != nil {
+		t.Fatalf("Failed to seed cache entry: %v", err)
+	}
+
+	router := chi.NewRouter()
+	router.Get("/v1/providers/{namespace}/{name}/versions", service.GetVersionList)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/v1/providers/hashicorp/aws/versions", nil))
+
+	if w.Header().Get("X-Cache-Status") != "STALE" {
+		t.Errorf("Expected X-Cache-Status: STALE, got %s", w.Header().Get("X-Cache-Status"))
+	}
+	if !contains(w.Body.String(), `"5.1.0"`) {
+		t.Errorf("Expected the cached version list, got %s", w.Body.String())
+	}
+
+	// The entry is refreshed and gets a metadata record
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := service.store.Metadata(context.Background(), cacheKey); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Cache entry was not refreshed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if fetches.Load() != 1 {
+		t.Errorf("Expected one upstream fetch, got %d", fetches.Load())
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, running := service.refreshing.Load(cacheKey); !running {
+			break
+		}
+	}
+}
+
+func TestGetVersionListUpstreamErrorsNotCached(t *testing.T) {
+	tests := []struct {
+		name           string
+		status         int
+		body           string
+		expectedHits   int32
+		expectedStatus string
+	}{
+		{
+			name:           "not found is negatively cached",
+			status:         http.StatusNotFound,
+			body:           `{"errors":["Not Found"]}`,
+			expectedHits:   1,
+			expectedStatus: "NEGATIVE",
+		},
+		{
+			name:           "server error is not cached",
+			status:         http.StatusInternalServerError,
+			body:           `{"errors":["Internal Server Error"]}`,
+			expectedHits:   2,
+			expectedStatus: "MISS",
+		},
+		{
+			name:           "invalid json is not cached",
+			status:         http.StatusOK,
+			body:           `<html>maintenance</html>`,
+			expectedHits:   2,
+			expectedStatus: "MISS",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hits atomic.Int32
+			mockUpstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				hits.Add(1)
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, tt.body)
+			}))
+			defer mockUpstream.Close()
+
+			cfg := createTestConfig()
+			cfg.Storage.File.Path = t.TempDir()
+			cfg.Terraform.RegistryUrl = mockUpstream.URL
+			cfg.Terraform.CacheTTL.NotFound = time.Minute
+			// Count every request reaching upstream, not retries
+			cfg.Upstream.Retries = -1
+
+			service, err := New(cfg)
+			if err != nil {
+				t.Fatalf("Failed to create service: %v", err)
+			}
+
+			router := chi.NewRouter()
+			router.Get("/v1/providers/{namespace}/{name}/versions", service.GetVersionList)
+
+			var w *httptest.ResponseRecorder
+			for i := 0; i < 2; i++ {
+				w = httptest.NewRecorder()
+				router.ServeHTTP(w, httptest.NewRequest("GET", "/v1/providers/hashicorp/awss/versions", nil))
+				if w.Code != tt.status {
+					t.Errorf("Expected status %d, got %d", tt.status, w.Code)
+				}
+			}
+
+			if cacheStatus := w.Header().Get("X-Cache-Status"); cacheStatus != tt.expectedStatus {
+				t.Errorf("Expected X-Cache-Status: %s, got %s", tt.expectedStatus, cacheStatus)
+			}
+			if hits.Load() != tt.expectedHits {
+				t.Errorf("Expected %d upstream requests, got %d", tt.expectedHits, hits.Load())
+			}
+
+			upstreamURL, _ := url.Parse(mockUpstream.URL)
+			if service.store.FileExists(context.Background(), "registry/"+upstreamURL.Host+"/v1/versions/hashicorp/awss") {
+				t.Error("Expected upstream error not to be stored")
+			}
+		})
+	}
+}
+
+func TestGetVersionListRetriesUpstreamHiccup(t *testing.T) {
+	var hits atomic.Int32
+	mockUpstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"versions":[{"version":"1.0.0"}]}`)
+	}))
+	defer mockUpstream.Close()
+
+	cfg := createTestConfig()
+	cfg.Storage.File.Path = t.TempDir()
+	cfg.Terraform.RegistryUrl = mockUpstream.URL
+	cfg.Upstream.RetryBackoff = time.Millisecond
+
+	service, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	router := chi.NewRouter()
+	router.Get("/v1/providers/{namespace}/{name}/versions", service.GetVersionList)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/v1/providers/hashicorp/aws/versions", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status 200 after a retry, got %d", w.Code)
+	}
+	if hits.Load() != 2 {
+		t.Errorf("Expected 2 upstream requests, got %d", hits.Load())
+	}
+}
+
+func TestCircuitOpen(t *testing.T) {
+	var hits atomic.Int32
+	mockUpstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer mockUpstream.Close()
+	host := strings.TrimPrefix(mockUpstream.URL, "http://")
+	port, _ := strconv.Atoi(host[strings.LastIndex(host, ":")+1:])
+
+	cfg := createTestConfig()
+	cfg.Storage.File.Path = t.TempDir()
+	cfg.Terraform.RegistryUrl = mockUpstream.URL
+	cfg.Cache.Rewrites = []config.CacheRewrite{{Prefix: "artifacts", Host: "127.0.0.1", Scheme: "http", Port: port}}
+	// Every stored file is expired as soon as it is written
+	cfg.Cache.TTL = []config.CacheTTLRule{{TTL: time.Nanosecond}}
+	cfg.Upstream.Retries = -1
+	cfg.Upstream.BreakerFailures = 1
+	cfg.Upstream.BreakerCooldown = time.Minute
+
+	service, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	if err := service.store.Save(context.Background(), "http/"+host+"/provider.zip", []byte("stale")); err != nil {
+		t.Fatalf("Failed to seed the stale entry: %v", err)
+	}
+	router := chi.NewRouter()
+	service.RegisterRoutes(router)
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	// The failed revalidation opens the circuit, the stale copy is served
+	// meanwhile without asking upstream again
+	for i := 0; i < 2; i++ {
+		w := get("/artifacts/provider.zip")
+		if w.Code != http.StatusOK || w.Body.String() != "stale" || w.Header().Get("X-Cache-Status") != "STALE" {
+			t.Errorf("Request %d: expected the STALE copy, got %d %q (%s)", i+1, w.Code, w.Body.String(), w.Header().Get("X-Cache-Status"))
+		}
+	}
+	if hits.Load() != 1 {
+		t.Errorf("Expected the open circuit to keep requests from upstream, got %d requests", hits.Load())
+	}
+
+	// Nothing stored: try again once the circuit may let requests through
+	misses := []string{
+		"/artifacts/other.zip",
+		"/v1/providers/hashicorp/aws/versions",
+	}
+	for _, path := range misses {
+		w := get(path)
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s: expected status 503, got %d", path, w.Code)
+		}
+		if after, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || after < 1 || after > 60 {
+			t.Errorf("%s: expected Retry-After within the cooldown, got %q", path, w.Header().Get("Retry-After"))
+		}
+	}
+	if hits.Load() != 1 {
+		t.Errorf("Expected no more upstream requests, got %d", hits.Load())
+	}
+}
+
+func TestGetVersionListCoalescesMisses(t *testing.T) {
+	var hits atomic.Int32
+	release := make(chan struct{})
+	mockUpstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"versions":[{"version":"5.0.0"}]}`)
+	}))
+	defer mockUpstream.Close()
+
+	cfg := createTestConfig()
+	cfg.Storage.File.Path = t.TempDir()
+	cfg.Terraform.RegistryUrl = mockUpstream.URL
+
+	service, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+
+	router := chi.NewRouter()
+	router.Get("/v1/providers/{namespace}/{name}/versions", service.GetVersionList)
+
+	before := metrics.CoalescedRequests.Value("registry")
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", "/v1/providers/hashicorp/aws/versions", nil))
+			if w.Code != http.StatusOK || !contains(w.Body.String(), "5.0.0") {
+				t.Errorf("Expected the version list, got %d: %s", w.Code, w.Body.String())
+			}
+		}()
+	}
+
+	// Let every request reach the fetch in flight before upstream answers
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if hits.Load() != 1 {
+		t.Errorf("Expected 1 upstream request, got %d", hits.Load())
+	}
+	if metrics.CoalescedRequests.Value("registry") == before {
+		t.Error("Expected coalesced requests to be counted")
+	}
+}
+
 func TestGetProviderDownloadDetailsWithMockUpstream(t *testing.T) {
 	// Create mock upstream server
 	mockUpstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -205,11 +578,18 @@ func TestGetProviderDownloadDetailsWithMockUpstream(t *testing.T) {
 	}
 
 	// Check that response is cached
-	cacheKey := "registry/v1/download/hashicorp/aws/5.0.0/linux/amd64"
-	if !service.store.FileExists(cacheKey) {
+	upstreamURL, _ := url.Parse(mockUpstream.URL)
+	cacheKey := "registry/" + upstreamURL.Host + "/v1/download/hashicorp/aws/5.0.0/linux/amd64"
+	if !service.store.FileExists(context.Background(), cacheKey) {
 		t.Error("Expected response to be cached")
 	}
 
+	// Check that the archive can be verified once it is downloaded
+	archiveKey := "releases.hashicorp.com/terraform-provider-aws/5.0.0/terraform-provider-aws_5.0.0_linux_amd64.zip"
+	if !service.store.FileExists(context.Background(), verify.ExpectationKey(archiveKey)) {
+		t.Error("Expected verification data to be recorded for the archive")
+	}
+
 	// Test cache hit on second request
 	w2 := httptest.NewRecorder()
 	router.ServeHTTP(w2, req)
@@ -0,0 +1,196 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/aliharirian/TerraPeak/config"
+	"github.com/go-chi/chi/v5"
+)
+
+// upstreamRegistry is one upstream Terraform registry served by TerraPeak
+type upstreamRegistry struct {
+	name   string // cache key namespace
+	url    string // upstream base URL, without trailing slash
+	host   string // upstream host, used by the network mirror protocol
+	prefix string // path prefix the registry is mounted under, if any
+	vhost  string // virtual host selecting the registry, if any
+}
+
+// newUpstreamRegistry validates a registry entry and fills in its defaults
+func newUpstreamRegistry(rc config.RegistryConfig) (*upstreamRegistry, error) {
+	u, err := url.Parse(rc.URL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid registry url %q", rc.URL)
+	}
+
+	name := rc.Name
+	if name == "" {
+		name = strings.ToLower(u.Host)
+	}
+	if strings.ContainsAny(name, "/\\") || name == "." || name == ".." {
+		return nil, fmt.Errorf("invalid registry name %q", name)
+	}
+	// registry/v1/... is where responses were kept before every registry
+	// had its own namespace; migrate-keys moves those keys away
+	if name == "v1" {
+		return nil, fmt.Errorf("registry name %q is reserved, set another name", name)
+	}
+
+	return &upstreamRegistry{
+		name:   name,
+		url:    strings.TrimSuffix(rc.URL, "/"),
+		host:   strings.ToLower(u.Host),
+		prefix: strings.Trim(rc.Prefix, "/"),
+		vhost:  strings.ToLower(rc.Host),
+	}, nil
+}
+
+// DefaultRegistryName returns the cache key namespace of the default
+// registry, terraform.registry_url
+func DefaultRegistryName(cfg *config.Config) (string, error) {
+	reg, err := newUpstreamRegistry(config.RegistryConfig{URL: cfg.Terraform.RegistryUrl})
+	if err != nil {
+		return "", err
+	}
+	return reg.name, nil
+}
+
+// newRegistries builds the default registry from terraform.registry_url plus
+// every entry of terraform.registries
+func newRegistries(cfg *config.Config) ([]*upstreamRegistry, error) {
+	defaultRegistry, err := newUpstreamRegistry(config.RegistryConfig{URL: cfg.Terraform.RegistryUrl})
+	if err != nil {
+		return nil, err
+	}
+	registries := []*upstreamRegistry{defaultRegistry}
+
+	names := map[string]bool{defaultRegistry.name: true}
+	prefixes := map[string]bool{}
+	vhosts := map[string]bool{}
+	for _, host := range cfg.Cache.AllowedHosts {
+		// A prefix equal to a cached host would shadow it in the cache
+		// dispatcher; wildcard and deny patterns name no host of their own
+		if !strings.ContainsAny(host, "*!") {
+			prefixes[strings.ToLower(host)] = true
+		}
+	}
+	for _, mirror := range cfg.Cache.Mirrors {
+		prefixes[strings.ToLower(mirror.Host)] = true
+	}
+	for _, rewrite := range cfg.Cache.Rewrites {
+		// Registry prefixes would shadow rewrites the same way
+		prefixes[strings.ToLower(strings.Trim(rewrite.Prefix, "/"))] = true
+	}
+
+	for _, rc := range cfg.Terraform.Registries {
+		reg, err := newUpstreamRegistry(rc)
+		if err != nil {
+			return nil, err
+		}
+		if names[reg.name] {
+			return nil, fmt.Errorf("duplicate registry name %q, set a distinct name", reg.name)
+		}
+		names[reg.name] = true
+
+		if reg.prefix != "" {
+			if prefixes[strings.ToLower(reg.prefix)] {
+				return nil, fmt.Errorf("registry prefix %q is already in use", reg.prefix)
+			}
+			prefixes[strings.ToLower(reg.prefix)] = true
+		}
+		if reg.vhost != "" {
+			if vhosts[reg.vhost] {
+				return nil, fmt.Errorf("registry host %q is already in use", reg.vhost)
+			}
+			vhosts[reg.vhost] = true
+		}
+		registries = append(registries, reg)
+	}
+	return registries, nil
+}
+
+// cacheKey builds a cache key inside the registry's own namespace
+func (reg *upstreamRegistry) cacheKey(format string, args ...any) string {
+	return "registry/" + reg.name + "/" + fmt.Sprintf(format, args...)
+}
+
+// registryRoute is the registry selected for a request and the path its
+// registry protocol is served under
+type registryRoute struct {
+	registry *upstreamRegistry
+	basePath string
+}
+
+type registryContextKey struct{}
+
+// withRegistry pins every request below a prefix route to a registry
+func withRegistry(reg *upstreamRegistry) func(http.Handler) http.Handler {
+	route := &registryRoute{registry: reg, basePath: "/" + reg.prefix}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), registryContextKey{}, route)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// registryFor selects the registry for a request: the prefix route it came
+// through, else a virtual host match, else the default registry
+func (s *Service) registryFor(r *http.Request) *registryRoute {
+	if route, ok := r.Context().Value(registryContextKey{}).(*registryRoute); ok {
+		return route
+	}
+
+	host := strings.ToLower(r.Host)
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	for _, reg := range s.registries {
+		if reg.vhost != "" && (reg.vhost == host || reg.vhost == hostname) {
+			return &registryRoute{registry: reg}
+		}
+	}
+	return &registryRoute{registry: s.registries[0]}
+}
+
+// registryByHost finds the registry proxying the given upstream hostname
+func (s *Service) registryByHost(hostname string) *upstreamRegistry {
+	for _, reg := range s.registries {
+		if strings.EqualFold(reg.host, hostname) {
+			return reg
+		}
+	}
+	return nil
+}
+
+// registerRegistryRoutes mounts the registry protocol on router
+func (s *Service) registerRegistryRoutes(router chi.Router) {
+	router.Get("/.well-known/terraform.json", s.WellKnown)
+	router.Get("/v1/providers/{namespace}/{name}/versions", s.GetVersionList)
+	router.Get("/v1/providers/{namespace}/{name}/{version}/download/{os}/{arch}", s.GetProviderDownloadDetails)
+	router.Get("/v1/modules/{namespace}/{name}/{provider}/versions", s.GetModuleVersions)
+	router.Get("/v1/modules/{namespace}/{name}/{provider}/{version}/download", s.GetModuleDownload)
+}
+
+// RegistryEndpoint tells how the registry proxying hostname is reached on
+// TerraPeak: the path prefix its protocol is served under and, for virtual
+// host registries, the Host header selecting it
+func (s *Service) RegistryEndpoint(hostname string) (basePath, virtualHost string, ok bool) {
+	reg := s.registryByHost(hostname)
+	switch {
+	case reg == nil:
+		return "", "", false
+	case reg == s.registries[0]:
+		return "", "", true
+	case reg.prefix != "":
+		return "/" + reg.prefix, "", true
+	default:
+		return "", reg.vhost, true
+	}
+}
@@ -0,0 +1,260 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/aliharirian/TerraPeak/config"
+	"github.com/go-chi/chi/v5"
+)
+
+// newNamedUpstream starts a registry stub that reports its own name in every
+// version listing
+func newNamedUpstream(t *testing.T, name string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"upstream":%q,"versions":[{"version":"1.0.0"}]}`, name)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestMultipleRegistries(t *testing.T) {
+	terraform := newNamedUpstream(t, "terraform")
+	opentofu := newNamedUpstream(t, "opentofu")
+	internal := newNamedUpstream(t, "internal")
+
+	cfg := createTestConfig()
+	cfg.Storage.File.Path = t.TempDir()
+	cfg.Terraform.RegistryUrl = terraform.URL
+	cfg.Terraform.Registries = []config.RegistryConfig{
+		{Name: "opentofu", URL: opentofu.URL, Prefix: "registry.opentofu.org"},
+		{Name: "internal", URL: internal.URL, Host: "registry.corp.example.com"},
+	}
+
+	service, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+
+	router := chi.NewRouter()
+	service.RegisterRoutes(router)
+
+	tests := []struct {
+		name     string
+		host     string
+		path     string
+		upstream string
+		cacheKey string
+	}{
+		{
+			name:     "default registry",
+			path:     "/v1/providers/hashicorp/aws/versions",
+			upstream: "terraform",
+			cacheKey: "registry/" + mustHost(t, terraform.URL) + "/v1/versions/hashicorp/aws",
+		},
+		{
+			name:     "prefixed registry",
+			path:     "/registry.opentofu.org/v1/providers/hashicorp/aws/versions",
+			upstream: "opentofu",
+			cacheKey: "registry/opentofu/v1/versions/hashicorp/aws",
+		},
+		{
+			name:     "virtual host registry",
+			host:     "registry.corp.example.com:443",
+			path:     "/v1/providers/hashicorp/aws/versions",
+			upstream: "internal",
+			cacheKey: "registry/internal/v1/versions/hashicorp/aws",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			if tt.host != "" {
+				req.Host = tt.host
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d", w.Code)
+			}
+			if !contains(w.Body.String(), `"upstream":"`+tt.upstream+`"`) {
+				t.Errorf("Expected response from %s upstream, got %s", tt.upstream, w.Body.String())
+			}
+			if !service.store.FileExists(context.Background(), tt.cacheKey) {
+				t.Errorf("Expected response to be cached under %s", tt.cacheKey)
+			}
+		})
+	}
+}
+
+func TestWellKnownPerRegistry(t *testing.T) {
+	cfg := createTestConfig()
+	cfg.Storage.File.Path = t.TempDir()
+	cfg.Terraform.Registries = []config.RegistryConfig{
+		{URL: "https://registry.opentofu.org", Prefix: "tofu"},
+		{URL: "https://registry.corp.example.com", Host: "registry.tp.example.com"},
+	}
+
+	service, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+
+	router := chi.NewRouter()
+	service.RegisterRoutes(router)
+
+	tests := []struct {
+		name     string
+		host     string
+		path     string
+		expected string
+	}{
+		{
+			name:     "default registry",
+			path:     "/.well-known/terraform.json",
+			expected: `{"modules.v1": "/v1/modules/", "providers.v1": "/v1/providers/"}`,
+		},
+		{
+			name:     "prefixed registry",
+			path:     "/tofu/.well-known/terraform.json",
+			expected: `{"modules.v1": "/tofu/v1/modules/", "providers.v1": "/tofu/v1/providers/"}`,
+		},
+		{
+			name:     "virtual host registry",
+			host:     "registry.tp.example.com",
+			path:     "/.well-known/terraform.json",
+			expected: `{"modules.v1": "/v1/modules/", "providers.v1": "/v1/providers/"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			if tt.host != "" {
+				req.Host = tt.host
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d", w.Code)
+			}
+			if w.Body.String() != tt.expected {
+				t.Errorf("Expected body %s, got %s", tt.expected, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestNewRegistriesValidation(t *testing.T) {
+	tests := []struct {
+		name       string
+		registries []config.RegistryConfig
+		rewrites   []config.CacheRewrite
+	}{
+		{
+			name: "duplicate name",
+			registries: []config.RegistryConfig{
+				{URL: "https://registry.opentofu.org", Prefix: "a"},
+				{URL: "https://registry.opentofu.org", Prefix: "b"},
+			},
+		},
+		{
+			name: "prefix shadows a cached host",
+			registries: []config.RegistryConfig{
+				{URL: "https://registry.opentofu.org", Prefix: "github.com"},
+			},
+		},
+		{
+			name: "prefix shadows a rewrite",
+			registries: []config.RegistryConfig{
+				{URL: "https://registry.opentofu.org", Prefix: "gh-releases"},
+			},
+			rewrites: []config.CacheRewrite{{Prefix: "/gh-releases/", Host: "github.com"}},
+		},
+		{
+			name: "reserved name",
+			registries: []config.RegistryConfig{
+				{Name: "v1", URL: "https://registry.opentofu.org", Prefix: "tofu"},
+			},
+		},
+		{
+			name: "duplicate virtual host",
+			registries: []config.RegistryConfig{
+				{Name: "a", URL: "https://a.example.com", Host: "tp.example.com"},
+				{Name: "b", URL: "https://b.example.com", Host: "tp.example.com"},
+			},
+		},
+		{
+			name: "invalid url",
+			registries: []config.RegistryConfig{
+				{URL: "not-a-url", Prefix: "x"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := createTestConfig()
+			cfg.Terraform.Registries = tt.registries
+			cfg.Cache.Rewrites = tt.rewrites
+
+			if _, err := newRegistries(cfg); err == nil {
+				t.Error("Expected an error, got none")
+			}
+		})
+	}
+}
+
+func mustHost(t *testing.T, rawURL string) string {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatalf("Failed to parse %s: %v", rawURL, err)
+	}
+	return u.Host
+}
+
+func TestRegistryEndpoint(t *testing.T) {
+	cfg := createTestConfig()
+	cfg.Storage.File.Path = t.TempDir()
+	cfg.Terraform.RegistryUrl = "https://registry.terraform.io"
+	cfg.Terraform.Registries = []config.RegistryConfig{
+		{URL: "https://registry.opentofu.org", Prefix: "tofu"},
+		{URL: "https://registry.corp.example.com", Host: "registry.tp.example.com"},
+	}
+
+	service, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+
+	tests := []struct {
+		hostname     string
+		expectedPath string
+		expectedHost string
+		expectedOK   bool
+	}{
+		{"registry.terraform.io", "", "", true},
+		{"registry.opentofu.org", "/tofu", "", true},
+		{"registry.corp.example.com", "", "registry.tp.example.com", true},
+		{"registry.example.com", "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.hostname, func(t *testing.T) {
+			basePath, virtualHost, ok := service.RegistryEndpoint(tt.hostname)
+			if basePath != tt.expectedPath || virtualHost != tt.expectedHost || ok != tt.expectedOK {
+				t.Errorf("Expected (%q, %q, %v), got (%q, %q, %v)", tt.expectedPath, tt.expectedHost, tt.expectedOK, basePath, virtualHost, ok)
+			}
+		})
+	}
+}
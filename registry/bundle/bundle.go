@@ -0,0 +1,300 @@
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aliharirian/TerraPeak/logger"
+	"github.com/aliharirian/TerraPeak/store"
+	"github.com/klauspost/compress/zstd"
+)
+
+// manifestName is the first entry of every bundle
+const manifestName = "manifest.json"
+
+// objectsDir holds the objects inside a bundle, one tar entry per key
+const objectsDir = "objects/"
+
+// Manifest lists every object of a bundle
+type Manifest struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	Entries []Entry   `json:"entries"`
+}
+
+// Entry describes one object of a bundle
+type Entry struct {
+	Key      string          `json:"key"`
+	Size     int64           `json:"size"`
+	SHA256   string          `json:"sha256"`
+	Metadata *store.Metadata `json:"metadata,omitempty"` // upstream headers, source and fetch time
+}
+
+// Export writes the objects stored under keys to w as a tar.zst bundle. The
+// manifest comes first, so import can check every object as it streams in.
+func Export(ctx context.Context, backend store.Storage, keys []string, w io.Writer) (*Manifest, error) {
+	manifest := &Manifest{Version: 1, Created: time.Now().UTC()}
+
+	// First pass: sizes and checksums for the manifest
+	for _, key := range keys {
+		size, sum, err := digest(ctx, backend, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", key, err)
+		}
+		entry := Entry{Key: key, Size: size, SHA256: sum}
+		if record, err := store.ReadMetadata(ctx, backend, key); err == nil {
+			entry.Metadata = record
+		}
+		manifest.Entries = append(manifest.Entries, entry)
+	}
+
+	zw, err := zstd.NewWriter(w)
+	if err != nil {
+		return nil, err
+	}
+	tw := tar.NewWriter(zw)
+
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeEntry(tw, manifestName, int64(len(manifestData)), bytes.NewReader(manifestData)); err != nil {
+		return nil, err
+	}
+
+	// Second pass: the objects themselves, checked against the manifest in
+	// case they changed in between
+	for _, entry := range manifest.Entries {
+		if err := exportObject(ctx, backend, tw, entry); err != nil {
+			return nil, err
+		}
+		logger.Debugf("Exported %s (%d bytes)", entry.Key, entry.Size)
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+func exportObject(ctx context.Context, backend store.Storage, tw *tar.Writer, entry Entry) error {
+	reader, err := backend.StreamRead(ctx, entry.Key)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", entry.Key, err)
+	}
+	defer reader.Close()
+
+	h := sha256.New()
+	if err := writeEntry(tw, objectsDir+entry.Key, entry.Size, io.TeeReader(reader, h)); err != nil {
+		return fmt.Errorf("failed to export %s: %w", entry.Key, err)
+	}
+	if hex.EncodeToString(h.Sum(nil)) != entry.SHA256 {
+		return fmt.Errorf("%s changed during export", entry.Key)
+	}
+	return nil
+}
+
+func writeEntry(tw *tar.Writer, name string, size int64, r io.Reader) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+	}); err != nil {
+		return err
+	}
+	_, err := io.Copy(tw, r)
+	return err
+}
+
+// digest returns the size and SHA256 of a stored object
+func digest(ctx context.Context, backend store.Storage, key string) (int64, string, error) {
+	reader, err := backend.StreamRead(ctx, key)
+	if err != nil {
+		return 0, "", err
+	}
+	defer reader.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, reader)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Import loads a bundle into backend. Every object is staged and checked
+// against the manifest, and every manifest entry must be present, before
+// anything is written to backend.
+func Import(ctx context.Context, backend store.Storage, r io.Reader) (*Manifest, error) {
+	zr, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+
+	header, err := tr.Next()
+	if err != nil || header.Name != manifestName {
+		return nil, errors.New("not a TerraPeak bundle: manifest missing")
+	}
+	var manifest Manifest
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	if manifest.Version != 1 {
+		return nil, fmt.Errorf("unsupported bundle version %d", manifest.Version)
+	}
+
+	// Objects are written under their canonical key, which is where the
+	// server looks them up, even if the bundle was exported from a store
+	// whose keys were not migrated yet
+	expected := make(map[string]Entry, len(manifest.Entries))
+	canonical := make(map[string]bool, len(manifest.Entries))
+	for _, entry := range manifest.Entries {
+		name := entry.Key
+		key, err := canonicalKey(name)
+		if err != nil {
+			return nil, err
+		}
+		if canonical[key] {
+			return nil, fmt.Errorf("%s appears twice in the manifest", key)
+		}
+		canonical[key] = true
+		entry.Key = key
+		expected[name] = entry
+	}
+
+	staging, err := os.MkdirTemp("", "terrapeak-import-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging)
+
+	staged := make(map[string]*stagedObject, len(expected))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read bundle: %w", err)
+		}
+
+		key := strings.TrimPrefix(header.Name, objectsDir)
+		entry, ok := expected[key]
+		if !ok || !strings.HasPrefix(header.Name, objectsDir) {
+			return nil, fmt.Errorf("%s is not listed in the manifest", header.Name)
+		}
+		if staged[key] != nil {
+			return nil, fmt.Errorf("%s appears twice in the bundle", key)
+		}
+
+		object, err := stageObject(filepath.Join(staging, strconv.Itoa(len(staged))), tr, entry)
+		if err != nil {
+			return nil, err
+		}
+		staged[key] = object
+	}
+
+	for key := range expected {
+		if staged[key] == nil {
+			return nil, fmt.Errorf("%s is listed in the manifest but missing from the bundle", key)
+		}
+	}
+
+	// The bundle is complete and intact, only now is the backend touched
+	imported := make([]string, 0, len(staged))
+	for _, entry := range manifest.Entries {
+		object := staged[entry.Key]
+		if err := object.write(ctx, backend); err != nil {
+			if len(imported) > 0 {
+				return nil, fmt.Errorf("%w (already imported: %s)", err, strings.Join(imported, ", "))
+			}
+			return nil, err
+		}
+		imported = append(imported, object.entry.Key)
+		logger.Debugf("Imported %s (%d bytes)", object.entry.Key, object.entry.Size)
+	}
+	return &manifest, nil
+}
+
+// stagedObject is an object of a bundle that was checked against its
+// manifest entry and waits in a temporary file to be written
+type stagedObject struct {
+	entry Entry
+	path  string
+	md5   string
+}
+
+// stageObject copies an object to path and checks it against its manifest
+// entry
+func stageObject(path string, r io.Reader, entry Entry) (*stagedObject, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	sha, md := sha256.New(), md5.New()
+	size, err := io.Copy(io.MultiWriter(file, sha, md), r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", entry.Key, err)
+	}
+	if size != entry.Size || hex.EncodeToString(sha.Sum(nil)) != entry.SHA256 {
+		return nil, fmt.Errorf("%s does not match the manifest", entry.Key)
+	}
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+	return &stagedObject{entry: entry, path: path, md5: hex.EncodeToString(md.Sum(nil))}, nil
+}
+
+// write stores the staged object and its metadata record in backend
+func (o *stagedObject) write(ctx context.Context, backend store.Storage) error {
+	file, err := os.Open(o.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := backend.StreamWrite(ctx, o.entry.Key, file, o.entry.Size); err != nil {
+		return fmt.Errorf("failed to write %s: %w", o.entry.Key, err)
+	}
+
+	// Keep the exported record, so the object is served as it was fetched
+	record := &store.Metadata{}
+	if o.entry.Metadata != nil {
+		*record = *o.entry.Metadata
+	}
+	record.MD5, record.SHA256, record.Size = o.md5, o.entry.SHA256, o.entry.Size
+	return store.WriteMetadata(ctx, backend, o.entry.Key, record)
+}
+
+// canonicalKey returns the key an object of the manifest is stored under. It
+// rejects keys that would escape the storage root and keys of the metadata
+// records, which are written from the manifest entries instead.
+func canonicalKey(key string) (string, error) {
+	canonical, err := store.NormalizeKey(key)
+	if err != nil || store.IsMetadataKey(canonical) {
+		return "", fmt.Errorf("invalid key %q in manifest", key)
+	}
+	return canonical, nil
+}
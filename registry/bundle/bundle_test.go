@@ -0,0 +1,349 @@
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/aliharirian/TerraPeak/config"
+	"github.com/aliharirian/TerraPeak/store"
+	"github.com/aliharirian/TerraPeak/store/filesystem"
+	"github.com/klauspost/compress/zstd"
+)
+
+func newTestStorage(t *testing.T) *filesystem.Storage {
+	t.Helper()
+	cfg := &config.Config{}
+	cfg.Storage.File.Path = t.TempDir()
+	storage, err := filesystem.New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	return storage
+}
+
+// populate stores one provider version with its artifacts, one module and an
+// unrelated file
+func populate(t *testing.T, storage *filesystem.Storage) {
+	t.Helper()
+	base := "https://tp.example.com/releases.hashicorp.com/terraform-provider-null/3.2.0/"
+	details := `{"download_url":"` + base + `terraform-provider-null_3.2.0_linux_amd64.zip",` +
+		`"shasums_url":"` + base + `terraform-provider-null_3.2.0_SHA256SUMS",` +
+		`"shasums_signature_url":"` + base + `terraform-provider-null_3.2.0_SHA256SUMS.sig"}`
+
+	files := map[string]string{
+		"registry/terraform/v1/versions/hashicorp/null":                                                                        `{"versions":[]}`,
+		"registry/terraform/v1/download/hashicorp/null/3.2.0/linux/amd64":                                                      details,
+		"releases.hashicorp.com/terraform-provider-null/3.2.0/terraform-provider-null_3.2.0_linux_amd64.zip":                   "zip",
+		"releases.hashicorp.com/terraform-provider-null/3.2.0/terraform-provider-null_3.2.0_SHA256SUMS":                        "sums",
+		"releases.hashicorp.com/terraform-provider-null/3.2.0/terraform-provider-null_3.2.0_SHA256SUMS.sig":                    "sig",
+		"verification/releases.hashicorp.com/terraform-provider-null/3.2.0/terraform-provider-null_3.2.0_linux_amd64.zip.json": `{}`,
+		"registry/terraform/v1/modules/versions/hashicorp/consul/aws":                                                          `{"modules":[]}`,
+		"registry/terraform/v1/modules/download/hashicorp/consul/aws/0.1.0":                                                    "git::https://github.com/hashicorp/terraform-aws-consul?ref=v0.1.0",
+		"codeload.github.com/hashicorp/terraform-aws-consul/tar.gz/v0.1.0":                                                     "tarball",
+		"registry/terraform/v1/versions/hashicorp/aws":                                                                         `{"versions":[]}`,
+	}
+	for key, content := range files {
+		if err := storage.Write(context.Background(), key, []byte(content)); err != nil {
+			t.Fatalf("Failed to write %s: %v", key, err)
+		}
+		if err := store.WriteMetadata(context.Background(), storage, key, &store.Metadata{MD5: "md5", SHA256: "sha256", Size: int64(len(content))}); err != nil {
+			t.Fatalf("Failed to save metadata for %s: %v", key, err)
+		}
+	}
+}
+
+func TestSelectionKeys(t *testing.T) {
+	storage := newTestStorage(t)
+	populate(t, storage)
+
+	tests := []struct {
+		name     string
+		sel      Selection
+		expected int
+	}{
+		{"provider with artifacts", Selection{Providers: []string{"hashicorp/null"}}, 6},
+		{"module with archive", Selection{Modules: []string{"hashicorp/consul/aws"}}, 3},
+		{"host", Selection{Hosts: []string{"releases.hashicorp.com"}}, 3},
+		{"prefix", Selection{Prefixes: []string{"registry/terraform/v1/versions/"}}, 2},
+		{"unknown provider", Selection{Providers: []string{"hashicorp/google"}}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, _, err := tt.sel.Keys(context.Background(), storage)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(keys) != tt.expected {
+				t.Errorf("Expected %d keys, got %d: %v", tt.expected, len(keys), keys)
+			}
+			for _, key := range keys {
+				if strings.HasSuffix(key, ".metadata.json") || strings.HasSuffix(key, ".success") {
+					t.Errorf("Expected metadata records to be left out, got %s", key)
+				}
+			}
+		})
+	}
+
+	if _, _, err := (Selection{Providers: []string{"null"}}).Keys(context.Background(), storage); err == nil {
+		t.Error("Expected an error for a malformed provider")
+	}
+}
+
+func TestSelectionArtifactKeys(t *testing.T) {
+	ctx := context.Background()
+	storage := newTestStorage(t)
+
+	write := func(key, content, sourceURL string) {
+		t.Helper()
+		if err := storage.Write(ctx, key, []byte(content)); err != nil {
+			t.Fatalf("Failed to write %s: %v", key, err)
+		}
+		if err := store.WriteMetadata(ctx, storage, key, &store.Metadata{Size: int64(len(content)), SourceURL: sourceURL}); err != nil {
+			t.Fatalf("Failed to save metadata for %s: %v", key, err)
+		}
+	}
+
+	// Provider artifacts on a non-default port and with a query string are
+	// keyed the way the cache handler keys them
+	write("registry/terraform/v1/download/acme/widget/1.0.0/linux/amd64",
+		`{"download_url":"https://tp.example.com/mirror.example.com:8443/widget.zip?token=a%2Fb"}`, "")
+	artifact := "mirror.example.com:8443/widget.zip?token%3Da%252Fb"
+	write(artifact, "zip", "")
+
+	// A relative module location resolves against the download URL recorded
+	// with it; without one the module is reported as skipped
+	write("registry/terraform/v1/modules/download/acme/net/aws/1.0.0", "/archives/net-1.0.0.tar.gz",
+		"https://registry.example.com/v1/modules/acme/net/aws/1.0.0/download")
+	write("registry.example.com/archives/net-1.0.0.tar.gz", "tarball", "")
+	write("registry/terraform/v1/modules/download/acme/net/aws/2.0.0", "/archives/net-2.0.0.tar.gz", "")
+
+	sel := Selection{Providers: []string{"acme/widget"}, Modules: []string{"acme/net/aws"}}
+	keys, skipped, err := sel.Keys(ctx, storage)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	selected := make(map[string]bool)
+	for _, key := range keys {
+		selected[key] = true
+	}
+	for _, key := range []string{artifact, "registry.example.com/archives/net-1.0.0.tar.gz"} {
+		if !selected[key] {
+			t.Errorf("Expected %s to be selected, got %v", key, keys)
+		}
+	}
+	if len(skipped) != 1 || !strings.Contains(skipped[0], "/v1/modules/download/acme/net/aws/2.0.0") {
+		t.Errorf("Expected the 2.0.0 module to be skipped, got %v", skipped)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	source := newTestStorage(t)
+	populate(t, source)
+
+	keys, _, err := Selection{Providers: []string{"hashicorp/null"}}.Keys(context.Background(), source)
+	if err != nil {
+		t.Fatalf("Failed to select keys: %v", err)
+	}
+
+	var archive bytes.Buffer
+	manifest, err := Export(context.Background(), source, keys, &archive)
+	if err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	if len(manifest.Entries) != len(keys) {
+		t.Errorf("Expected %d manifest entries, got %d", len(keys), len(manifest.Entries))
+	}
+
+	target := newTestStorage(t)
+	imported, err := Import(context.Background(), target, bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	if len(imported.Entries) != len(keys) {
+		t.Errorf("Expected %d imported entries, got %d", len(keys), len(imported.Entries))
+	}
+
+	for _, key := range keys {
+		want, _ := source.Read(context.Background(), key)
+		got, err := target.Read(context.Background(), key)
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("Expected %s to be imported, got %q (%v)", key, got, err)
+		}
+		exported, err := store.ReadMetadata(context.Background(), source, key)
+		if err != nil {
+			t.Fatalf("Failed to read metadata for %s: %v", key, err)
+		}
+		record, err := store.ReadMetadata(context.Background(), target, key)
+		if err != nil {
+			t.Errorf("Expected metadata for %s: %v", key, err)
+		} else if !record.Timestamp.Equal(exported.Timestamp) {
+			t.Errorf("Expected fetch time %v for %s, got %v", exported.Timestamp, key, record.Timestamp)
+		}
+	}
+}
+
+func TestImportCanonicalKeys(t *testing.T) {
+	source := newTestStorage(t)
+
+	// Saved by a version that did not normalize keys
+	legacy := "example.com/archive.zip?" + strings.Repeat("q", 220)
+	canonical, _ := store.NormalizeKey(legacy)
+	if err := source.Write(context.Background(), legacy, []byte("archive")); err != nil {
+		t.Fatalf("Failed to write %s: %v", legacy, err)
+	}
+
+	var archive bytes.Buffer
+	if _, err := Export(context.Background(), source, []string{legacy}, &archive); err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+
+	target := newTestStorage(t)
+	if _, err := Import(context.Background(), target, bytes.NewReader(archive.Bytes())); err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	if data, err := target.Read(context.Background(), canonical); err != nil || string(data) != "archive" {
+		t.Errorf("Expected the object under its canonical key, got %q, %v", data, err)
+	}
+	if _, err := store.ReadMetadata(context.Background(), target, canonical); err != nil {
+		t.Errorf("Expected metadata under the canonical key: %v", err)
+	}
+	if target.Exists(context.Background(), legacy) {
+		t.Error("Expected nothing under the legacy key")
+	}
+}
+
+// rewrite decodes a bundle, lets edit change its entries and encodes it again
+func rewrite(t *testing.T, data []byte, edit func(name string, content []byte) (string, []byte, bool)) []byte {
+	t.Helper()
+	zr, err := zstd.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Failed to open bundle: %v", err)
+	}
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+
+	var out bytes.Buffer
+	zw, _ := zstd.NewWriter(&out)
+	tw := tar.NewWriter(zw)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to read bundle: %v", err)
+		}
+		content, _ := io.ReadAll(tr)
+		name, content, keep := edit(header.Name, content)
+		if !keep {
+			continue
+		}
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		tw.Write(content)
+	}
+	tw.Close()
+	zw.Close()
+	return out.Bytes()
+}
+
+func TestImportRejectsBadBundles(t *testing.T) {
+	source := newTestStorage(t)
+	populate(t, source)
+
+	var archive bytes.Buffer
+	keys := []string{"registry/terraform/v1/versions/hashicorp/null", "registry/terraform/v1/versions/hashicorp/aws"}
+	if _, err := Export(context.Background(), source, keys, &archive); err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		edit     func(name string, content []byte) (string, []byte, bool)
+		expected string
+	}{
+		{
+			name: "tampered object",
+			edit: func(name string, content []byte) (string, []byte, bool) {
+				if name == objectsDir+keys[0] {
+					return name, []byte(`{"versions":[{}]}`), true
+				}
+				return name, content, true
+			},
+			expected: "does not match the manifest",
+		},
+		{
+			name: "missing object",
+			edit: func(name string, content []byte) (string, []byte, bool) {
+				return name, content, name != objectsDir+keys[1]
+			},
+			expected: "missing from the bundle",
+		},
+		{
+			name: "unlisted object",
+			edit: func(name string, content []byte) (string, []byte, bool) {
+				if name == objectsDir+keys[1] {
+					return objectsDir + "registry/other", content, true
+				}
+				return name, content, true
+			},
+			expected: "not listed in the manifest",
+		},
+		{
+			name: "escaping key",
+			edit: func(name string, content []byte) (string, []byte, bool) {
+				if name == manifestName {
+					var manifest Manifest
+					json.Unmarshal(content, &manifest)
+					manifest.Entries[0].Key = "../outside"
+					content, _ = json.Marshal(manifest)
+				}
+				return name, content, true
+			},
+			expected: "invalid key",
+		},
+		{
+			name: "metadata record key",
+			edit: func(name string, content []byte) (string, []byte, bool) {
+				if name == manifestName {
+					var manifest Manifest
+					json.Unmarshal(content, &manifest)
+					manifest.Entries[0].Key += ".metadata.json"
+					content, _ = json.Marshal(manifest)
+				}
+				return name, content, true
+			},
+			expected: "invalid key",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := newTestStorage(t)
+			_, err := Import(context.Background(), target, bytes.NewReader(rewrite(t, archive.Bytes(), tt.edit)))
+			if err == nil || !strings.Contains(err.Error(), tt.expected) {
+				t.Fatalf("Expected error containing %q, got %v", tt.expected, err)
+			}
+		})
+	}
+
+	// A tampered object never reaches the store
+	target := newTestStorage(t)
+	Import(context.Background(), target, bytes.NewReader(rewrite(t, archive.Bytes(), tests[0].edit)))
+	if target.Exists(context.Background(), keys[0]) {
+		t.Error("Expected the tampered object not to be written")
+	}
+
+	// Nor does anything else of a bundle that turns out to be incomplete
+	target = newTestStorage(t)
+	Import(context.Background(), target, bytes.NewReader(rewrite(t, archive.Bytes(), tests[1].edit)))
+	if target.Exists(context.Background(), keys[0]) {
+		t.Error("Expected nothing of an incomplete bundle to be written")
+	}
+}
@@ -0,0 +1,178 @@
+package bundle
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/aliharirian/TerraPeak/modarchive"
+	"github.com/aliharirian/TerraPeak/store"
+	"github.com/aliharirian/TerraPeak/verify"
+)
+
+// Selection picks the stored content to export
+type Selection struct {
+	Providers []string // "namespace/type", with their archives and SHASUMS
+	Modules   []string // "namespace/name/provider", with their archives
+	Hosts     []string // cached upstream hosts, e.g. "releases.hashicorp.com"
+	Prefixes  []string // raw key prefixes
+}
+
+// Keys resolves the selection to the sorted list of stored keys, leaving out
+// the metadata records the backends keep next to each object. skipped
+// describes the module archives that were selected but cannot be exported.
+func (sel Selection) Keys(ctx context.Context, backend store.Storage) (keys []string, skipped []string, err error) {
+	selected := make(map[string]bool)
+	add := func(key string) {
+		if !store.IsMetadataKey(key) && backend.Exists(ctx, key) {
+			selected[key] = true
+		}
+	}
+
+	var registryKeys []string
+	if len(sel.Providers) > 0 || len(sel.Modules) > 0 {
+		if registryKeys, err = store.ListAll(ctx, backend, "registry/"); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for _, provider := range sel.Providers {
+		parts := strings.Split(provider, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, nil, fmt.Errorf("invalid provider %q, expected namespace/type", provider)
+		}
+		versions := "/v1/versions/" + provider
+		downloads := "/v1/download/" + provider + "/"
+
+		for _, key := range registryKeys {
+			rest := registryRelative(key)
+			switch {
+			case rest == versions:
+				add(key)
+			case strings.HasPrefix(rest, downloads) && !store.IsMetadataKey(key):
+				add(key)
+				for _, artifact := range providerArtifacts(ctx, backend, key) {
+					add(artifact)
+					add(verify.ExpectationKey(artifact))
+				}
+			}
+		}
+	}
+
+	for _, module := range sel.Modules {
+		parts := strings.Split(module, "/")
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			return nil, nil, fmt.Errorf("invalid module %q, expected namespace/name/provider", module)
+		}
+		versions := "/v1/modules/versions/" + module
+		downloads := "/v1/modules/download/" + module + "/"
+
+		for _, key := range registryKeys {
+			rest := registryRelative(key)
+			switch {
+			case rest == versions:
+				add(key)
+			case strings.HasPrefix(rest, downloads) && !store.IsMetadataKey(key):
+				add(key)
+				artifact, err := moduleArtifact(ctx, backend, key)
+				if err != nil {
+					skipped = append(skipped, fmt.Sprintf("%s: %v", key, err))
+					continue
+				}
+				add(artifact)
+			}
+		}
+	}
+
+	for _, host := range sel.Hosts {
+		listed, err := store.ListAll(ctx, backend, strings.Trim(host, "/")+"/")
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, key := range listed {
+			add(key)
+		}
+	}
+
+	for _, prefix := range sel.Prefixes {
+		listed, err := store.ListAll(ctx, backend, prefix)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, key := range listed {
+			add(key)
+		}
+	}
+
+	keys = make([]string, 0, len(selected))
+	for key := range selected {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, skipped, nil
+}
+
+// registryRelative strips the "registry/{name}" namespace from a registry key
+func registryRelative(key string) string {
+	rest := strings.TrimPrefix(key, "registry/")
+	if i := strings.Index(rest, "/"); i >= 0 {
+		return rest[i:]
+	}
+	return ""
+}
+
+// providerArtifacts returns the cache keys of the archive, SHASUMS and
+// signature that stored download details point at
+func providerArtifacts(ctx context.Context, backend store.Storage, detailsKey string) []string {
+	data, err := backend.Read(ctx, detailsKey)
+	if err != nil {
+		return nil
+	}
+	var details map[string]any
+	if err := json.Unmarshal(data, &details); err != nil {
+		return nil
+	}
+
+	var artifacts []string
+	for _, field := range []string{"download_url", "shasums_url", "shasums_signature_url"} {
+		location, _ := details[field].(string)
+		u, err := url.Parse(location)
+		if err != nil || u.Host == "" {
+			continue
+		}
+		// Stored details point at TerraPeak: /{host}/{path} is what the
+		// cache handler keys the artifact by
+		host, rest, _ := strings.Cut(strings.TrimPrefix(u.Path, "/"), "/")
+		if host == "" {
+			continue
+		}
+		artifacts = append(artifacts, store.URLKey(host, "/"+rest, u.RawQuery))
+	}
+	return artifacts
+}
+
+// moduleArtifact returns the cache key of the archive a stored module
+// location resolves to. Relative locations are resolved against the
+// download URL recorded as the source of the location.
+func moduleArtifact(ctx context.Context, backend store.Storage, locationKey string) (string, error) {
+	location, err := backend.Read(ctx, locationKey)
+	if err != nil {
+		return "", err
+	}
+	downloadURL := ""
+	if record, err := store.ReadMetadata(ctx, backend, locationKey); err == nil {
+		downloadURL = record.SourceURL
+	}
+
+	archiveURL, _, ok := modarchive.URL(string(location), downloadURL)
+	if !ok {
+		if u, err := url.Parse(string(location)); err == nil && !u.IsAbs() && downloadURL == "" {
+			return "", fmt.Errorf("relative location %s has no download URL recorded to resolve it against", location)
+		}
+		return "", fmt.Errorf("%s is not an archive TerraPeak caches", location)
+	}
+	return modarchive.Key(archiveURL), nil
+}
@@ -2,23 +2,49 @@ package cache
 
 import (
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"net/http"
-	"net/url"
+	"path"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aliharirian/TerraPeak/logger"
+	"github.com/aliharirian/TerraPeak/proxy"
+	"github.com/aliharirian/TerraPeak/store"
 )
 
 // StoreInterface defines the interface for the store that the cache handler will use
 // This matches the methods available in the existing store package
 type StoreInterface interface {
-	FileExists(filePath string) bool
-	ReadFromStorage(filePath string) ([]byte, error)
-	Save(filename string, data []byte) error
+	FileExists(ctx context.Context, filePath string) bool
+	ReadFromStorage(ctx context.Context, filePath string) ([]byte, error)
+	StreamFromStorage(ctx context.Context, filePath string) (io.ReadCloser, error)
+	Metadata(ctx context.Context, filename string) (*store.Metadata, error)
+	Save(ctx context.Context, filename string, data []byte) error
+	SaveMetadata(ctx context.Context, filename string, record *store.Metadata) error
+	SaveStream(ctx context.Context, filename string, reader io.Reader, size int64, info *store.Metadata) error
+}
+
+// storedHeaders are the upstream response headers kept in the metadata
+// record of a cached object
+var storedHeaders = []string{
+	"Content-Type", "Content-Disposition", "Content-Encoding", "Content-Language",
+	"ETag", "Last-Modified", "Cache-Control", "Expires",
+}
+
+// replayedHeaders are the stored headers sent again when the object is served
+// from the cache. The ETag served is the object's SHA256 instead.
+var replayedHeaders = []string{"Content-Type", "Content-Disposition", "Content-Encoding", "Content-Language"}
+
+// Verifier checks a downloaded artifact by its SHA256 before it is cached. An
+// error rejects the artifact: it is neither cached nor served completely.
+type Verifier interface {
+	VerifySum(ctx context.Context, cacheKey, sha256Sum string) error
 }
 
 // Handler handles HTTP requests with transparent caching and proxying
@@ -26,6 +52,9 @@ type Handler struct {
 	store      StoreInterface
 	config     *Config
 	httpClient *http.Client
+	verifier   Verifier
+	fillsMu    sync.Mutex
+	fills      map[string]*fill // upstream fetches in flight, by cache key
 }
 
 // NewCacheHandler creates a new cache handler with the given store and configuration
@@ -57,13 +86,32 @@ func NewCacheHandlerWithClient(store StoreInterface, config *Config, httpClient
 		return nil, fmt.Errorf("invalid cache config: %w", err)
 	}
 
+	// Redirects are followed by the handler's own rules, not the client's
+	var client *http.Client
+	if httpClient != nil {
+		cloned := *httpClient
+		client = &cloned
+	} else {
+		client = &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: config.SkipSSLVerify},
+		}}
+	}
+	client.CheckRedirect = config.checkRedirect
+
 	return &Handler{
 		store:      store,
 		config:     config,
-		httpClient: httpClient,
+		httpClient: client,
 	}, nil
 }
 
+// SetVerifier makes the handler check successful upstream responses with v
+// before they are cached
+func (h *Handler) SetVerifier(v Verifier) {
+	h.verifier = v
+}
+
 // Handle is the main HTTP handler that implements caching and proxying logic
 func (h *Handler) Handle(w http.ResponseWriter, r *http.Request) {
 	// Parse the incoming request to extract host and path
@@ -74,8 +122,11 @@ func (h *Handler) Handle(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check if the host is allowed
-	if !h.config.IsHostAllowed(proxyReq.Host) {
+	// Rewrites route their prefix to a configured upstream; any other first
+	// segment is the upstream host itself and must be allowed or mirrored
+	if rewrite := h.config.rewriteFor(proxyReq.Host); rewrite != nil {
+		rewrite.apply(proxyReq)
+	} else if !h.config.IsHostAllowed(proxyReq.Host) && h.config.mirrorFor(proxyReq.Host) == nil {
 		logger.Warnf("Host %s is not in allowed hosts list", proxyReq.Host)
 		http.Error(w, "Forbidden: Host not allowed", http.StatusForbidden)
 		return
@@ -86,78 +137,299 @@ func (h *Handler) Handle(w http.ResponseWriter, r *http.Request) {
 	// Generate cache key for this request
 	cacheKey := GenerateCacheKey(proxyReq)
 
-	// Check if content exists in cache
-	if h.store.FileExists(cacheKey) {
-		logger.Infof("Cache HIT: Serving cached content for %s", cacheKey)
-		h.serveCachedContent(w, cacheKey)
+	// Check if content exists in cache. Expired content is served as is
+	// offline and to anything but GET; otherwise it is revalidated first.
+	var stale *store.Metadata
+	if h.store.FileExists(r.Context(), cacheKey) {
+		record, fresh := h.freshness(r.Context(), proxyReq, cacheKey)
+		if fresh || h.config.Offline || proxyReq.Method != http.MethodGet {
+			logger.Infof("Cache HIT: Serving cached content for %s", cacheKey)
+			h.serveCachedContent(w, r, cacheKey, "HIT")
+			return
+		}
+		stale = record
+	}
+
+	if h.config.Offline {
+		logger.Infof("Cache MISS: %s is not cached and upstream is not contacted in offline mode", cacheKey)
+		http.Error(w, fmt.Sprintf("%s is not in the cache and TerraPeak is running in offline mode", proxyReq.Host+proxyReq.Path), http.StatusNotFound)
+		return
+	}
+
+	// Concurrent misses for the same key share one upstream fetch
+	var f *fill
+	if proxyReq.Method == http.MethodGet {
+		var leader bool
+		if f, leader = h.joinFill(cacheKey); !leader {
+			h.follow(w, r, f, cacheKey)
+			return
+		}
+		defer h.leaveFill(cacheKey, f)
+
+		// Followers get whatever upstream answers, so it must be the whole
+		// object rather than the part or the 304 this client asked for
+		proxyReq = wholeObjectRequest(proxyReq)
+
+		// The previous fetch may have stored or revalidated the content
+		// since the lookup above
+		if h.store.FileExists(r.Context(), cacheKey) {
+			if _, fresh := h.freshness(r.Context(), proxyReq, cacheKey); fresh {
+				logger.Infof("Cache HIT: Serving cached content for %s", cacheKey)
+				f.complete(servedFromStore{status: "HIT"})
+				h.serveCachedContent(w, r, cacheKey, "HIT")
+				return
+			}
+		}
+	}
+
+	if stale != nil {
+		logger.Infof("Cache EXPIRED: Revalidating %s with upstream %s", cacheKey, proxyReq.Host)
+		h.revalidate(w, r, proxyReq, cacheKey, stale, f)
 		return
 	}
 
 	// Cache miss - need to proxy to upstream and cache the result
 	logger.Infof("Cache MISS: Proxying request to upstream %s", proxyReq.Host)
-	h.proxyAndCache(w, proxyReq, cacheKey)
+	h.proxyAndCache(w, proxyReq, cacheKey, f)
+}
+
+// freshness returns the metadata record of the stored content for cacheKey,
+// never nil, and whether it can be served without asking upstream
+func (h *Handler) freshness(ctx context.Context, proxyReq *ProxyRequest, cacheKey string) (*store.Metadata, bool) {
+	record, err := h.store.Metadata(ctx, cacheKey)
+	if err != nil {
+		logger.Debugf("No metadata for cached content %s: %v", cacheKey, err)
+		return &store.Metadata{}, h.config.isFresh(proxyReq, nil)
+	}
+	return record, h.config.isFresh(proxyReq, record)
+}
+
+// revalidate asks upstream whether the expired content stored for cacheKey
+// is still current. A 304 refreshes its metadata record and serves it from
+// the store, a new version replaces it, and when upstream fails the expired
+// content is served as STALE.
+func (h *Handler) revalidate(w http.ResponseWriter, r *http.Request, proxyReq *ProxyRequest, cacheKey string, stale *store.Metadata, f *fill) {
+	resp, conditional, err := h.openUpstream(revalidationRequest(proxyReq, stale))
+	if err == nil && resp.StatusCode >= http.StatusInternalServerError {
+		resp.Body.Close()
+		err = fmt.Errorf("upstream answered %s", resp.Status)
+	}
+
+	switch {
+	case err != nil:
+		logger.Warnf("Cache STALE: Revalidating %s failed, serving the expired copy: %v", cacheKey, err)
+		f.complete(servedFromStore{status: "STALE"})
+		h.serveCachedContent(w, r, cacheKey, "STALE")
+
+	case resp.StatusCode == http.StatusNotModified:
+		resp.Body.Close()
+		stale.Timestamp = time.Now().UTC()
+		for _, name := range storedHeaders {
+			if values := resp.Header.Values(name); len(values) > 0 {
+				if stale.Header == nil {
+					stale.Header = make(http.Header)
+				}
+				stale.Header[name] = values
+			}
+		}
+		// Followers are served from the refreshed record, so it is saved
+		// even if this client goes away
+		if err := h.store.SaveMetadata(context.Background(), cacheKey, stale); err != nil {
+			logger.Warnf("Failed to refresh metadata of %s: %v", cacheKey, err)
+		}
+		logger.Infof("Cache REVALIDATED: Upstream confirmed %s is current", cacheKey)
+		f.complete(servedFromStore{status: "REVALIDATED"})
+		h.serveCachedContent(w, r, cacheKey, "REVALIDATED")
+
+	default:
+		logger.Infof("Cache MISS: Upstream %s has a new version of %s", proxyReq.Host, cacheKey)
+		if sum := h.cacheResponse(w, conditional, cacheKey, f, resp); sum != "" {
+			h.compareMirrors(proxyReq, conditional, sum)
+		}
+	}
 }
 
-// serveCachedContent serves content from the cache
-func (h *Handler) serveCachedContent(w http.ResponseWriter, cacheKey string) {
-	data, err := h.store.ReadFromStorage(cacheKey)
+// serveCachedContent streams content from the cache. Range, HEAD and
+// conditional requests are answered by http.ServeContent, with the ETag taken
+// from the stored SHA256 and Last-Modified from upstream, or else from the
+// time it was fetched. The upstream content headers kept in the metadata
+// record are replayed. cacheStatus is reported in X-Cache-Status.
+func (h *Handler) serveCachedContent(w http.ResponseWriter, r *http.Request, cacheKey, cacheStatus string) {
+	reader, err := h.store.StreamFromStorage(r.Context(), cacheKey)
 	if err != nil {
 		logger.Errorf("Failed to read cached content for %s: %v", cacheKey, err)
 		http.Error(w, "Internal server error reading cache", http.StatusInternalServerError)
 		return
 	}
+	defer reader.Close()
+
+	// Set cache headers, replaying the upstream ones kept with the object
+	w.Header().Set("X-Cache-Status", cacheStatus)
+	var modTime time.Time
+	status := http.StatusOK
+	if metadata, err := h.store.Metadata(r.Context(), cacheKey); err == nil {
+		modTime = metadata.Timestamp
+		for _, name := range replayedHeaders {
+			if values := metadata.Header.Values(name); len(values) > 0 {
+				w.Header()[name] = values
+			}
+		}
+		if lastModified, err := http.ParseTime(metadata.Header.Get("Last-Modified")); err == nil {
+			modTime = lastModified
+		}
+		if metadata.SHA256 != "" {
+			w.Header().Set("ETag", `"`+metadata.SHA256+`"`)
+		}
+		if metadata.StatusCode != 0 {
+			status = metadata.StatusCode
+		}
+	} else {
+		logger.Debugf("No metadata for cached content %s: %v", cacheKey, err)
+	}
 
-	// Set cache headers
-	w.Header().Set("X-Cache-Status", "HIT")
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
-
-	// Write response
-	w.WriteHeader(http.StatusOK)
-	if _, err := w.Write(data); err != nil {
-		logger.Errorf("Failed to write cached response: %v", err)
+	content, ok := reader.(io.ReadSeeker)
+	if !ok || status != http.StatusOK {
+		// Without seeking there are no ranges: send the whole object, with
+		// the status upstream answered it with
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", "application/octet-stream")
+		}
+		w.WriteHeader(status)
+		if r.Method != http.MethodHead {
+			if _, err := io.Copy(w, reader); err != nil {
+				logger.Errorf("Failed to write cached response: %v", err)
+				return
+			}
+		}
+		logger.Infof("Successfully served cached content for %s", cacheKey)
+		return
 	}
 
-	logger.Infof("Successfully served cached content for %s (%d bytes)", cacheKey, len(data))
+	// The file name picks the Content-Type; the query part of the key is not part of it
+	name, _, _ := strings.Cut(path.Base(cacheKey), "?")
+	http.ServeContent(w, r, name, modTime, content)
+	logger.Infof("Successfully served cached content for %s", cacheKey)
 }
 
-// proxyAndCache proxies the request to upstream server and caches the successful response
-func (h *Handler) proxyAndCache(w http.ResponseWriter, proxyReq *ProxyRequest, cacheKey string) {
-	// Make upstream request with SSL verification config
-	resp, err := MakeUpstreamRequestWithConfig(proxyReq, h.httpClient, h.config.SkipSSLVerify)
+// proxyAndCache proxies the request to upstream server and caches the successful response.
+func (h *Handler) proxyAndCache(w http.ResponseWriter, proxyReq *ProxyRequest, cacheKey string, f *fill) {
+	resp, upstreamReq, err := h.openUpstream(proxyReq)
 	if err != nil {
 		logger.Errorf("Upstream request failed for %s: %v", proxyReq.Host, err)
-		http.Error(w, "Upstream server error", http.StatusBadGateway)
+		f.complete(err)
+		if !proxy.WriteCircuitOpen(w, err) {
+			http.Error(w, "Upstream server error", http.StatusBadGateway)
+		}
 		return
 	}
+	if sum := h.cacheResponse(w, upstreamReq, cacheKey, f, resp); sum != "" {
+		h.compareMirrors(proxyReq, upstreamReq, sum)
+	}
+}
 
-	// Copy response headers to client (excluding hop-by-hop headers)
-	copyResponseHeaders(w.Header(), resp.Headers)
-	w.Header().Set("X-Cache-Status", "MISS")
+// cacheResponse streams an upstream response to the client and, when it may
+// be cached, into the store. The body is streamed to the client, into the
+// store and to the requests following f at the same time; the cache entry is
+// only committed once the full body has been received. It closes the body
+// and returns the SHA256 of the cached content, empty when nothing was cached.
+func (h *Handler) cacheResponse(w http.ResponseWriter, proxyReq *ProxyRequest, cacheKey string, f *fill, resp *http.Response) string {
+	defer resp.Body.Close()
+	f.start(resp.StatusCode, resp.Header)
+
+	// Only whole GET responses upstream allows to be stored end up in the
+	// cache: a 206 holds a part of the object and other 2xx none of it
+	if resp.StatusCode != http.StatusOK || proxyReq.Method != http.MethodGet || h.config.forbidsStore(resp.Header) {
+		logger.Infof("Not caching response for %s (method: %s, status: %d)", cacheKey, proxyReq.Method, resp.StatusCode)
+		copyResponseHeaders(w.Header(), resp.Header)
+		w.Header().Set("X-Cache-Status", "MISS")
+		w.WriteHeader(resp.StatusCode)
+		written, err := io.Copy(io.MultiWriter(&storeWriter{w: w}, f), resp.Body)
+		f.complete(err)
+		if err != nil {
+			logger.Errorf("Failed to proxy response for %s: %v", cacheKey, err)
+			return ""
+		}
+		logger.Infof("Successfully proxied request to %s (%d bytes, status: %d)", proxyReq.Host, written, resp.StatusCode)
+		return ""
+	}
+
+	header := make(http.Header)
+	copyResponseHeaders(header, resp.Header)
+	header.Set("X-Cache-Status", "MISS")
+	client := &heldBackWriter{w: w, header: header, status: resp.StatusCode}
+
+	// The store reads from a pipe until it is closed: cleanly to commit the
+	// entry, with an error to discard it
+	pr, pw := io.Pipe()
+	saved := make(chan error, 1)
+	info := &store.Metadata{
+		StatusCode: resp.StatusCode,
+		SourceURL:  proxyReq.BuildUpstreamURL(),
+		Header:     make(http.Header),
+	}
+	for _, name := range storedHeaders {
+		if values := resp.Header.Values(name); len(values) > 0 {
+			info.Header[name] = values
+		}
+	}
+	go func() {
+		// The fill outlives the request that started it, so the store
+		// write is not bound to its context
+		err := h.store.SaveStream(context.Background(), cacheKey, pr, resp.ContentLength, info)
+		pr.CloseWithError(errStoreDone)
+		saved <- err
+	}()
+	storage := &storeWriter{w: pw}
 
-	// Set status code
-	w.WriteHeader(resp.StatusCode)
+	sum := sha256.New()
+	written, err := io.Copy(io.MultiWriter(client, storage, sum, f), resp.Body)
+	if err == nil && resp.ContentLength >= 0 && written != resp.ContentLength {
+		err = fmt.Errorf("received %d of %d bytes", written, resp.ContentLength)
+	}
+	if err != nil {
+		f.complete(err)
+		pw.CloseWithError(err)
+		<-saved
+		logger.Errorf("Upstream response for %s broke off, not caching it: %v", cacheKey, err)
+		client.abort(http.StatusBadGateway, "Upstream server error")
+		return ""
+	}
+
+	// Reject artifacts that fail verification before the end of the body
+	// reaches the client. Like the store write it serves the whole fill, not
+	// just this request; the verifier bounds its own upstream fetches.
+	if h.verifier != nil {
+		if err := h.verifier.VerifySum(context.Background(), cacheKey, hex.EncodeToString(sum.Sum(nil))); err != nil {
+			f.complete(err)
+			pw.CloseWithError(err)
+			<-saved
+			logger.Errorf("Rejecting %s: verification failed: %v", cacheKey, err)
+			client.abort(http.StatusBadGateway, "Upstream artifact failed verification")
+			return ""
+		}
+	}
 
-	// Write response body to client
-	if _, err := w.Write(resp.Body); err != nil {
-		logger.Errorf("Failed to write response to client: %v", err)
-		return
+	f.complete(nil)
+	client.finish()
+	if client.err != nil {
+		logger.Warnf("Client went away while receiving %s, caching it anyway: %v", cacheKey, client.err)
 	}
 
-	// Cache the response if it was successful
-	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-		if err := h.store.Save(cacheKey, resp.Body); err != nil {
-			logger.Warnf("Failed to cache response for %s: %v", cacheKey, err)
-			// Don't return error to client as the response was already sent
-		} else {
-			logger.Infof("Successfully cached response for %s (%d bytes)", cacheKey, len(resp.Body))
-		}
+	pw.Close()
+	cachedSum := ""
+	if err := <-saved; err != nil {
+		logger.Warnf("Failed to cache response for %s: %v", cacheKey, err)
+		// Don't return error to client as the response was already sent
+	} else if storage.err != nil {
+		logger.Warnf("Failed to cache response for %s: %v", cacheKey, storage.err)
 	} else {
-		logger.Infof("Not caching response for %s (status: %d)", cacheKey, resp.StatusCode)
+		logger.Infof("Successfully cached response for %s (%d bytes)", cacheKey, written)
+		cachedSum = hex.EncodeToString(sum.Sum(nil))
 	}
 
 	logger.Infof("Successfully proxied request to %s (%d bytes, status: %d)",
-		proxyReq.Host, len(resp.Body), resp.StatusCode)
+		proxyReq.Host, written, resp.StatusCode)
+	return cachedSum
 }
 
 // copyResponseHeaders copies headers from upstream response to client response
@@ -181,32 +453,62 @@ func copyResponseHeaders(dst, src http.Header) {
 
 // Config holds cache configuration settings
 type Config struct {
-	// AllowedHosts is a list of upstream hosts that are allowed to be proxied
+	// AllowedHosts is a list of upstream host patterns that are allowed to
+	// be proxied, e.g. "github.com", "*.githubusercontent.com",
+	// "nexus.corp.local:8443" or "!gist.github.com"; see hostPattern
 	AllowedHosts []string `yaml:"allowed_hosts"`
 
 	// SkipSSLVerify disables SSL certificate verification for upstream requests
 	// WARNING: This should only be used in development or with trusted hosts
 	SkipSSLVerify bool `yaml:"skip_ssl_verify"`
+
+	// Offline answers cache misses with 404 instead of contacting upstream
+	Offline bool `yaml:"offline"`
+
+	// TTLRules set how long stored objects are served before they are
+	// revalidated with upstream; the first matching rule wins and objects
+	// no rule matches are kept forever
+	TTLRules []TTLRule `yaml:"ttl"`
+
+	// HonorCacheControl takes the lifetime of objects no rule matches from
+	// the upstream Cache-Control and Expires headers, and skips no-store
+	// responses
+	HonorCacheControl bool `yaml:"honor_cache_control"`
+
+	// Rewrites route requests under a path prefix to an upstream host,
+	// scheme, port and path prefix instead of the host named in the path
+	Rewrites []Rewrite `yaml:"rewrites"`
+
+	// Mirrors serve hosts from an ordered list of upstreams, e.g. an
+	// internal mirror before the public host itself
+	Mirrors []Mirror `yaml:"mirrors"`
+
+	// RedirectHosts are host patterns upstream may redirect to in addition
+	// to the allowed and rewritten hosts, e.g. objects.githubusercontent.com
+	RedirectHosts []string `yaml:"redirect_hosts"`
+
+	// MaxRedirects limits the redirects followed per request; zero means
+	// defaultMaxRedirects, a negative value passes redirects to the client
+	MaxRedirects int `yaml:"max_redirects"`
 }
 
-// IsHostAllowed checks if the given host is in the allowed hosts list
+// IsHostAllowed checks if the given host, with an optional port, matches the
+// allowed host patterns. Hosts are fetched over https, so port 443 counts as
+// no port; any other port must be allowed explicitly.
 func (c *Config) IsHostAllowed(host string) bool {
-	if c == nil || len(c.AllowedHosts) == 0 {
+	if c == nil {
 		return false
 	}
+	return MatchHost(c.AllowedHosts, host, "443")
+}
 
-	// Normalize host by converting to lowercase and removing any port
+// normalizeHost converts host to lowercase and removes any port
+func normalizeHost(host string) string {
 	normalizedHost := strings.ToLower(host)
 	if colonIndex := strings.Index(normalizedHost, ":"); colonIndex != -1 {
 		normalizedHost = normalizedHost[:colonIndex]
 	}
-
-	for _, allowedHost := range c.AllowedHosts {
-		if strings.ToLower(allowedHost) == normalizedHost {
-			return true
-		}
-	}
-	return false
+	return normalizedHost
 }
 
 // Validate ensures the cache configuration is valid
@@ -215,14 +517,53 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("cache config cannot be nil")
 	}
 
-	if len(c.AllowedHosts) == 0 {
-		return fmt.Errorf("cache config must specify at least one allowed host")
+	if len(c.AllowedHosts) == 0 && len(c.Rewrites) == 0 && len(c.Mirrors) == 0 {
+		return fmt.Errorf("cache config must specify at least one allowed host, rewrite or mirror")
 	}
 
 	for i, host := range c.AllowedHosts {
 		if strings.TrimSpace(host) == "" {
 			return fmt.Errorf("allowed host at index %d cannot be empty", i)
 		}
+		if _, err := parseHostPattern(host); err != nil {
+			return fmt.Errorf("allowed host at index %d: %w", i, err)
+		}
+	}
+
+	for i, host := range c.RedirectHosts {
+		if _, err := parseHostPattern(host); err != nil {
+			return fmt.Errorf("redirect host at index %d: %w", i, err)
+		}
+	}
+
+	for i, rule := range c.TTLRules {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("ttl rule at index %d: %w", i, err)
+		}
+	}
+
+	prefixes := make(map[string]bool, len(c.Rewrites))
+	for i, rewrite := range c.Rewrites {
+		if err := rewrite.validate(); err != nil {
+			return fmt.Errorf("rewrite at index %d: %w", i, err)
+		}
+		prefix := strings.Trim(rewrite.Prefix, "/")
+		if prefixes[prefix] {
+			return fmt.Errorf("rewrite at index %d: prefix %q is used twice", i, prefix)
+		}
+		prefixes[prefix] = true
+	}
+
+	mirrored := make(map[string]bool, len(c.Mirrors))
+	for i, mirror := range c.Mirrors {
+		if err := mirror.validate(); err != nil {
+			return fmt.Errorf("mirror at index %d: %w", i, err)
+		}
+		host := strings.ToLower(mirror.Host)
+		if mirrored[host] {
+			return fmt.Errorf("mirror at index %d: host %q is mirrored twice", i, mirror.Host)
+		}
+		mirrored[host] = true
 	}
 
 	return nil
@@ -230,7 +571,8 @@ func (c *Config) Validate() error {
 
 // ProxyRequest contains all the information needed to proxy a request
 type ProxyRequest struct {
-	Host        string
+	Scheme      string // "http" or "https"; empty means https
+	Host        string // upstream host, with the port unless it is the default
 	Path        string
 	Method      string
 	Headers     http.Header
@@ -270,6 +612,13 @@ func ParseRequest(r *http.Request) (*ProxyRequest, error) {
 		return nil, fmt.Errorf("invalid path: host cannot be empty")
 	}
 
+	// Traversal segments would make the cache key leave its host
+	for _, segment := range strings.Split(path, "/") {
+		if segment == ".." {
+			return nil, fmt.Errorf("invalid path: %q contains a parent directory segment", r.URL.Path)
+		}
+	}
+
 	// Reconstruct the path for the upstream server
 	var upstreamPath string
 	if len(parts) == 2 {
@@ -290,7 +639,11 @@ func ParseRequest(r *http.Request) (*ProxyRequest, error) {
 
 // BuildUpstreamURL constructs the full upstream URL from the proxy request
 func (pr *ProxyRequest) BuildUpstreamURL() string {
-	upstreamURL := fmt.Sprintf("https://%s%s", pr.Host, pr.Path)
+	scheme := pr.Scheme
+	if scheme == "" {
+		scheme = "https"
+	}
+	upstreamURL := fmt.Sprintf("%s://%s%s", scheme, pr.Host, pr.Path)
 	if pr.QueryString != "" {
 		upstreamURL += "?" + pr.QueryString
 	}
@@ -304,6 +657,34 @@ func MakeUpstreamRequest(proxyReq *ProxyRequest) (*ProxyResponse, error) {
 
 // MakeUpstreamRequestWithConfig performs the actual HTTP request to the upstream server with custom configuration
 func MakeUpstreamRequestWithConfig(proxyReq *ProxyRequest, httpClient *http.Client, skipSSLVerify bool) (*ProxyResponse, error) {
+	resp, err := OpenUpstreamRequest(proxyReq, httpClient, skipSSLVerify)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// Read response body
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upstream response: %w", err)
+	}
+
+	return &ProxyResponse{
+		StatusCode:    resp.StatusCode,
+		Headers:       resp.Header.Clone(),
+		Body:          body,
+		ContentLength: resp.ContentLength,
+	}, nil
+}
+
+// OpenUpstreamRequest sends the request to the upstream server and returns the
+// response with its body still to be read. The caller must close the body.
+func OpenUpstreamRequest(proxyReq *ProxyRequest, httpClient *http.Client, skipSSLVerify bool) (*http.Response, error) {
+	return openUpstreamRequest(context.Background(), proxyReq, httpClient, skipSSLVerify)
+}
+
+// openUpstreamRequest is OpenUpstreamRequest, abandoned when ctx is canceled
+func openUpstreamRequest(ctx context.Context, proxyReq *ProxyRequest, httpClient *http.Client, skipSSLVerify bool) (*http.Response, error) {
 	if proxyReq == nil {
 		return nil, fmt.Errorf("proxy request cannot be nil")
 	}
@@ -335,28 +716,17 @@ func MakeUpstreamRequestWithConfig(proxyReq *ProxyRequest, httpClient *http.Clie
 	}
 
 	// Per-request timeout (allow large artifact downloads)
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
-	defer cancel()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Minute)
 	req = req.WithContext(ctx)
 
 	resp, err := client.Do(req)
 	if err != nil {
+		cancel()
 		return nil, fmt.Errorf("upstream request failed: %w", err)
 	}
-	defer resp.Body.Close()
-
-	// Read response body
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read upstream response: %w", err)
-	}
 
-	return &ProxyResponse{
-		StatusCode:    resp.StatusCode,
-		Headers:       resp.Header.Clone(),
-		Body:          body,
-		ContentLength: resp.ContentLength,
-	}, nil
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
 }
 
 // copyHeaders copies headers from source to destination, excluding hop-by-hop headers
@@ -381,14 +751,14 @@ func copyHeaders(dst, src http.Header) {
 }
 
 // GenerateCacheKey generates a cache key from the proxy request
-// This is used as the file path in storage
+// This is used as the file path in storage, in the canonical form of
+// store.NormalizeKey, so long query strings end up hashed. Content fetched
+// over plain http is kept under "http/", apart from the https content of the
+// same host and path.
 func GenerateCacheKey(proxyReq *ProxyRequest) string {
-	key := fmt.Sprintf("%s%s", proxyReq.Host, proxyReq.Path)
-	if proxyReq.QueryString != "" {
-		// URL encode the query string to make it filesystem-safe
-		encoded := url.QueryEscape(proxyReq.QueryString)
-		key += "?" + encoded
-	}
-	// Remove leading slash if present to make it a valid file path
-	return strings.TrimPrefix(key, "/")
+	key := store.URLKey(proxyReq.Host, proxyReq.Path, proxyReq.QueryString)
+	if proxyReq.Scheme != "" && proxyReq.Scheme != "https" {
+		key = proxyReq.Scheme + "/" + key
+	}
+	return key
 }
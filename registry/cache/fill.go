@@ -0,0 +1,236 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/aliharirian/TerraPeak/logger"
+	"github.com/aliharirian/TerraPeak/metrics"
+	"github.com/aliharirian/TerraPeak/proxy"
+)
+
+// fill is an upstream fetch of a cache miss that later requests for the same
+// key follow instead of fetching again. The response is spooled to a
+// temporary file as it arrives, so every follower streams it at its own pace.
+// A nil fill is valid and does nothing: requests that are never coalesced
+// (anything but GET) run without one.
+type fill struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	spool   *os.File
+	status  int
+	header  http.Header
+	started bool  // status and header are known
+	written int64 // bytes of the body spooled so far
+	done    bool
+	err     error // why the fetch failed, once done
+	refs    int
+}
+
+// errFillAbandoned fails a fill whose fetch ended without completing it
+var errFillAbandoned = errors.New("upstream fetch ended without a response")
+
+// servedFromStore completes a fill whose fetch found the stored copy current,
+// or unreachable upstream: followers serve the store's copy with status
+type servedFromStore struct {
+	status string
+}
+
+func (servedFromStore) Error() string { return "served from the store" }
+
+// joinFill returns the fill in flight for cacheKey, or registers a new one
+// when there is none, in which case the caller leads the fetch
+func (h *Handler) joinFill(cacheKey string) (f *fill, leader bool) {
+	h.fillsMu.Lock()
+	defer h.fillsMu.Unlock()
+
+	if f, ok := h.fills[cacheKey]; ok {
+		f.mu.Lock()
+		f.refs++
+		f.mu.Unlock()
+		return f, false
+	}
+
+	f = &fill{refs: 1}
+	f.cond = sync.NewCond(&f.mu)
+	if h.fills == nil {
+		h.fills = make(map[string]*fill)
+	}
+	h.fills[cacheKey] = f
+	return f, true
+}
+
+// leaveFill ends the leader's part in a fill: later requests no longer join it
+func (h *Handler) leaveFill(cacheKey string, f *fill) {
+	h.fillsMu.Lock()
+	delete(h.fills, cacheKey)
+	h.fillsMu.Unlock()
+
+	f.complete(errFillAbandoned)
+	f.release()
+}
+
+// start records the upstream status and headers and opens the spool
+func (f *fill) start(status int, header http.Header) {
+	if f == nil {
+		return
+	}
+	spool, err := os.CreateTemp("", "terrapeak-fill-")
+	if err != nil {
+		logger.Warnf("Failed to spool upstream response for coalesced requests: %v", err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.spool, f.status, f.header, f.started = spool, status, header, true
+	if spool == nil {
+		f.done, f.err = true, err
+	}
+	f.cond.Broadcast()
+}
+
+// Write spools a piece of the body for the followers. Spool errors fail the
+// fill for the followers only, never for the leader.
+func (f *fill) Write(p []byte) (int, error) {
+	if f == nil {
+		return len(p), nil
+	}
+
+	f.mu.Lock()
+	spool, done := f.spool, f.done
+	f.mu.Unlock()
+	if done || spool == nil {
+		return len(p), nil
+	}
+
+	_, err := spool.Write(p)
+
+	f.mu.Lock()
+	if err != nil && !f.done {
+		f.done, f.err = true, err
+	} else if err == nil {
+		f.written += int64(len(p))
+	}
+	f.cond.Broadcast()
+	f.mu.Unlock()
+	return len(p), nil
+}
+
+// complete ends the fill: followers finish their response, or break it off
+// when err is set. Only the first call counts.
+func (f *fill) complete(err error) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.done {
+		f.done, f.err = true, err
+		f.cond.Broadcast()
+	}
+}
+
+// wake lets waiting followers notice their client went away
+func (f *fill) wake() {
+	f.mu.Lock()
+	f.cond.Broadcast()
+	f.mu.Unlock()
+}
+
+// release drops a reference, removing the spool with the last one
+func (f *fill) release() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.refs--
+	if f.refs == 0 && f.spool != nil {
+		f.spool.Close()
+		os.Remove(f.spool.Name())
+		f.spool = nil
+	}
+}
+
+// follow serves a request from the fill another request leads, streaming the
+// body as it arrives. The end of the body is held back until the fill
+// completes, so a fetch that fails verification is never served in full.
+func (h *Handler) follow(w http.ResponseWriter, r *http.Request, f *fill, cacheKey string) {
+	defer f.release()
+	metrics.CoalescedRequests.Inc("artifact")
+	logger.Infof("Cache COALESCED: Following the upstream fetch already in flight for %s", cacheKey)
+
+	ctx := r.Context()
+	stop := context.AfterFunc(ctx, f.wake)
+	defer stop()
+
+	f.mu.Lock()
+	for !f.started && !f.done && ctx.Err() == nil {
+		f.cond.Wait()
+	}
+	started, status, header := f.started, f.status, f.header
+	f.mu.Unlock()
+
+	var client *heldBackWriter
+	if started {
+		followHeader := make(http.Header)
+		copyResponseHeaders(followHeader, header)
+		followHeader.Set("X-Cache-Status", "COALESCED")
+		client = &heldBackWriter{w: w, header: followHeader, status: status}
+	} else {
+		client = &heldBackWriter{w: w}
+	}
+
+	var offset int64
+	buf := make([]byte, 32*1024)
+	for {
+		f.mu.Lock()
+		for f.written == offset && !f.done && ctx.Err() == nil {
+			f.cond.Wait()
+		}
+		written, done, err, spool := f.written, f.done, f.err, f.spool
+		f.mu.Unlock()
+
+		if ctx.Err() != nil {
+			logger.Debugf("Client following %s went away", cacheKey)
+			return
+		}
+
+		if written > offset && spool != nil {
+			n := int64(len(buf))
+			if written-offset < n {
+				n = written - offset
+			}
+			if _, err := spool.ReadAt(buf[:n], offset); err != nil && err != io.EOF {
+				client.abort(http.StatusBadGateway, "Upstream server error")
+				return
+			}
+			offset += n
+			client.Write(buf[:n])
+			if client.err != nil {
+				logger.Debugf("Client following %s went away: %v", cacheKey, client.err)
+				return
+			}
+			continue
+		}
+
+		if done {
+			var stored servedFromStore
+			if errors.As(err, &stored) {
+				h.serveCachedContent(w, r, cacheKey, stored.status)
+				return
+			}
+			if err != nil || !started {
+				logger.Warnf("Upstream fetch followed for %s failed: %v", cacheKey, err)
+				if started || !proxy.WriteCircuitOpen(w, err) {
+					client.abort(http.StatusBadGateway, "Upstream server error")
+				}
+				return
+			}
+			client.finish()
+			logger.Infof("Successfully served %s to a coalesced request (%d bytes)", cacheKey, offset)
+			return
+		}
+	}
+}
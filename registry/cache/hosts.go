@@ -0,0 +1,98 @@
+package cache
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// hostPattern is one entry of a host list such as allowed_hosts:
+//
+//	github.com                 the host itself, on the default port
+//	*.githubusercontent.com    any subdomain, but not the domain itself
+//	artifacts.corp.local:8443  the host on port 8443
+//	nexus.corp.local:*         the host on any port
+//	!gist.github.com           deny entry, wins over every allow entry
+type hostPattern struct {
+	deny bool
+	host string // lowercase, "*" or starting with "*." for wildcards
+	port string // "" for the default port, "*" for any port
+}
+
+// parseHostPattern parses one host list entry
+func parseHostPattern(entry string) (hostPattern, error) {
+	var p hostPattern
+	entry = strings.ToLower(strings.TrimSpace(entry))
+	if strings.HasPrefix(entry, "!") {
+		p.deny = true
+		entry = strings.TrimSpace(entry[1:])
+	}
+
+	p.host, p.port = splitHostPort(entry)
+	if p.port != "" && p.port != "*" {
+		if n, err := strconv.Atoi(p.port); err != nil || n <= 0 || n > 65535 {
+			return p, fmt.Errorf("invalid port in host pattern %q", entry)
+		}
+	}
+
+	wildcard := strings.TrimPrefix(p.host, "*.")
+	switch {
+	case p.host == "":
+		return p, fmt.Errorf("empty host pattern")
+	case p.host == "*":
+	case strings.ContainsAny(wildcard, "*/?[]@ "):
+		return p, fmt.Errorf("invalid host pattern %q, wildcards are only allowed as a leading \"*.\"", entry)
+	}
+	return p, nil
+}
+
+// matches reports whether the pattern covers host on port, where an empty
+// port is the default one
+func (p hostPattern) matches(host, port string) bool {
+	if p.port != "*" && p.port != port {
+		return false
+	}
+	switch {
+	case p.host == "*":
+		return true
+	case strings.HasPrefix(p.host, "*."):
+		suffix := p.host[1:]
+		return strings.HasSuffix(host, suffix) && len(host) > len(suffix)
+	default:
+		return p.host == host
+	}
+}
+
+// MatchHost reports whether patterns allow hostport, a host with an optional
+// port as it appears in a URL; defaultPort is the port of the URL's scheme,
+// which counts as no port at all. Deny entries win over allow entries, and
+// malformed entries (rejected by Config.Validate) never match.
+func MatchHost(patterns []string, hostport, defaultPort string) bool {
+	host, port := splitHostPort(strings.ToLower(hostport))
+	if port == defaultPort {
+		port = ""
+	}
+
+	allowed := false
+	for _, entry := range patterns {
+		p, err := parseHostPattern(entry)
+		if err != nil || !p.matches(host, port) {
+			continue
+		}
+		if p.deny {
+			return false
+		}
+		allowed = true
+	}
+	return allowed
+}
+
+// splitHostPort splits hostport into the host, without IPv6 brackets, and the
+// port, which is empty when there is none
+func splitHostPort(hostport string) (host, port string) {
+	if h, p, err := net.SplitHostPort(hostport); err == nil {
+		return h, p
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(hostport, "["), "]"), ""
+}
@@ -0,0 +1,277 @@
+package cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aliharirian/TerraPeak/logger"
+	"github.com/aliharirian/TerraPeak/metrics"
+)
+
+// Mirror serves a host from an ordered list of upstreams, e.g. an internal
+// Artifactory remote repository before the public host itself. Files are
+// cached under the host whichever upstream served them.
+type Mirror struct {
+	Host       string        // host in the request path, e.g. "releases.hashicorp.com"
+	Upstreams  []string      // base URLs tried in order, e.g. "https://artifactory.corp/artifactory/hashicorp"
+	HedgeAfter time.Duration // start the next upstream when one has not answered within this, zero to wait for it to fail
+	Compare    bool          // fetch cached files from the other upstreams in the background and compare their SHA256
+}
+
+// validate rejects mirrors whose upstreams cannot be requested
+func (m Mirror) validate() error {
+	if strings.TrimSpace(m.Host) == "" || strings.Contains(m.Host, "/") {
+		return fmt.Errorf("host %q must be a host name without scheme or path", m.Host)
+	}
+	if len(m.Upstreams) == 0 {
+		return fmt.Errorf("host %q needs at least one upstream", m.Host)
+	}
+	for _, upstream := range m.Upstreams {
+		if _, err := parseMirrorUpstream(upstream); err != nil {
+			return err
+		}
+	}
+	if m.HedgeAfter < 0 {
+		return fmt.Errorf("hedge_after must not be negative")
+	}
+	return nil
+}
+
+// parseMirrorUpstream turns an upstream base URL into the rewrite applying it
+func parseMirrorUpstream(base string) (Rewrite, error) {
+	u, err := url.Parse(base)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" || u.RawQuery != "" || u.User != nil {
+		return Rewrite{}, fmt.Errorf("upstream %q must be an http or https base URL without query or credentials", base)
+	}
+	port := 0
+	if u.Port() != "" {
+		if port, err = strconv.Atoi(u.Port()); err != nil || port <= 0 || port > 65535 {
+			return Rewrite{}, fmt.Errorf("upstream %q has an invalid port", base)
+		}
+	}
+	return Rewrite{Host: u.Hostname(), Scheme: u.Scheme, Port: port, PathPrefix: u.Path}, nil
+}
+
+// requests returns proxyReq pointed at each upstream, in order
+func (m *Mirror) requests(proxyReq *ProxyRequest) []*ProxyRequest {
+	requests := make([]*ProxyRequest, 0, len(m.Upstreams))
+	for _, base := range m.Upstreams {
+		upstream, err := parseMirrorUpstream(base)
+		if err != nil {
+			// Rejected by Config.Validate
+			continue
+		}
+		req := *proxyReq
+		upstream.apply(&req)
+		requests = append(requests, &req)
+	}
+	return requests
+}
+
+// mirrorFor returns the mirror of host, nil when there is none
+func (c *Config) mirrorFor(host string) *Mirror {
+	for i := range c.Mirrors {
+		if strings.EqualFold(c.Mirrors[i].Host, host) {
+			return &c.Mirrors[i]
+		}
+	}
+	return nil
+}
+
+// mirrorResult is the outcome of a request to one upstream of a mirror
+type mirrorResult struct {
+	req    *ProxyRequest
+	resp   *http.Response
+	err    error
+	cancel context.CancelFunc
+}
+
+// failed reports whether the next upstream should be tried instead
+func (r mirrorResult) failed() bool {
+	return r.err != nil || (r.resp.StatusCode/100 != 2 && r.resp.StatusCode != http.StatusNotModified)
+}
+
+// discard releases the response of a result that is not used
+func (r mirrorResult) discard() {
+	if r.resp != nil {
+		r.resp.Body.Close()
+	}
+	r.cancel()
+}
+
+// keep returns the response of a result that is used, which releases the
+// request once its body is closed
+func (r mirrorResult) keep() *http.Response {
+	r.resp.Body = &cancelOnClose{ReadCloser: r.resp.Body, cancel: r.cancel}
+	return r.resp
+}
+
+// openUpstream opens proxyReq upstream, through the upstreams of its mirror
+// when the host has one. It returns the request that was answered.
+func (h *Handler) openUpstream(proxyReq *ProxyRequest) (*http.Response, *ProxyRequest, error) {
+	mirror := h.config.mirrorFor(proxyReq.Host)
+	if mirror == nil {
+		resp, err := OpenUpstreamRequest(proxyReq, h.httpClient, h.config.SkipSSLVerify)
+		return resp, proxyReq, err
+	}
+
+	requests := mirror.requests(proxyReq)
+	if proxyReq.Method != http.MethodGet && proxyReq.Method != http.MethodHead {
+		// Only requests that can be repeated are failed over
+		requests = requests[:1]
+	}
+	return h.openMirror(mirror, requests)
+}
+
+// openMirror tries requests in order until one is answered with success. A
+// failed upstream is followed by the next one at once; with HedgeAfter, the
+// next one is also started when an upstream takes longer than that to answer,
+// and the first success wins. When every upstream fails, the last failure is
+// returned.
+func (h *Handler) openMirror(mirror *Mirror, requests []*ProxyRequest) (*http.Response, *ProxyRequest, error) {
+	results := make(chan mirrorResult, len(requests))
+	cancels := make([]context.CancelFunc, 0, len(requests))
+	next, pending := 0, 0
+	start := func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancels = append(cancels, cancel)
+		req := requests[next]
+		next++
+		pending++
+		go func() {
+			resp, err := openUpstreamRequest(ctx, req, h.httpClient, h.config.SkipSSLVerify)
+			results <- mirrorResult{req: req, resp: resp, err: err, cancel: cancel}
+		}()
+	}
+
+	var hedge <-chan time.Time
+	var timer *time.Timer
+	if mirror.HedgeAfter > 0 {
+		timer = time.NewTimer(mirror.HedgeAfter)
+		defer timer.Stop()
+		hedge = timer.C
+	}
+
+	start()
+	var last *mirrorResult
+	for pending > 0 {
+		select {
+		case result := <-results:
+			pending--
+			if !result.failed() {
+				if last != nil {
+					last.discard()
+				}
+				// Hedged requests still in flight lost and are abandoned
+				for i, cancel := range cancels {
+					if requests[i] != result.req {
+						cancel()
+					}
+				}
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						(<-results).discard()
+					}
+				}(pending)
+				return result.keep(), result.req, nil
+			}
+
+			logger.Warnf("Mirror upstream %s of %s failed: %s", result.req.BuildUpstreamURL(), mirror.Host, describeFailure(result))
+			switch {
+			case last == nil:
+				last = &result
+			case result.resp != nil || last.resp == nil:
+				last.discard()
+				last = &result
+			default:
+				// Keep the answer of an earlier upstream over a connection error
+				result.discard()
+			}
+			if next < len(requests) {
+				start()
+				if timer != nil {
+					timer.Reset(mirror.HedgeAfter)
+				}
+			}
+
+		case <-hedge:
+			if next < len(requests) {
+				logger.Infof("Mirror upstream %s of %s is slow, also asking %s", requests[next-1].BuildUpstreamURL(), mirror.Host, requests[next].BuildUpstreamURL())
+				start()
+				timer.Reset(mirror.HedgeAfter)
+			}
+		}
+	}
+
+	if last.err != nil {
+		last.cancel()
+		return nil, last.req, last.err
+	}
+	return last.keep(), last.req, nil
+}
+
+// describeFailure returns why an upstream of a mirror failed
+func describeFailure(result mirrorResult) string {
+	if result.err != nil {
+		return result.err.Error()
+	}
+	return result.resp.Status
+}
+
+// compareMirrors fetches a file just cached from served, one upstream of the
+// mirror of proxyReq's host, from the other upstreams in the background and
+// reports those serving other bytes than sum
+func (h *Handler) compareMirrors(proxyReq, served *ProxyRequest, sum string) {
+	mirror := h.config.mirrorFor(proxyReq.Host)
+	if mirror == nil || !mirror.Compare || len(mirror.Upstreams) < 2 {
+		return
+	}
+
+	get := *proxyReq
+	get.Method, get.Headers, get.Body = http.MethodGet, nil, nil
+	servedURL := served.BuildUpstreamURL()
+	go func() {
+		for _, req := range mirror.requests(&get) {
+			upstreamURL := req.BuildUpstreamURL()
+			if upstreamURL == servedURL {
+				continue
+			}
+			other, err := h.mirrorSum(req)
+			if err != nil {
+				logger.Warnf("Could not compare %s with %s: %v", upstreamURL, servedURL, err)
+				continue
+			}
+			if other != sum {
+				metrics.MirrorMismatches.Inc(mirror.Host)
+				logger.Errorf("Mirror MISMATCH: %s has SHA256 %s but %s served %s", upstreamURL, other, servedURL, sum)
+				continue
+			}
+			logger.Debugf("Mirror %s serves the same bytes as %s", upstreamURL, servedURL)
+		}
+	}()
+}
+
+// mirrorSum returns the SHA256 of the body upstream answers req with
+func (h *Handler) mirrorSum(req *ProxyRequest) (string, error) {
+	resp, err := OpenUpstreamRequest(req, h.httpClient, h.config.SkipSSLVerify)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("upstream answered %s", resp.Status)
+	}
+	sum := sha256.New()
+	if _, err := io.Copy(sum, resp.Body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
@@ -0,0 +1,66 @@
+package cache
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/aliharirian/TerraPeak/logger"
+)
+
+// defaultMaxRedirects is the number of redirects followed per request unless
+// configured otherwise
+const defaultMaxRedirects = 5
+
+// checkRedirect is the CheckRedirect of the handler's client. Upstream may
+// only redirect to allowed, rewritten or redirect hosts, never from https to
+// http, and at most MaxRedirects times. The final response is cached under
+// the key of the original request, so short-lived signed redirect URLs never
+// become cache keys.
+func (c *Config) checkRedirect(req *http.Request, via []*http.Request) error {
+	if c.MaxRedirects < 0 {
+		return http.ErrUseLastResponse
+	}
+	limit := c.MaxRedirects
+	if limit == 0 {
+		limit = defaultMaxRedirects
+	}
+	if len(via) > limit {
+		return fmt.Errorf("stopped after %d redirects", limit)
+	}
+
+	previous := via[len(via)-1].URL
+	if previous.Scheme == "https" && req.URL.Scheme != "https" {
+		return fmt.Errorf("refusing redirect from https to %s://%s", req.URL.Scheme, req.URL.Host)
+	}
+	if !c.isRedirectAllowed(req.URL) {
+		return fmt.Errorf("redirect to %s is not allowed", req.URL.Host)
+	}
+
+	// The query of signed URLs is a credential, so only the host is logged
+	logger.Debugf("Following redirect %d from %s to %s%s", len(via), previous.Host, req.URL.Host, req.URL.Path)
+	return nil
+}
+
+// isRedirectAllowed reports whether upstream may redirect to target. The
+// allowed, redirect, rewrite and mirror upstream hosts are matched as one list, so a deny
+// entry in any of them wins.
+func (c *Config) isRedirectAllowed(target *url.URL) bool {
+	patterns := append(append([]string{}, c.AllowedHosts...), c.RedirectHosts...)
+	for _, rewrite := range c.Rewrites {
+		patterns = append(patterns, rewrite.upstreamHost())
+	}
+	for _, mirror := range c.Mirrors {
+		for _, base := range mirror.Upstreams {
+			if upstream, err := parseMirrorUpstream(base); err == nil {
+				patterns = append(patterns, upstream.upstreamHost())
+			}
+		}
+	}
+
+	defaultPort := "443"
+	if target.Scheme == "http" {
+		defaultPort = "80"
+	}
+	return MatchHost(patterns, target.Host, defaultPort)
+}
@@ -0,0 +1,66 @@
+package cache
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Rewrite routes requests under a short path prefix to an upstream, e.g.
+// /gh-releases/... to github.com or /internal-artifacts/... to a plain HTTP
+// mirror on another port
+type Rewrite struct {
+	Prefix     string // first path segment, e.g. "gh-releases"
+	Host       string // upstream host
+	Scheme     string // "http" or "https" (default)
+	Port       int    // upstream port, zero for the scheme default
+	PathPrefix string // prepended to the upstream path, e.g. "/artifactory/remote"
+}
+
+// validate rejects rewrites that cannot be routed
+func (rw Rewrite) validate() error {
+	prefix := strings.Trim(rw.Prefix, "/")
+	if prefix == "" || strings.Contains(prefix, "/") || prefix == "." || prefix == ".." {
+		return fmt.Errorf("prefix %q must be a single path segment", rw.Prefix)
+	}
+	if strings.TrimSpace(rw.Host) == "" || strings.ContainsAny(rw.Host, "/:") {
+		return fmt.Errorf("host %q must be a host name without scheme, port or path", rw.Host)
+	}
+	if rw.Scheme != "" && rw.Scheme != "http" && rw.Scheme != "https" {
+		return fmt.Errorf("scheme %q must be http or https", rw.Scheme)
+	}
+	if rw.Port < 0 || rw.Port > 65535 {
+		return fmt.Errorf("port %d is out of range", rw.Port)
+	}
+	return nil
+}
+
+// upstreamHost returns the host, with the port unless it is the scheme default
+func (rw Rewrite) upstreamHost() string {
+	if rw.Port == 0 || (rw.Port == 80 && rw.Scheme == "http") || (rw.Port == 443 && rw.Scheme != "http") {
+		return rw.Host
+	}
+	return net.JoinHostPort(rw.Host, strconv.Itoa(rw.Port))
+}
+
+// apply points proxyReq, parsed with the prefix in place of the host, at the
+// upstream of the rewrite
+func (rw Rewrite) apply(proxyReq *ProxyRequest) {
+	proxyReq.Host = rw.upstreamHost()
+	proxyReq.Scheme = rw.Scheme
+	if pathPrefix := strings.Trim(rw.PathPrefix, "/"); pathPrefix != "" {
+		proxyReq.Path = "/" + pathPrefix + proxyReq.Path
+	}
+}
+
+// rewriteFor returns the rewrite whose prefix is the first segment of a
+// request path, nil when there is none
+func (c *Config) rewriteFor(segment string) *Rewrite {
+	for i := range c.Rewrites {
+		if strings.Trim(c.Rewrites[i].Prefix, "/") == segment {
+			return &c.Rewrites[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/aliharirian/TerraPeak/logger"
+)
+
+// errStoreDone stops writes into the store once it no longer reads them
+var errStoreDone = errors.New("store stopped reading")
+
+// heldBackWriter forwards a response body to the client one write late, so
+// the response can still be rejected once the complete body has been checked.
+// Client errors are recorded rather than returned: a client going away must
+// not stop the body from being cached.
+type heldBackWriter struct {
+	w       http.ResponseWriter
+	header  http.Header // sent with the first forwarded write
+	status  int
+	pending []byte
+	started bool
+	err     error
+}
+
+func (c *heldBackWriter) Write(p []byte) (int, error) {
+	c.flush()
+	c.pending = append(c.pending[:0], p...)
+	return len(p), nil
+}
+
+// flush forwards the pending write
+func (c *heldBackWriter) flush() {
+	if len(c.pending) == 0 {
+		return
+	}
+	c.start()
+	if c.err == nil {
+		_, c.err = c.w.Write(c.pending)
+	}
+	c.pending = c.pending[:0]
+}
+
+func (c *heldBackWriter) start() {
+	if c.started {
+		return
+	}
+	c.started = true
+	for key, values := range c.header {
+		c.w.Header()[key] = values
+	}
+	c.w.WriteHeader(c.status)
+}
+
+// finish forwards the end of the body
+func (c *heldBackWriter) finish() {
+	c.flush()
+	c.start()
+}
+
+// abort answers with an error when nothing has been sent yet, and otherwise
+// breaks the connection so the client cannot mistake the body for complete
+func (c *heldBackWriter) abort(status int, message string) {
+	if !c.started {
+		http.Error(c.w, message, status)
+		return
+	}
+	logger.Warnf("Aborting response after part of the body was sent: %s", message)
+	panic(http.ErrAbortHandler)
+}
+
+// storeWriter feeds the store, recording its error instead of returning it so
+// the client keeps receiving the body when caching fails
+type storeWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (s *storeWriter) Write(p []byte) (int, error) {
+	if s.err == nil {
+		_, s.err = s.w.Write(p)
+	}
+	return len(p), nil
+}
+
+// cancelOnClose releases the request context along with the response body
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
@@ -0,0 +1,156 @@
+package cache
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aliharirian/TerraPeak/store"
+)
+
+// TTLRule sets how long the stored objects of matching requests are served
+// before they are revalidated with upstream
+type TTLRule struct {
+	Host string        // glob, empty matches any host
+	Path string        // glob on the upstream path, empty matches any path
+	TTL  time.Duration // zero keeps matching objects forever
+}
+
+// matches reports whether the rule applies to a request for host and urlPath
+func (r TTLRule) matches(host, urlPath string) bool {
+	if r.Host != "" {
+		if ok, _ := path.Match(strings.ToLower(r.Host), host); !ok {
+			return false
+		}
+	}
+	if r.Path != "" {
+		if ok, _ := path.Match(r.Path, urlPath); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// validate rejects malformed patterns and negative lifetimes
+func (r TTLRule) validate() error {
+	for _, pattern := range []string{r.Host, r.Path} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q", pattern)
+		}
+	}
+	if r.TTL < 0 {
+		return fmt.Errorf("ttl must not be negative")
+	}
+	return nil
+}
+
+// lifetime returns how long an object fetched for proxyReq stays fresh after
+// it was fetched. expires is false for objects that are kept forever.
+func (c *Config) lifetime(proxyReq *ProxyRequest, record *store.Metadata) (ttl time.Duration, expires bool) {
+	host := normalizeHost(proxyReq.Host)
+	for _, rule := range c.TTLRules {
+		if rule.matches(host, proxyReq.Path) {
+			return rule.TTL, rule.TTL > 0
+		}
+	}
+
+	if c.HonorCacheControl && record != nil {
+		return upstreamLifetime(record)
+	}
+	return 0, false
+}
+
+// isFresh reports whether the stored object can be served without asking
+// upstream. Expiring objects without a metadata record are never fresh.
+func (c *Config) isFresh(proxyReq *ProxyRequest, record *store.Metadata) bool {
+	ttl, expires := c.lifetime(proxyReq, record)
+	if !expires {
+		return true
+	}
+	return record != nil && time.Since(record.Timestamp) < ttl
+}
+
+// forbidsStore reports whether upstream asked for a response not to be stored
+func (c *Config) forbidsStore(header http.Header) bool {
+	if !c.HonorCacheControl {
+		return false
+	}
+	_, noStore := cacheControl(header)["no-store"]
+	return noStore
+}
+
+// upstreamLifetime reads the lifetime upstream gave an object from its
+// Cache-Control and Expires headers
+func upstreamLifetime(record *store.Metadata) (time.Duration, bool) {
+	directives := cacheControl(record.Header)
+	if _, ok := directives["no-cache"]; ok {
+		return 0, true
+	}
+	for _, name := range []string{"s-maxage", "max-age"} {
+		if value, ok := directives[name]; ok {
+			if seconds, err := strconv.ParseInt(value, 10, 64); err == nil && seconds >= 0 {
+				return time.Duration(seconds) * time.Second, true
+			}
+		}
+	}
+
+	if expires := record.Header.Get("Expires"); expires != "" {
+		at, err := http.ParseTime(expires)
+		if err != nil {
+			// An invalid Expires means the response is already stale
+			return 0, true
+		}
+		return at.Sub(record.Timestamp), true
+	}
+	return 0, false
+}
+
+// cacheControl parses the Cache-Control directives of header, by lowercase name
+func cacheControl(header http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name != "" {
+				directives[strings.ToLower(name)] = strings.Trim(arg, `"`)
+			}
+		}
+	}
+	return directives
+}
+
+// partialHeaders are the client headers that can make upstream answer with a
+// part of the object or none of it
+var partialHeaders = []string{"Range", "If-Range", "If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"}
+
+// wholeObjectRequest returns a copy of proxyReq without the client's range
+// and conditional headers, so upstream answers with the whole object, which
+// can be stored and served to every request following the fetch
+func wholeObjectRequest(proxyReq *ProxyRequest) *ProxyRequest {
+	whole := *proxyReq
+	whole.Headers = proxyReq.Headers.Clone()
+	if whole.Headers == nil {
+		whole.Headers = make(http.Header)
+	}
+	for _, name := range partialHeaders {
+		whole.Headers.Del(name)
+	}
+	return &whole
+}
+
+// revalidationRequest turns proxyReq into a conditional request for the
+// stored object described by record. The client's own range and conditional
+// headers are dropped, so a 304 always refers to the stored copy.
+func revalidationRequest(proxyReq *ProxyRequest, record *store.Metadata) *ProxyRequest {
+	conditional := wholeObjectRequest(proxyReq)
+	if etag := record.Header.Get("ETag"); etag != "" {
+		conditional.Headers.Set("If-None-Match", etag)
+	}
+	if lastModified := record.Header.Get("Last-Modified"); lastModified != "" {
+		conditional.Headers.Set("If-Modified-Since", lastModified)
+	}
+	return conditional
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/aliharirian/TerraPeak/bundle"
+	"github.com/aliharirian/TerraPeak/config"
+	"github.com/aliharirian/TerraPeak/logger"
+	"github.com/aliharirian/TerraPeak/store"
+)
+
+// runExport implements "terrapeak export": it writes the selected part of the
+// configured store to a tar.zst bundle and returns the process exit code
+func runExport(args []string) int {
+	var (
+		configPath string
+		output     string
+		sel        bundle.Selection
+	)
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	flags.StringVar(&configPath, "c", "", "Path to the configuration file")
+	flags.StringVar(&configPath, "config", "", "Path to the configuration file")
+	flags.StringVar(&output, "o", "", "Bundle file to write, e.g. terrapeak.tar.zst")
+	flags.Var((*stringList)(&sel.Providers), "provider", "Provider to export as namespace/type (repeatable)")
+	flags.Var((*stringList)(&sel.Modules), "module", "Module to export as namespace/name/provider (repeatable)")
+	flags.Var((*stringList)(&sel.Hosts), "host", "Upstream host whose cached files to export (repeatable)")
+	flags.Var((*stringList)(&sel.Prefixes), "prefix", "Raw store key prefix to export (repeatable)")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: terrapeak export [-c cfg.yml] -o bundle.tar.zst [-provider ns/type]... [-module ns/name/provider]... [-host host]... [-prefix prefix]...")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if output == "" {
+		flags.Usage()
+		log.Fatal().Msg("no output file: pass -o")
+	}
+	if len(sel.Providers)+len(sel.Modules)+len(sel.Hosts)+len(sel.Prefixes) == 0 {
+		flags.Usage()
+		log.Fatal().Msg("nothing selected: pass -provider, -module, -host and/or -prefix")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	_, backend := openBackend(configPath)
+	keys, skipped, err := sel.Keys(ctx, backend)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to select keys")
+	}
+	for _, reason := range skipped {
+		log.Warn().Msgf("skipping module archive of %s", reason)
+	}
+	if len(keys) == 0 {
+		log.Error().Msg("the selection matches nothing in the store")
+		return 1
+	}
+
+	file, err := os.Create(output)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to create bundle")
+	}
+	manifest, err := bundle.Export(ctx, backend, keys, file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(output)
+		log.Error().Err(err).Msg("export failed")
+		return 1
+	}
+
+	fmt.Printf("Exported %d objects (%s) to %s\n", len(manifest.Entries), totalSize(manifest), output)
+	return 0
+}
+
+// runImport implements "terrapeak import": it loads a bundle into the
+// configured store and returns the process exit code
+func runImport(args []string) int {
+	var configPath, input string
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	flags.StringVar(&configPath, "c", "", "Path to the configuration file")
+	flags.StringVar(&configPath, "config", "", "Path to the configuration file")
+	flags.StringVar(&input, "i", "", "Bundle file to import")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: terrapeak import [-c cfg.yml] -i bundle.tar.zst")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if input == "" {
+		flags.Usage()
+		log.Fatal().Msg("no bundle file: pass -i")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	_, backend := openBackend(configPath)
+	file, err := os.Open(input)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to open bundle")
+	}
+	defer file.Close()
+
+	manifest, err := bundle.Import(ctx, backend, file)
+	if err != nil {
+		log.Error().Err(err).Msg("import failed")
+		return 1
+	}
+
+	fmt.Printf("Imported %d objects (%s) from %s\n", len(manifest.Entries), totalSize(manifest), input)
+	return 0
+}
+
+// openBackend loads the configuration and opens the configured storage
+func openBackend(configPath string) (*config.Config, store.Storage) {
+	cfg, err := config.Configure(configPath, log.Logger)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to load configuration")
+	}
+	logger.Init("TerraPeak", nil, cfg.Log.Level, "15:04:05.0000T2006-01-02")
+
+	st, err := store.New(cfg)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to initialize storage")
+	}
+	return cfg, st.Backend()
+}
+
+func totalSize(manifest *bundle.Manifest) string {
+	var total int64
+	for _, entry := range manifest.Entries {
+		total += entry.Size
+	}
+	return fmt.Sprintf("%d bytes", total)
+}
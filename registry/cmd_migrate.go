@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/aliharirian/TerraPeak/api"
+	"github.com/aliharirian/TerraPeak/store"
+)
+
+// runMigrateKeys implements "terrapeak migrate-keys": it moves objects saved
+// before storage keys were normalized, and registry responses saved before
+// registries had their own namespace, to their canonical keys, writes the
+// metadata records objects saved before records were kept lack, and returns
+// the process exit code
+func runMigrateKeys(args []string) int {
+	var (
+		configPath string
+		dryRun     bool
+	)
+	flags := flag.NewFlagSet("migrate-keys", flag.ExitOnError)
+	flags.StringVar(&configPath, "c", "", "Path to the configuration file")
+	flags.StringVar(&configPath, "config", "", "Path to the configuration file")
+	flags.BoolVar(&dryRun, "dry-run", false, "Only list the objects that would be moved or given a metadata record")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: terrapeak migrate-keys [-c cfg.yml] [-dry-run]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	cfg, backend := openBackend(configPath)
+	registryName, err := api.DefaultRegistryName(cfg)
+	if err != nil {
+		log.Error().Err(err).Msg("invalid terraform.registry_url")
+		return 1
+	}
+	migration, err := store.MigrateKeys(ctx, backend, registryName, dryRun)
+	if migration != nil {
+		for _, move := range migration.Moves {
+			fmt.Printf("%s -> %s\n", move.From, move.To)
+		}
+		for _, key := range migration.Backfilled {
+			fmt.Printf("%s: metadata record\n", key)
+		}
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("migration failed")
+		return 1
+	}
+
+	if dryRun {
+		fmt.Printf("%d objects would be moved, %d would get a metadata record\n", len(migration.Moves), len(migration.Backfilled))
+	} else {
+		fmt.Printf("Moved %d objects, wrote %d metadata records\n", len(migration.Moves), len(migration.Backfilled))
+	}
+	return 0
+}
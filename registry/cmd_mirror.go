@@ -0,0 +1,99 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+
+	"github.com/aliharirian/TerraPeak/api"
+	"github.com/aliharirian/TerraPeak/config"
+	"github.com/aliharirian/TerraPeak/logger"
+	"github.com/aliharirian/TerraPeak/mirror"
+)
+
+// stringList is a repeatable, comma separated flag
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// runMirror implements "terrapeak mirror": it downloads the selected providers
+// into the configured store and returns the process exit code
+func runMirror(args []string) int {
+	var (
+		configPath   string
+		providerList string
+		lockFiles    stringList
+		platforms    stringList
+	)
+	flags := flag.NewFlagSet("mirror", flag.ExitOnError)
+	flags.StringVar(&configPath, "c", "", "Path to the configuration file")
+	flags.StringVar(&configPath, "config", "", "Path to the configuration file")
+	flags.StringVar(&providerList, "providers", "", "YAML file listing providers and version constraints")
+	flags.Var(&lockFiles, "lock", "A .terraform.lock.hcl file to mirror (repeatable)")
+	flags.Var(&platforms, "platform", "Platform to mirror as os_arch, e.g. linux_amd64 (repeatable or comma separated)")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: terrapeak mirror [-c cfg.yml] [-providers providers.yml] [-lock .terraform.lock.hcl]... -platform linux_amd64[,...]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	cfg, err := config.Configure(configPath, log.Logger)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to load configuration")
+	}
+	logger.Init("TerraPeak", nil, cfg.Log.Level, "15:04:05.0000T2006-01-02")
+
+	var providers []mirror.Provider
+	if providerList != "" {
+		listed, listPlatforms, err := mirror.LoadProviderList(providerList)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to load provider list")
+		}
+		providers = append(providers, listed...)
+		if len(platforms) == 0 {
+			platforms = listPlatforms
+		}
+	}
+	for _, path := range lockFiles {
+		locked, err := mirror.LoadLockFile(path)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to load lock file")
+		}
+		providers = append(providers, locked...)
+	}
+
+	if len(providers) == 0 {
+		flags.Usage()
+		log.Fatal().Msg("no providers to mirror: pass -providers and/or -lock")
+	}
+	if len(platforms) == 0 {
+		flags.Usage()
+		log.Fatal().Msg("no platforms selected: pass -platform")
+	}
+
+	svc, err := api.New(cfg)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to initialize API service")
+	}
+	router := chi.NewRouter()
+	svc.RegisterRoutes(router)
+
+	report := mirror.New(router, svc, cfg.Server.Domain, os.Stdout).Run(providers, platforms)
+	if report.Failed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,58 @@
+package coalesce
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Group merges concurrent calls for the same key into a single call whose
+// result every caller receives
+type Group[T any] struct {
+	mu    sync.Mutex
+	calls map[string]*call[T]
+}
+
+type call[T any] struct {
+	wg  sync.WaitGroup
+	val T
+	err error
+}
+
+// Do runs fn unless a call for key is already in flight, in which case it
+// waits for that call instead. shared reports whether the result came from a
+// call started by another caller. When fn panics, the callers waiting for it
+// get an error and the panic goes on in the caller that ran fn.
+func (g *Group[T]) Do(key string, fn func() (T, error)) (val T, shared bool, err error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*call[T])
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.val, true, c.err
+	}
+	c := &call[T]{}
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	defer func() {
+		if r := recover(); r != nil {
+			c.err = fmt.Errorf("coalesced call for %s panicked: %v", key, r)
+			g.finish(key, c)
+			panic(r)
+		}
+		g.finish(key, c)
+	}()
+	c.val, c.err = fn()
+	return c.val, false, c.err
+}
+
+// finish removes c, the call for key, and releases the callers waiting for it
+func (g *Group[T]) finish(key string, c *call[T]) {
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	c.wg.Done()
+}
@@ -0,0 +1,105 @@
+package coalesce
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGroupDo(t *testing.T) {
+	var g Group[string]
+	var calls, shared atomic.Int32
+	release := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			val, wasShared, err := g.Do("key", func() (string, error) {
+				calls.Add(1)
+				<-release
+				return "result", nil
+			})
+			if err != nil || val != "result" {
+				t.Errorf("Expected result, got %q (%v)", val, err)
+			}
+			if wasShared {
+				shared.Add(1)
+			}
+		}()
+	}
+
+	// Give every caller the chance to join before the call completes
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls.Load() != 1 {
+		t.Errorf("Expected 1 call, got %d", calls.Load())
+	}
+	if shared.Load() != 9 {
+		t.Errorf("Expected 9 shared results, got %d", shared.Load())
+	}
+}
+
+func TestGroupDoSequential(t *testing.T) {
+	var g Group[int]
+	failure := errors.New("failed")
+
+	if _, _, err := g.Do("key", func() (int, error) { return 0, failure }); err != failure {
+		t.Errorf("Expected the call's error, got %v", err)
+	}
+
+	// Once a call completed, the next one runs again
+	val, shared, err := g.Do("key", func() (int, error) { return 2, nil })
+	if err != nil || val != 2 || shared {
+		t.Errorf("Expected a fresh call returning 2, got %d (shared %v, %v)", val, shared, err)
+	}
+}
+
+func TestGroupDoPanic(t *testing.T) {
+	var g Group[*int]
+	started, release := make(chan struct{}), make(chan struct{})
+
+	leader := make(chan any, 1)
+	go func() {
+		defer func() { leader <- recover() }()
+		g.Do("key", func() (*int, error) {
+			close(started)
+			<-release
+			panic("boom")
+		})
+	}()
+	<-started
+
+	waiter := make(chan error, 1)
+	go func() {
+		val, shared, err := g.Do("key", func() (*int, error) {
+			t.Error("Expected the waiter to join the call in flight")
+			return nil, nil
+		})
+		if val != nil || !shared {
+			t.Errorf("Expected a shared nil value, got %v (shared %v)", val, shared)
+		}
+		waiter <- err
+	}()
+
+	// Give the waiter the chance to join before the call panics
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	if r := <-leader; r != "boom" {
+		t.Errorf("Expected the panic to go on in the leader, got %v", r)
+	}
+	if err := <-waiter; err == nil {
+		t.Error("Expected the waiter to get an error")
+	}
+
+	// The panicked call no longer blocks the key
+	if _, shared, err := g.Do("key", func() (*int, error) { return new(int), nil }); err != nil || shared {
+		t.Errorf("Expected a fresh call, got shared %v, %v", shared, err)
+	}
+}
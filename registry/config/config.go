@@ -2,8 +2,12 @@ package config
 
 import (
 	"errors"
+	"fmt"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/rs/zerolog"
 	"gopkg.in/yaml.v3"
@@ -23,7 +27,9 @@ type Config struct {
 	} `yaml:"log"`
 
 	Terraform struct {
-		RegistryUrl string `yaml:"registry_url"`
+		RegistryUrl string            `yaml:"registry_url"`
+		Registries  []RegistryConfig  `yaml:"registries"`
+		CacheTTL    RegistryTTLConfig `yaml:"cache_ttl"`
 	} `yaml:"terraform"`
 
 	Storage struct {
@@ -38,12 +44,18 @@ type Config struct {
 		} `yaml:"s3"`
 
 		File struct {
-			Path string `yaml:"path"`
+			Path         string   `yaml:"path"`
+			MaxSize      ByteSize `yaml:"max_size"`      // evict least recently used files above this size, 0 = unlimited
+			LowWatermark ByteSize `yaml:"low_watermark"` // eviction stops below this size, defaults to 90% of max_size
+			Pinned       []string `yaml:"pinned"`        // keys or key prefixes that are never evicted
 		} `yaml:"file"`
 	}
 
 	ServeIf bool `yaml:"serve_if"`
 
+	// Offline serves exclusively from the store and never contacts upstream
+	Offline bool `yaml:"offline"`
+
 	Proxy struct {
 		Enabled  bool   `yaml:"enabled"`
 		Type     string `yaml:"type"` // "http", "socks5", "socks4"
@@ -53,16 +65,145 @@ type Config struct {
 		Password string `yaml:"password"`
 	} `yaml:"proxy"`
 
+	// Upstream makes requests to upstream hosts ride out short outages
+	Upstream UpstreamConfig `yaml:"upstream"`
+
+	Policy PolicyConfig `yaml:"policy"`
+
+	// Admin protects the /admin cache inspection and purge API, which is
+	// disabled without a token
+	Admin struct {
+		Token string `yaml:"token"` // expected as "Authorization: Bearer <token>"
+	} `yaml:"admin"`
+
 	Cache struct {
-		AllowedHosts  []string `yaml:"allowed_hosts"`
-		SkipSSLVerify bool     `yaml:"skip_ssl_verify"`
-		Rewrites      []struct {
-			Prefix string `yaml:"prefix"`
-			Host   string `yaml:"host"`
-		} `yaml:"rewrites"`
+		AllowedHosts      []string       `yaml:"allowed_hosts"`
+		SkipSSLVerify     bool           `yaml:"skip_ssl_verify"`
+		TTL               []CacheTTLRule `yaml:"ttl"`
+		HonorCacheControl bool           `yaml:"honor_cache_control"`
+		Rewrites          []CacheRewrite `yaml:"rewrites"`
+		Mirrors           []CacheMirror  `yaml:"mirrors"`
+		Redirects         struct {
+			AllowedHosts []string `yaml:"allowed_hosts"` // redirect targets besides allowed_hosts and rewrite hosts
+			MaxHops      int      `yaml:"max_hops"`      // 0 = 5 hops, -1 = pass redirects to the client
+		} `yaml:"redirects"`
 	} `yaml:"cache"`
 }
 
+// RegistryConfig describes an additional upstream registry. Requests reach it
+// either through a path prefix (/{prefix}/v1/providers/...) or a virtual host.
+type RegistryConfig struct {
+	Name   string `yaml:"name"`   // cache key namespace, defaults to the URL host
+	URL    string `yaml:"url"`    // upstream registry base URL
+	Prefix string `yaml:"prefix"` // path prefix, e.g. "registry.opentofu.org"
+	Host   string `yaml:"host"`   // virtual host, e.g. "tofu.tp.example.com"
+}
+
+// RegistryTTLConfig sets how long each kind of cached registry response is
+// served before it is refreshed from upstream. Zero keeps an entry forever.
+type RegistryTTLConfig struct {
+	Versions       time.Duration `yaml:"versions"`        // provider version lists
+	Download       time.Duration `yaml:"download"`        // provider download details
+	ModuleVersions time.Duration `yaml:"module_versions"` // module version lists
+	ModuleDownload time.Duration `yaml:"module_download"` // module download locations
+	NotFound       time.Duration `yaml:"not_found"`       // upstream 404 answers, kept in memory only
+}
+
+// UpstreamConfig sets how upstream GET and HEAD requests are retried and when
+// a host's circuit breaker stops sending it requests
+type UpstreamConfig struct {
+	Retries         int           `yaml:"retries"`          // retries after the first attempt, 0 = 2, -1 = none
+	RetryBackoff    time.Duration `yaml:"retry_backoff"`    // first delay, doubled per retry with jitter, 0 = 200ms
+	MaxBackoff      time.Duration `yaml:"max_backoff"`      // longest delay, also for Retry-After, 0 = 10s
+	BreakerFailures int           `yaml:"breaker_failures"` // consecutive failures opening a host's circuit, 0 = 5, -1 = never
+	BreakerCooldown time.Duration `yaml:"breaker_cooldown"` // how long an open circuit rejects requests, 0 = 30s
+}
+
+// CacheTTLRule sets how long cached files of matching requests are served
+// before they are revalidated with upstream. The first matching rule wins.
+type CacheTTLRule struct {
+	Host string        `yaml:"host"` // glob, empty matches any host
+	Path string        `yaml:"path"` // glob on the upstream path, empty matches any path
+	TTL  time.Duration `yaml:"ttl"`  // zero keeps matching files forever
+}
+
+// CacheRewrite routes cached requests under /{prefix}/ to an upstream other
+// than the host named in the path, e.g. a plain HTTP mirror on its own port
+type CacheRewrite struct {
+	Prefix     string `yaml:"prefix"`      // single path segment, e.g. "gh-releases"
+	Host       string `yaml:"host"`        // upstream host, e.g. "github.com"
+	Scheme     string `yaml:"scheme"`      // "http" or "https" (default)
+	Port       int    `yaml:"port"`        // defaults to the scheme's port
+	PathPrefix string `yaml:"path_prefix"` // prepended to the upstream path
+}
+
+// CacheMirror serves a cached host from an ordered list of upstream base
+// URLs, e.g. an internal Artifactory remote before the public host
+type CacheMirror struct {
+	Host             string        `yaml:"host"`              // host in the request path, e.g. "releases.hashicorp.com"
+	Upstreams        []string      `yaml:"upstreams"`         // base URLs tried in order
+	HedgeAfter       time.Duration `yaml:"hedge_after"`       // also ask the next upstream after this long, 0 = only on failure
+	CompareChecksums bool          `yaml:"compare_checksums"` // compare cached files with the other upstreams in the background
+}
+
+// ByteSize is a size in bytes, written in YAML as a plain number or with a
+// unit: KB, MB, GB and TB are powers of 1000, KiB, MiB, GiB and TiB of 1024
+type ByteSize int64
+
+// byteUnits maps the accepted unit suffixes to their size, longest first
+var byteUnits = []struct {
+	suffix string
+	size   float64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"B", 1},
+}
+
+// ParseByteSize parses a size such as "512MiB", "20GB" or "1048576"
+func ParseByteSize(value string) (ByteSize, error) {
+	value = strings.TrimSpace(value)
+	number, unit := value, 1.0
+	for _, u := range byteUnits {
+		if strings.HasSuffix(strings.ToUpper(value), strings.ToUpper(u.suffix)) {
+			number, unit = strings.TrimSpace(value[:len(value)-len(u.suffix)]), u.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return ByteSize(n * unit), nil
+}
+
+// UnmarshalYAML accepts plain numbers and sizes with a unit
+func (b *ByteSize) UnmarshalYAML(node *yaml.Node) error {
+	size, err := ParseByteSize(node.Value)
+	if err != nil {
+		return err
+	}
+	*b = size
+	return nil
+}
+
+// PolicyConfig decides which providers and versions may be served. Rules are
+// evaluated in order and the first match wins; default applies otherwise.
+type PolicyConfig struct {
+	Default string       `yaml:"default"` // "allow" (default) or "deny"
+	Rules   []PolicyRule `yaml:"rules"`
+}
+
+// PolicyRule matches providers by namespace, type and version constraint
+type PolicyRule struct {
+	Namespace string `yaml:"namespace"` // glob, empty matches any namespace
+	Type      string `yaml:"type"`      // glob, empty matches any provider type
+	Versions  string `yaml:"versions"`  // e.g. ">= 5.0, != 5.1.2", empty matches any version
+	Action    string `yaml:"action"`    // "allow" or "deny"
+	Reason    string `yaml:"reason"`    // reported to clients of denied versions
+}
+
 // Validate checks if the configuration is valid
 func (c *Config) Validate(logger zerolog.Logger) error {
 	if c.Terraform.RegistryUrl == "" {
@@ -75,14 +216,94 @@ func (c *Config) Validate(logger zerolog.Logger) error {
 		return errors.New("server.addr is required")
 	}
 
+	for i, registry := range c.Terraform.Registries {
+		if registry.URL == "" {
+			logger.Error().Int("index", i).Msg("terraform.registries entry has no url")
+			return fmt.Errorf("terraform.registries[%d].url is required", i)
+		}
+		if registry.Prefix == "" && registry.Host == "" {
+			logger.Error().Int("index", i).Str("url", registry.URL).Msg("terraform.registries entry has neither prefix nor host")
+			return fmt.Errorf("terraform.registries[%d] needs a prefix or a host", i)
+		}
+		if strings.Contains(strings.Trim(registry.Prefix, "/"), "/") {
+			return fmt.Errorf("terraform.registries[%d].prefix must be a single path segment", i)
+		}
+	}
+
+	ttl := c.Terraform.CacheTTL
+	if ttl.Versions < 0 || ttl.Download < 0 || ttl.ModuleVersions < 0 || ttl.ModuleDownload < 0 || ttl.NotFound < 0 {
+		logger.Error().Msg("terraform.cache_ttl values must not be negative")
+		return errors.New("terraform.cache_ttl values must not be negative")
+	}
+
+	if d := strings.ToLower(c.Policy.Default); d != "" && d != "allow" && d != "deny" {
+		logger.Error().Str("default", c.Policy.Default).Msg("policy.default must be allow or deny")
+		return fmt.Errorf("policy.default must be allow or deny, got %q", c.Policy.Default)
+	}
+	for i, rule := range c.Policy.Rules {
+		if a := strings.ToLower(rule.Action); a != "allow" && a != "deny" {
+			logger.Error().Int("index", i).Str("action", rule.Action).Msg("policy rule action must be allow or deny")
+			return fmt.Errorf("policy.rules[%d].action must be allow or deny, got %q", i, rule.Action)
+		}
+	}
+
+	for i, rule := range c.Cache.TTL {
+		if rule.TTL < 0 {
+			logger.Error().Int("index", i).Msg("cache.ttl values must not be negative")
+			return fmt.Errorf("cache.ttl[%d].ttl must not be negative", i)
+		}
+	}
+
+	for i, rewrite := range c.Cache.Rewrites {
+		if rewrite.Host == "" || strings.Trim(rewrite.Prefix, "/") == "" {
+			logger.Error().Int("index", i).Msg("cache.rewrites entry needs a prefix and a host")
+			return fmt.Errorf("cache.rewrites[%d] needs a prefix and a host", i)
+		}
+		if strings.Contains(strings.Trim(rewrite.Prefix, "/"), "/") {
+			return fmt.Errorf("cache.rewrites[%d].prefix must be a single path segment", i)
+		}
+	}
+
+	upstream := c.Upstream
+	if upstream.Retries < -1 || upstream.BreakerFailures < -1 {
+		logger.Error().Int("retries", upstream.Retries).Int("breaker_failures", upstream.BreakerFailures).Msg("upstream.retries and upstream.breaker_failures must be -1 or more")
+		return errors.New("upstream.retries and upstream.breaker_failures must be -1 or more")
+	}
+	if upstream.RetryBackoff < 0 || upstream.MaxBackoff < 0 || upstream.BreakerCooldown < 0 {
+		logger.Error().Msg("upstream durations must not be negative")
+		return errors.New("upstream durations must not be negative")
+	}
+
+	for i, mirror := range c.Cache.Mirrors {
+		if mirror.Host == "" || len(mirror.Upstreams) == 0 {
+			logger.Error().Int("index", i).Msg("cache.mirrors entry needs a host and upstreams")
+			return fmt.Errorf("cache.mirrors[%d] needs a host and at least one upstream", i)
+		}
+		if mirror.HedgeAfter < 0 {
+			return fmt.Errorf("cache.mirrors[%d].hedge_after must not be negative", i)
+		}
+	}
+
+	file := c.Storage.File
+	if file.MaxSize < 0 || file.LowWatermark < 0 {
+		return errors.New("storage.file sizes must not be negative")
+	}
+	if file.MaxSize > 0 && file.LowWatermark >= file.MaxSize {
+		logger.Error().Int64("max_size", int64(file.MaxSize)).Int64("low_watermark", int64(file.LowWatermark)).Msg("storage.file.low_watermark must be below max_size")
+		return errors.New("storage.file.low_watermark must be below max_size")
+	}
+
 	// Validate cache config if any allowed hosts are set
-	if len(c.Cache.AllowedHosts) == 0 {
+	if len(c.Cache.AllowedHosts) == 0 && len(c.Cache.Rewrites) == 0 && len(c.Cache.Mirrors) == 0 {
 		logger.Warn().Msg("cache.allowed_hosts is empty - cache functionality will be limited")
 	}
 
 	logger.Debug().
 		Str("registry_url", c.Terraform.RegistryUrl).
 		Str("server_addr", c.Server.Addr).
+		Int("registries", len(c.Terraform.Registries)).
+		Int("policy_rules", len(c.Policy.Rules)).
+		Bool("offline", c.Offline).
 		Int("allowed_hosts", len(c.Cache.AllowedHosts)).
 		Msg("Configuration validated successfully")
 
@@ -4,6 +4,7 @@ import (
 	"os"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/rs/zerolog"
 )
@@ -253,3 +254,194 @@ terraform:
 		t.Error("Expected non-nil config")
 	}
 }
+
+func TestValidateRegistries(t *testing.T) {
+	tests := []struct {
+		name        string
+		registries  []RegistryConfig
+		shouldError bool
+	}{
+		{
+			name:       "prefixed registry",
+			registries: []RegistryConfig{{URL: "https://registry.opentofu.org", Prefix: "registry.opentofu.org"}},
+		},
+		{
+			name:       "virtual host registry",
+			registries: []RegistryConfig{{URL: "https://registry.corp.example.com", Host: "registry.tp.example.com"}},
+		},
+		{
+			name:        "missing url",
+			registries:  []RegistryConfig{{Prefix: "tofu"}},
+			shouldError: true,
+		},
+		{
+			name:        "missing prefix and host",
+			registries:  []RegistryConfig{{URL: "https://registry.opentofu.org"}},
+			shouldError: true,
+		},
+		{
+			name:        "nested prefix",
+			registries:  []RegistryConfig{{URL: "https://registry.opentofu.org", Prefix: "a/b"}},
+			shouldError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{}
+			cfg.Server.Addr = ":8080"
+			cfg.Terraform.RegistryUrl = "https://registry.terraform.io"
+			cfg.Terraform.Registries = tt.registries
+
+			err := cfg.Validate(zerolog.Nop())
+			if tt.shouldError && err == nil {
+				t.Error("Expected validation error, got none")
+			}
+			if !tt.shouldError && err != nil {
+				t.Errorf("Unexpected validation error: %v", err)
+			}
+		})
+	}
+}
+
+func TestValidatePolicy(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      PolicyConfig
+		shouldError bool
+	}{
+		{
+			name: "allow and deny rules",
+			policy: PolicyConfig{
+				Default: "deny",
+				Rules: []PolicyRule{
+					{Namespace: "hashicorp", Versions: "!= 5.1.2", Action: "allow"},
+					{Namespace: "hashicorp", Type: "aws", Action: "deny", Reason: "known bad"},
+				},
+			},
+		},
+		{
+			name:        "unknown default",
+			policy:      PolicyConfig{Default: "maybe"},
+			shouldError: true,
+		},
+		{
+			name:        "missing action",
+			policy:      PolicyConfig{Rules: []PolicyRule{{Namespace: "hashicorp"}}},
+			shouldError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{}
+			cfg.Server.Addr = ":8080"
+			cfg.Terraform.RegistryUrl = "https://registry.terraform.io"
+			cfg.Policy = tt.policy
+
+			err := cfg.Validate(zerolog.Nop())
+			if tt.shouldError && err == nil {
+				t.Error("Expected validation error, got none")
+			}
+			if !tt.shouldError && err != nil {
+				t.Errorf("Unexpected validation error: %v", err)
+			}
+		})
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		value       string
+		expected    ByteSize
+		shouldError bool
+	}{
+		{value: "1048576", expected: 1048576},
+		{value: "512MiB", expected: 512 << 20},
+		{value: "20GB", expected: 20e9},
+		{value: "1.5 GiB", expected: 3 << 29},
+		{value: "100kb", expected: 100e3},
+		{value: "0", expected: 0},
+		{value: "lots", shouldError: true},
+		{value: "-1GB", shouldError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			size, err := ParseByteSize(tt.value)
+			if tt.shouldError {
+				if err == nil {
+					t.Errorf("Expected an error for %q, got %d", tt.value, size)
+				}
+				return
+			}
+			if err != nil || size != tt.expected {
+				t.Errorf("Expected %d, got %d (%v)", tt.expected, size, err)
+			}
+		})
+	}
+}
+
+func TestValidateStorageLimits(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxSize      ByteSize
+		lowWatermark ByteSize
+		shouldError  bool
+	}{
+		{name: "unlimited"},
+		{name: "default watermark", maxSize: 10 << 30},
+		{name: "explicit watermark", maxSize: 10 << 30, lowWatermark: 8 << 30},
+		{name: "watermark above max", maxSize: 10 << 30, lowWatermark: 10 << 30, shouldError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{}
+			cfg.Server.Addr = ":8080"
+			cfg.Terraform.RegistryUrl = "https://registry.terraform.io"
+			cfg.Storage.File.MaxSize = tt.maxSize
+			cfg.Storage.File.LowWatermark = tt.lowWatermark
+
+			err := cfg.Validate(zerolog.Nop())
+			if tt.shouldError && err == nil {
+				t.Error("Expected validation error, got none")
+			}
+			if !tt.shouldError && err != nil {
+				t.Errorf("Unexpected validation error: %v", err)
+			}
+		})
+	}
+}
+
+func TestValidateUpstream(t *testing.T) {
+	tests := []struct {
+		name        string
+		upstream    UpstreamConfig
+		shouldError bool
+	}{
+		{name: "defaults"},
+		{name: "tuned", upstream: UpstreamConfig{Retries: 4, RetryBackoff: time.Second, MaxBackoff: time.Minute, BreakerFailures: 10, BreakerCooldown: time.Minute}},
+		{name: "disabled", upstream: UpstreamConfig{Retries: -1, BreakerFailures: -1}},
+		{name: "negative retries", upstream: UpstreamConfig{Retries: -2}, shouldError: true},
+		{name: "negative backoff", upstream: UpstreamConfig{RetryBackoff: -time.Second}, shouldError: true},
+		{name: "negative cooldown", upstream: UpstreamConfig{BreakerCooldown: -time.Second}, shouldError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{}
+			cfg.Server.Addr = ":8080"
+			cfg.Terraform.RegistryUrl = "https://registry.terraform.io"
+			cfg.Upstream = tt.upstream
+
+			err := cfg.Validate(zerolog.Nop())
+			if tt.shouldError && err == nil {
+				t.Error("Expected validation error, got none")
+			}
+			if !tt.shouldError && err != nil {
+				t.Errorf("Unexpected validation error: %v", err)
+			}
+		})
+	}
+}
@@ -3,7 +3,9 @@ module github.com/aliharirian/TerraPeak
 go 1.25.0
 
 require (
+	github.com/ProtonMail/go-crypto v1.3.0
 	github.com/go-chi/chi/v5 v5.2.2
+	github.com/klauspost/compress v1.18.0
 	github.com/minio/minio-go/v7 v7.0.95
 	github.com/rs/zerolog v1.34.0
 	golang.org/x/net v0.41.0
@@ -11,12 +13,12 @@ require (
 )
 
 require (
+	github.com/cloudflare/circl v1.6.0 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/dustin/go-humanize v1.0.1 // indirect
 	github.com/go-ini/ini v1.67.0 // indirect
 	github.com/goccy/go-json v0.10.5 // indirect
 	github.com/google/uuid v1.6.0 // indirect
-	github.com/klauspost/compress v1.18.0 // indirect
 	github.com/klauspost/cpuid/v2 v2.2.11 // indirect
 	github.com/kr/pretty v0.3.0 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
@@ -17,74 +17,20 @@ import (
 )
 
 func createIntegrationTestConfig(tempDir string) *config.Config {
-	return &config.Config{
-		Server: struct {
-			Addr         string `yaml:"addr"`
-			ReadTimeout  int    `yaml:"read_timeout"`
-			WriteTimeout int    `yaml:"write_timeout"`
-			IdleTimeout  int    `yaml:"idle_timeout"`
-			Domain       string `yaml:"domain"`
-		}{
-			Addr:         ":0", // Let OS choose port
-			ReadTimeout:  30,
-			WriteTimeout: 30,
-			IdleTimeout:  60,
-			Domain:       "https://test.example.com",
-		},
-		Log: struct {
-			Level string `yaml:"level"`
-		}{
-			Level: "info",
-		},
-		Terraform: struct {
-			RegistryUrl string `yaml:"registry_url"`
-		}{
-			RegistryUrl: "https://registry.terraform.io",
-		},
-		Storage: struct {
-			S3 struct {
-				Enabled   bool   `yaml:"enabled"`
-				Endpoint  string `yaml:"endpoint"`
-				Region    string `yaml:"region"`
-				AccessKey string `yaml:"access_key"`
-				SecretKey string `yaml:"secret_key"`
-				Bucket    string `yaml:"bucket"`
-				SkipSSL   bool   `yaml:"skip_ssl_verify"`
-			} `yaml:"s3"`
-			File struct {
-				Path string `yaml:"path"`
-			} `yaml:"file"`
-		}{
-			S3: struct {
-				Enabled   bool   `yaml:"enabled"`
-				Endpoint  string `yaml:"endpoint"`
-				Region    string `yaml:"region"`
-				AccessKey string `yaml:"access_key"`
-				SecretKey string `yaml:"secret_key"`
-				Bucket    string `yaml:"bucket"`
-				SkipSSL   bool   `yaml:"skip_ssl_verify"`
-			}{
-				Enabled: false,
-			},
-			File: struct {
-				Path string `yaml:"path"`
-			}{
-				Path: tempDir,
-			},
-		},
-		Cache: struct {
-			AllowedHosts  []string `yaml:"allowed_hosts"`
-			SkipSSLVerify bool     `yaml:"skip_ssl_verify"`
-			Rewrites      []struct {
-				Prefix string `yaml:"prefix"`
-				Host   string `yaml:"host"`
-			} `yaml:"rewrites"`
-		}{
-			AllowedHosts:  []string{"github.com", "registry.terraform.io", "gitlab.com"},
-			SkipSSLVerify: true,
-		},
-		ServeIf: true,
-	}
+	cfg := &config.Config{}
+	cfg.Server.Addr = ":0" // Let OS choose port
+	cfg.Server.ReadTimeout = 30
+	cfg.Server.WriteTimeout = 30
+	cfg.Server.IdleTimeout = 60
+	cfg.Server.Domain = "https://test.example.com"
+	cfg.Log.Level = "info"
+	cfg.Terraform.RegistryUrl = "https://registry.terraform.io"
+	cfg.Storage.S3.Enabled = false
+	cfg.Storage.File.Path = tempDir
+	cfg.Cache.AllowedHosts = []string{"github.com", "registry.terraform.io", "gitlab.com"}
+	cfg.Cache.SkipSSLVerify = true
+	cfg.ServeIf = true
+	return cfg
 }
 
 func TestFullIntegration(t *testing.T) {
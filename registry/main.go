@@ -4,6 +4,7 @@ import (
 	"errors"
 	"flag"
 	"net/http"
+	"os"
 	"time"
 
 	"github.com/aliharirian/TerraPeak/logger"
@@ -17,6 +18,19 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "mirror":
+			os.Exit(runMirror(os.Args[2:]))
+		case "export":
+			os.Exit(runExport(os.Args[2:]))
+		case "import":
+			os.Exit(runImport(os.Args[2:]))
+		case "migrate-keys":
+			os.Exit(runMigrateKeys(os.Args[2:]))
+		}
+	}
+
 	var configPath string
 	flag.StringVar(&configPath, "c", "", "Path to the configuration file")
 	flag.StringVar(&configPath, "config", "", "Path to the configuration file")
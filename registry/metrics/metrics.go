@@ -1,5 +1,100 @@
 package metrics
 
-func Metrics() {
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
 
+// Counter is a Prometheus counter, optionally split by a single label
+type Counter struct {
+	name   string
+	help   string
+	label  string
+	mu     sync.Mutex
+	values map[string]uint64
+}
+
+var (
+	countersMu sync.Mutex
+	counters   []*Counter
+)
+
+// NewCounter registers a counter exposed on /metrics. label names the label
+// the counter is split by, empty for none.
+func NewCounter(name, help, label string) *Counter {
+	c := &Counter{name: name, help: help, label: label, values: make(map[string]uint64)}
+	countersMu.Lock()
+	counters = append(counters, c)
+	countersMu.Unlock()
+	return c
+}
+
+// Inc adds one to the counter for the label value
+func (c *Counter) Inc(labelValue string) {
+	c.Add(labelValue, 1)
+}
+
+// Add adds n to the counter for the label value
+func (c *Counter) Add(labelValue string, n uint64) {
+	c.mu.Lock()
+	c.values[labelValue] += n
+	c.mu.Unlock()
+}
+
+// Value returns the current count for the label value
+func (c *Counter) Value(labelValue string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[labelValue]
+}
+
+// CoalescedRequests counts cache misses served by an upstream fetch that
+// another request started, by kind ("artifact" or "registry")
+var CoalescedRequests = NewCounter("terrapeak_coalesced_requests_total",
+	"Cache misses served by an upstream fetch started for another request.", "kind")
+
+// UpstreamRetries counts upstream requests that were sent again after a
+// failure, by upstream host
+var UpstreamRetries = NewCounter("terrapeak_upstream_retries_total",
+	"Upstream requests retried after a failure.", "host")
+
+// UpstreamCircuitRejections counts upstream requests not sent because the
+// circuit breaker of their host was open, by upstream host
+var UpstreamCircuitRejections = NewCounter("terrapeak_upstream_circuit_rejections_total",
+	"Upstream requests rejected by an open circuit breaker.", "host")
+
+// MirrorMismatches counts cached files another upstream of their mirror
+// served with a different SHA256, by mirrored host
+var MirrorMismatches = NewCounter("terrapeak_mirror_mismatches_total",
+	"Cached files another upstream of their mirror serves with other bytes.", "host")
+
+// Metrics writes every counter in the Prometheus text exposition format
+func Metrics(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	countersMu.Lock()
+	registered := append([]*Counter(nil), counters...)
+	countersMu.Unlock()
+
+	for _, c := range registered {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+
+		c.mu.Lock()
+		if c.label == "" {
+			fmt.Fprintf(w, "%s %d\n", c.name, c.values[""])
+		} else {
+			labelValues := make([]string, 0, len(c.values))
+			for v := range c.values {
+				labelValues = append(labelValues, v)
+			}
+			sort.Strings(labelValues)
+			for _, v := range labelValues {
+				fmt.Fprintf(w, "%s{%s=%q} %d\n", c.name, c.label, v, c.values[v])
+			}
+		}
+		c.mu.Unlock()
+	}
 }
@@ -28,16 +28,34 @@ func TestHealth(t *testing.T) {
 }
 
 func TestMetrics(t *testing.T) {
-	// Since Metrics() doesn't take parameters, we test that it doesn't panic
-	defer func() {
-		if r := recover(); r != nil {
-			t.Errorf("Metrics() panicked: %v", r)
-		}
-	}()
+	counter := NewCounter("terrapeak_test_total", "Test counter.", "kind")
+	counter.Inc("b")
+	counter.Add("a", 2)
+	plain := NewCounter("terrapeak_test_plain_total", "Unlabeled test counter.", "")
+	plain.Inc("")
 
-	Metrics()
+	w := httptest.NewRecorder()
+	Metrics(w)
 
-	// Test passed if we reach here without panic
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", w.Code)
+	}
+
+	body := w.Body.String()
+	for _, expected := range []string{
+		"# TYPE terrapeak_test_total counter\n",
+		"terrapeak_test_total{kind=\"a\"} 2\nterrapeak_test_total{kind=\"b\"} 1\n",
+		"terrapeak_test_plain_total 1\n",
+		"# TYPE terrapeak_coalesced_requests_total counter\n",
+	} {
+		if !contains(body, expected) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", expected, body)
+		}
+	}
+
+	if counter.Value("a") != 2 {
+		t.Errorf("Expected 2, got %d", counter.Value("a"))
+	}
 }
 
 // Helper function to check if string contains substring
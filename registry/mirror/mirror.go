@@ -0,0 +1,275 @@
+package mirror
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/aliharirian/TerraPeak/logger"
+	"github.com/aliharirian/TerraPeak/policy"
+)
+
+// Resolver tells how a registry host is reached on TerraPeak; *api.Service
+// implements it
+type Resolver interface {
+	RegistryEndpoint(hostname string) (basePath, virtualHost string, ok bool)
+}
+
+// Mirror pre-populates the store by sending registry and download requests
+// through TerraPeak's own router in-process, exactly as Terraform would
+type Mirror struct {
+	handler  http.Handler
+	resolver Resolver
+	domain   string // host of server.domain, which download URLs point at
+	out      io.Writer
+}
+
+// New creates a mirror driving handler. Progress is written to out.
+func New(handler http.Handler, resolver Resolver, domain string, out io.Writer) *Mirror {
+	domainHost := ""
+	if u, err := url.Parse(domain); err == nil {
+		domainHost = u.Host
+	}
+	if out == nil {
+		out = io.Discard
+	}
+	return &Mirror{handler: handler, resolver: resolver, domain: domainHost, out: out}
+}
+
+// Report counts what a mirror run did
+type Report struct {
+	Providers  int // providers processed
+	Versions   int // versions selected
+	Platforms  int // version/platform combinations mirrored
+	Downloaded int // files fetched from upstream
+	Cached     int // files already in the store
+	Failed     int // failed requests
+}
+
+func (r *Report) String() string {
+	return fmt.Sprintf("%d providers, %d versions, %d platform packages: %d files downloaded, %d already cached, %d failed",
+		r.Providers, r.Versions, r.Platforms, r.Downloaded, r.Cached, r.Failed)
+}
+
+// Run mirrors every selected version of the providers for the given
+// "os_arch" platforms. Running it again only touches what is missing.
+func (m *Mirror) Run(providers []Provider, platforms []string) *Report {
+	report := &Report{}
+	wanted := make(map[string]bool, len(platforms))
+	for _, p := range platforms {
+		wanted[p] = true
+	}
+
+	for _, provider := range providers {
+		report.Providers++
+		if err := m.mirrorProvider(provider, wanted, report); err != nil {
+			report.Failed++
+			fmt.Fprintf(m.out, "FAILED  %s: %v\n", provider, err)
+			logger.Errorf("Failed to mirror %s: %v", provider, err)
+		}
+	}
+
+	fmt.Fprintf(m.out, "Mirrored %s\n", report)
+	return report
+}
+
+// registryVersions is the part of the version listing the mirror uses
+type registryVersions struct {
+	Versions []struct {
+		Version   string `json:"version"`
+		Platforms []struct {
+			OS   string `json:"os"`
+			Arch string `json:"arch"`
+		} `json:"platforms"`
+	} `json:"versions"`
+}
+
+func (m *Mirror) mirrorProvider(provider Provider, wanted map[string]bool, report *Report) error {
+	constraint, err := policy.ParseConstraint(provider.Versions)
+	if err != nil {
+		return err
+	}
+
+	basePath, virtualHost, ok := m.resolver.RegistryEndpoint(provider.Hostname)
+	if !ok {
+		return fmt.Errorf("registry %s is not configured", provider.Hostname)
+	}
+	providerPath := basePath + "/v1/providers/" + provider.Namespace + "/" + provider.Type
+
+	status, _, body := m.get(providerPath+"/versions", virtualHost, true)
+	if status != http.StatusOK {
+		return fmt.Errorf("version list: status %d: %s", status, strings.TrimSpace(string(body)))
+	}
+
+	var versions registryVersions
+	if err := json.Unmarshal(body, &versions); err != nil {
+		return fmt.Errorf("failed to parse version list: %w", err)
+	}
+
+	selected := 0
+	for _, v := range versions.Versions {
+		version, err := policy.ParseVersion(v.Version)
+		if err != nil || !constraint.Check(version) {
+			continue
+		}
+		selected++
+		report.Versions++
+
+		var available []string
+		for _, p := range v.Platforms {
+			if platform := p.OS + "_" + p.Arch; wanted[platform] {
+				available = append(available, platform)
+			}
+		}
+		sort.Strings(available)
+		if len(available) == 0 {
+			fmt.Fprintf(m.out, "SKIPPED %s %s: none of the selected platforms is published\n", provider, v.Version)
+			continue
+		}
+
+		for _, platform := range available {
+			os, arch, _ := strings.Cut(platform, "_")
+			report.Platforms++
+			m.mirrorPackage(provider, providerPath, virtualHost, v.Version, os, arch, report)
+		}
+	}
+
+	if selected == 0 {
+		return fmt.Errorf("no version matches %q", provider.Versions)
+	}
+	return nil
+}
+
+// mirrorPackage fetches the download details of one platform package and then
+// SHASUMS, signature and archive through the cache handler
+func (m *Mirror) mirrorPackage(provider Provider, providerPath, virtualHost, version, os, arch string, report *Report) {
+	label := fmt.Sprintf("%s %s %s_%s", provider, version, os, arch)
+
+	status, _, body := m.get(providerPath+"/"+version+"/download/"+os+"/"+arch, virtualHost, true)
+	if status != http.StatusOK {
+		report.Failed++
+		fmt.Fprintf(m.out, "FAILED  %s: download details: status %d\n", label, status)
+		return
+	}
+
+	var details map[string]any
+	if err := json.Unmarshal(body, &details); err != nil {
+		report.Failed++
+		fmt.Fprintf(m.out, "FAILED  %s: download details: %v\n", label, err)
+		return
+	}
+
+	// SHASUMS first, so the archive can be verified against them
+	downloaded, cached := 0, 0
+	for _, field := range []string{"shasums_url", "shasums_signature_url", "download_url"} {
+		location, _ := details[field].(string)
+		if location == "" {
+			continue
+		}
+
+		status, cacheStatus, _ := m.get(m.localPath(location), "", false)
+		switch {
+		case status != http.StatusOK:
+			report.Failed++
+			fmt.Fprintf(m.out, "FAILED  %s: %s: status %d\n", label, location, status)
+			return
+		case cacheStatus == "HIT":
+			cached++
+		default:
+			downloaded++
+		}
+	}
+
+	report.Downloaded += downloaded
+	report.Cached += cached
+	fmt.Fprintf(m.out, "OK      %s: %d downloaded, %d cached\n", label, downloaded, cached)
+}
+
+// localPath turns a download URL into the path the cache handler serves it
+// under: URLs already pointing at TerraPeak keep their path, upstream URLs
+// become /{host}/{path}
+func (m *Mirror) localPath(location string) string {
+	u, err := url.Parse(location)
+	if err != nil || u.Host == "" {
+		return location
+	}
+
+	local := u.EscapedPath()
+	if !strings.EqualFold(u.Host, m.domain) {
+		local = "/" + u.Host + local
+	}
+	if u.RawQuery != "" {
+		local += "?" + u.RawQuery
+	}
+	return local
+}
+
+// get sends a GET request through the handler, keeping the body only when
+// asked to
+func (m *Mirror) get(target, virtualHost string, keepBody bool) (int, string, []byte) {
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return http.StatusBadRequest, "", []byte(err.Error())
+	}
+	if virtualHost != "" {
+		req.Host = virtualHost
+	}
+
+	rw := &responseWriter{header: make(http.Header), keepBody: keepBody}
+	if !serve(m.handler, rw, req) {
+		return http.StatusBadGateway, "", []byte("response aborted")
+	}
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	return rw.status, rw.header.Get("X-Cache-Status"), rw.body.Bytes()
+}
+
+// serve runs the handler, reporting false when it aborted the response part
+// way through, as the cache handler does for downloads it rejects
+func serve(handler http.Handler, rw http.ResponseWriter, req *http.Request) (completed bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			if r != http.ErrAbortHandler {
+				panic(r)
+			}
+			completed = false
+		}
+	}()
+	handler.ServeHTTP(rw, req)
+	return true
+}
+
+// responseWriter collects a response produced in-process, optionally
+// discarding large bodies such as provider archives
+type responseWriter struct {
+	header   http.Header
+	status   int
+	body     bytes.Buffer
+	keepBody bool
+}
+
+func (rw *responseWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *responseWriter) Write(data []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	if rw.keepBody {
+		return rw.body.Write(data)
+	}
+	return len(data), nil
+}
+
+func (rw *responseWriter) WriteHeader(statusCode int) {
+	if rw.status == 0 {
+		rw.status = statusCode
+	}
+}
@@ -0,0 +1,179 @@
+package mirror
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// fakeResolver serves the default registry at the root and one prefixed registry
+type fakeResolver struct{}
+
+func (fakeResolver) RegistryEndpoint(hostname string) (string, string, bool) {
+	switch hostname {
+	case DefaultHostname:
+		return "", "", true
+	case "registry.opentofu.org":
+		return "/tofu", "", true
+	}
+	return "", "", false
+}
+
+// newFakeTerraPeak answers like TerraPeak would, marking files as HIT once
+// they have been requested before
+func newFakeTerraPeak() (http.Handler, *sync.Map) {
+	var seen sync.Map
+	router := chi.NewRouter()
+
+	versions := func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"versions":[
+			{"version":"5.0.0","platforms":[{"os":"linux","arch":"amd64"},{"os":"darwin","arch":"arm64"}]},
+			{"version":"5.1.0","platforms":[{"os":"linux","arch":"amd64"}]},
+			{"version":"4.9.0","platforms":[{"os":"linux","arch":"amd64"}]}
+		]}`)
+	}
+	download := func(w http.ResponseWriter, r *http.Request) {
+		base := "https://tp.example.com/releases.hashicorp.com/" + chi.URLParam(r, "name") + "/" + chi.URLParam(r, "version")
+		fmt.Fprintf(w, `{"download_url":"%s/%s_%s.zip","shasums_url":"%s/SHA256SUMS","shasums_signature_url":"%s/SHA256SUMS.sig"}`,
+			base, chi.URLParam(r, "os"), chi.URLParam(r, "arch"), base, base)
+	}
+	for _, prefix := range []string{"", "/tofu"} {
+		router.Get(prefix+"/v1/providers/{namespace}/{name}/versions", versions)
+		router.Get(prefix+"/v1/providers/{namespace}/{name}/{version}/download/{os}/{arch}", download)
+	}
+	router.Get("/releases.hashicorp.com/*", func(w http.ResponseWriter, r *http.Request) {
+		if _, cached := seen.LoadOrStore(r.URL.Path, true); cached {
+			w.Header().Set("X-Cache-Status", "HIT")
+		} else {
+			w.Header().Set("X-Cache-Status", "MISS")
+		}
+		w.Write([]byte("content"))
+	})
+	return router, &seen
+}
+
+func TestMirrorRun(t *testing.T) {
+	handler, seen := newFakeTerraPeak()
+
+	var out bytes.Buffer
+	m := New(handler, fakeResolver{}, "https://tp.example.com", &out)
+
+	providers := []Provider{
+		{Hostname: DefaultHostname, Namespace: "hashicorp", Type: "aws", Versions: ">= 5.0"},
+		{Hostname: "registry.opentofu.org", Namespace: "hashicorp", Type: "null", Versions: "= 5.0.0"},
+	}
+
+	report := m.Run(providers, []string{"linux_amd64"})
+	if report.Failed != 0 {
+		t.Fatalf("Expected no failures, got %d:\n%s", report.Failed, out.String())
+	}
+	if report.Versions != 3 || report.Platforms != 3 {
+		t.Errorf("Expected 3 versions and 3 platform packages, got %d and %d", report.Versions, report.Platforms)
+	}
+	if report.Downloaded != 9 || report.Cached != 0 {
+		t.Errorf("Expected 9 downloads and 0 cached files, got %d and %d", report.Downloaded, report.Cached)
+	}
+	if _, ok := seen.Load("/releases.hashicorp.com/aws/5.1.0/linux_amd64.zip"); !ok {
+		t.Error("Expected the 5.1.0 linux_amd64 archive to be requested")
+	}
+	if _, ok := seen.Load("/releases.hashicorp.com/aws/5.0.0/darwin_arm64.zip"); ok {
+		t.Error("Expected unselected platforms to be skipped")
+	}
+
+	// A second run finds everything in the store
+	report = m.Run(providers, []string{"linux_amd64"})
+	if report.Downloaded != 0 || report.Cached != 9 {
+		t.Errorf("Expected 0 downloads and 9 cached files on the second run, got %d and %d", report.Downloaded, report.Cached)
+	}
+	if !strings.Contains(out.String(), "Mirrored 2 providers") {
+		t.Errorf("Expected a summary, got:\n%s", out.String())
+	}
+}
+
+func TestMirrorRunFailures(t *testing.T) {
+	handler, _ := newFakeTerraPeak()
+	m := New(handler, fakeResolver{}, "https://tp.example.com", nil)
+
+	providers := []Provider{
+		{Hostname: "registry.example.com", Namespace: "hashicorp", Type: "aws"},
+		{Hostname: DefaultHostname, Namespace: "hashicorp", Type: "aws", Versions: "= 9.9.9"},
+	}
+
+	if report := m.Run(providers, []string{"linux_amd64"}); report.Failed != 2 {
+		t.Errorf("Expected 2 failures, got %d", report.Failed)
+	}
+}
+
+func TestLoadLockFile(t *testing.T) {
+	lockFile := filepath.Join(t.TempDir(), ".terraform.lock.hcl")
+	content := `# This file is maintained automatically by "terraform init".
+
+provider "registry.terraform.io/hashicorp/aws" {
+  version     = "5.31.0"
+  constraints = "~> 5.0"
+  hashes = [
+    "h1:abc=",
+    "zh:def",
+  ]
+}
+
+provider "registry.opentofu.org/hashicorp/random" {
+  version = "3.6.0"
+}
+`
+	if err := os.WriteFile(lockFile, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write lock file: %v", err)
+	}
+
+	providers, err := LoadLockFile(lockFile)
+	if err != nil {
+		t.Fatalf("Failed to load lock file: %v", err)
+	}
+
+	expected := []Provider{
+		{Hostname: "registry.terraform.io", Namespace: "hashicorp", Type: "aws", Versions: "= 5.31.0"},
+		{Hostname: "registry.opentofu.org", Namespace: "hashicorp", Type: "random", Versions: "= 3.6.0"},
+	}
+	if len(providers) != len(expected) {
+		t.Fatalf("Expected %d providers, got %d", len(expected), len(providers))
+	}
+	for i := range expected {
+		if providers[i] != expected[i] {
+			t.Errorf("Expected %+v, got %+v", expected[i], providers[i])
+		}
+	}
+}
+
+func TestLoadProviderList(t *testing.T) {
+	listFile := filepath.Join(t.TempDir(), "providers.yml")
+	content := `platforms: [linux_amd64, darwin_arm64]
+providers:
+  - source: hashicorp/aws
+    versions: "~> 5.0"
+  - source: registry.opentofu.org/hashicorp/random
+`
+	if err := os.WriteFile(listFile, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write provider list: %v", err)
+	}
+
+	providers, platforms, err := LoadProviderList(listFile)
+	if err != nil {
+		t.Fatalf("Failed to load provider list: %v", err)
+	}
+	if len(platforms) != 2 {
+		t.Errorf("Expected 2 platforms, got %v", platforms)
+	}
+	if len(providers) != 2 || providers[0].Hostname != DefaultHostname || providers[0].Versions != "~> 5.0" {
+		t.Errorf("Unexpected providers %+v", providers)
+	}
+	if providers[1].String() != "registry.opentofu.org/hashicorp/random" {
+		t.Errorf("Expected registry.opentofu.org/hashicorp/random, got %s", providers[1])
+	}
+}
@@ -0,0 +1,133 @@
+package mirror
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultHostname is the registry host assumed for sources without one
+const DefaultHostname = "registry.terraform.io"
+
+// Provider is one provider to mirror and the versions wanted
+type Provider struct {
+	Hostname  string
+	Namespace string
+	Type      string
+	Versions  string // version constraint, empty means every version
+}
+
+func (p Provider) String() string {
+	return p.Hostname + "/" + p.Namespace + "/" + p.Type
+}
+
+// ParseSource parses a provider source address: "namespace/type" or
+// "hostname/namespace/type"
+func ParseSource(source string) (Provider, error) {
+	parts := strings.Split(strings.TrimSpace(source), "/")
+	switch {
+	case len(parts) == 2 && parts[0] != "" && parts[1] != "":
+		return Provider{Hostname: DefaultHostname, Namespace: parts[0], Type: parts[1]}, nil
+	case len(parts) == 3 && parts[0] != "" && parts[1] != "" && parts[2] != "":
+		return Provider{Hostname: strings.ToLower(parts[0]), Namespace: parts[1], Type: parts[2]}, nil
+	}
+	return Provider{}, fmt.Errorf("invalid provider source %q", source)
+}
+
+// ProviderList is the YAML file listing providers to mirror:
+//
+//	platforms: [linux_amd64, darwin_arm64]
+//	providers:
+//	  - source: hashicorp/aws
+//	    versions: "~> 5.0"
+type ProviderList struct {
+	Platforms []string `yaml:"platforms"`
+	Providers []struct {
+		Source   string `yaml:"source"`
+		Versions string `yaml:"versions"`
+	} `yaml:"providers"`
+}
+
+// LoadProviderList reads a provider list file
+func LoadProviderList(path string) ([]Provider, []string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var list ProviderList
+	if err := yaml.Unmarshal(data, &list); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	var providers []Provider
+	for _, entry := range list.Providers {
+		provider, err := ParseSource(entry.Source)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", path, err)
+		}
+		provider.Versions = entry.Versions
+		providers = append(providers, provider)
+	}
+	return providers, list.Platforms, nil
+}
+
+var (
+	lockProviderPattern = regexp.MustCompile(`^\s*provider\s+"([^"]+)"\s*\{`)
+	lockVersionPattern  = regexp.MustCompile(`^\s*version\s*=\s*"([^"]+)"`)
+)
+
+// LoadLockFile reads the provider selections of a .terraform.lock.hcl file,
+// pinning each provider to its locked version
+func LoadLockFile(path string) ([]Provider, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var (
+		providers []Provider
+		current   *Provider
+		depth     int
+	)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if current == nil {
+			if m := lockProviderPattern.FindStringSubmatch(line); m != nil {
+				provider, err := ParseSource(m[1])
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", path, err)
+				}
+				current, depth = &provider, 1
+			}
+			continue
+		}
+
+		// Only the provider block's own attributes count, not nested blocks
+		if m := lockVersionPattern.FindStringSubmatch(line); m != nil && depth == 1 {
+			current.Versions = "= " + m[1]
+		}
+		depth += strings.Count(line, "{") - strings.Count(line, "}")
+		if depth <= 0 {
+			if current.Versions == "" {
+				return nil, fmt.Errorf("%s: provider %s has no locked version", path, current)
+			}
+			providers = append(providers, *current)
+			current = nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if current != nil {
+		return nil, fmt.Errorf("%s: unterminated provider block for %s", path, current)
+	}
+	return providers, nil
+}
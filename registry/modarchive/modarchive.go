@@ -0,0 +1,108 @@
+// Package modarchive maps module registry download locations to the HTTP
+// archives TerraPeak caches and the keys they are stored under. It is shared
+// by the registry API and the bundle tools.
+package modarchive
+
+import (
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/aliharirian/TerraPeak/store"
+)
+
+// URL turns a module X-Terraform-Get location into the HTTP URL of an
+// archive holding the module, plus the go-getter subdirectory inside it.
+//
+// Relative locations are resolved against the download endpoint that returned
+// them. Plain http(s) locations are used as they are; git sources hosted on
+// github.com with a ref are mapped to the matching codeload.github.com tarball.
+// Anything else (git remotes elsewhere, s3::, gcs::, ...) reports ok=false.
+func URL(location, downloadURL string) (archiveURL *url.URL, subdir string, ok bool) {
+	getter := ""
+	if i := strings.Index(location, "::"); i > 0 && !strings.Contains(location[:i], "/") {
+		getter, location = location[:i], location[i+2:]
+	}
+
+	source, subdir := splitModuleSubdir(location)
+
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, "", false
+	}
+	if !u.IsAbs() && getter == "" {
+		base, err := url.Parse(downloadURL)
+		if err != nil {
+			return nil, "", false
+		}
+		u = base.ResolveReference(u)
+	}
+	if u.Host == "" || (u.Scheme != "https" && u.Scheme != "http") {
+		return nil, "", false
+	}
+
+	switch getter {
+	case "", "http", "https":
+		return u, subdir, true
+	case "git":
+		if !strings.EqualFold(u.Hostname(), "github.com") {
+			return nil, "", false
+		}
+		ref := u.Query().Get("ref")
+		parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+		if ref == "" || len(parts) != 2 {
+			return nil, "", false
+		}
+		repo := strings.TrimSuffix(parts[1], ".git")
+
+		// GitHub tarballs wrap the repository in a single top-level
+		// directory, which go-getter selects with a "*" subdirectory
+		if subdir == "" {
+			subdir = "*"
+		} else {
+			subdir = path.Join("*", subdir)
+		}
+		return &url.URL{
+			Scheme:   "https",
+			Host:     "codeload.github.com",
+			Path:     "/" + parts[0] + "/" + repo + "/tar.gz/" + ref,
+			RawQuery: "archive=tar.gz",
+		}, subdir, true
+	default:
+		return nil, "", false
+	}
+}
+
+// Key returns the cache key an archive from URL is stored under. go-getter
+// consumes the "archive" query parameter itself and requests the archive
+// without it, so it is no part of the key.
+func Key(archiveURL *url.URL) string {
+	var query []string
+	for _, param := range strings.Split(archiveURL.RawQuery, "&") {
+		name, _, _ := strings.Cut(param, "=")
+		if name, err := url.QueryUnescape(name); param == "" || (err == nil && name == "archive") {
+			continue
+		}
+		query = append(query, param)
+	}
+	return store.URLKey(archiveURL.Host, archiveURL.Path, strings.Join(query, "&"))
+}
+
+// splitModuleSubdir separates a go-getter "//subdir" suffix from a source,
+// keeping any query string on the source part
+func splitModuleSubdir(source string) (string, string) {
+	query := ""
+	if i := strings.Index(source, "?"); i >= 0 {
+		source, query = source[:i], source[i:]
+	}
+
+	offset := 0
+	if i := strings.Index(source, "://"); i >= 0 {
+		offset = i + 3
+	}
+	i := strings.Index(source[offset:], "//")
+	if i < 0 {
+		return source + query, ""
+	}
+	return source[:offset+i] + query, strings.Trim(source[offset+i+2:], "/")
+}
@@ -0,0 +1,96 @@
+package modarchive
+
+import (
+	"testing"
+)
+
+func TestURL(t *testing.T) {
+	tests := []struct {
+		name           string
+		location       string
+		downloadURL    string
+		expectedURL    string
+		expectedSubdir string
+		expectedOK     bool
+	}{
+		{
+			name:           "github git source",
+			location:       "git::https://github.com/terraform-aws-modules/terraform-aws-vpc?ref=v5.0.0",
+			downloadURL:    "https://registry.terraform.io/v1/modules/terraform-aws-modules/vpc/aws/5.0.0/download",
+			expectedURL:    "https://codeload.github.com/terraform-aws-modules/terraform-aws-vpc/tar.gz/v5.0.0?archive=tar.gz",
+			expectedSubdir: "*",
+			expectedOK:     true,
+		},
+		{
+			name:           "github git source with subdir and .git suffix",
+			location:       "git::https://github.com/hashicorp/example.git//modules/consul?ref=v1.2.0",
+			downloadURL:    "https://registry.terraform.io/v1/modules/hashicorp/consul/aws/1.2.0/download",
+			expectedURL:    "https://codeload.github.com/hashicorp/example/tar.gz/v1.2.0?archive=tar.gz",
+			expectedSubdir: "*/modules/consul",
+			expectedOK:     true,
+		},
+		{
+			name:           "https archive",
+			location:       "https://example.com/modules/vpc-1.0.0.tar.gz",
+			downloadURL:    "https://registry.example.com/v1/modules/acme/vpc/aws/1.0.0/download",
+			expectedURL:    "https://example.com/modules/vpc-1.0.0.tar.gz",
+			expectedSubdir: "",
+			expectedOK:     true,
+		},
+		{
+			name:           "relative archive with subdir",
+			location:       "/archives/vpc.zip//network?archive=zip",
+			downloadURL:    "https://registry.example.com/v1/modules/acme/vpc/aws/1.0.0/download",
+			expectedURL:    "https://registry.example.com/archives/vpc.zip?archive=zip",
+			expectedSubdir: "network",
+			expectedOK:     true,
+		},
+		{
+			name:        "github git source without ref",
+			location:    "git::https://github.com/hashicorp/example",
+			downloadURL: "https://registry.terraform.io/v1/modules/hashicorp/example/aws/1.0.0/download",
+			expectedOK:  false,
+		},
+		{
+			name:        "git source on other host",
+			location:    "git::https://gitlab.com/acme/vpc.git?ref=v1.0.0",
+			downloadURL: "https://registry.terraform.io/v1/modules/acme/vpc/aws/1.0.0/download",
+			expectedOK:  false,
+		},
+		{
+			name:        "s3 source",
+			location:    "s3::https://s3.amazonaws.com/bucket/vpc.zip",
+			downloadURL: "https://registry.terraform.io/v1/modules/acme/vpc/aws/1.0.0/download",
+			expectedOK:  false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			archiveURL, subdir, ok := URL(tt.location, tt.downloadURL)
+			if ok != tt.expectedOK {
+				t.Fatalf("Expected ok=%v, got %v", tt.expectedOK, ok)
+			}
+			if !ok {
+				return
+			}
+			if archiveURL.String() != tt.expectedURL {
+				t.Errorf("Expected URL %s, got %s", tt.expectedURL, archiveURL.String())
+			}
+			if subdir != tt.expectedSubdir {
+				t.Errorf("Expected subdir %q, got %q", tt.expectedSubdir, subdir)
+			}
+		})
+	}
+}
+
+func TestKey(t *testing.T) {
+	archiveURL, _, ok := URL("/archives/vpc.zip?archive=zip&token=abc", "https://registry.example.com/v1/modules/acme/vpc/aws/1.0.0/download")
+	if !ok {
+		t.Fatal("Expected the location to be cacheable")
+	}
+	// go-getter drops the archive parameter before it downloads the archive
+	if key := Key(archiveURL); key != "registry.example.com/archives/vpc.zip?token%3Dabc" {
+		t.Errorf("Unexpected key %s", key)
+	}
+}
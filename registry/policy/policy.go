@@ -0,0 +1,105 @@
+package policy
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/aliharirian/TerraPeak/config"
+)
+
+// Decision is the outcome of evaluating a provider version against the policy
+type Decision struct {
+	Allowed bool
+	Reason  string
+	Rule    int // index of the deciding rule, -1 for the default action
+}
+
+// Policy decides which provider versions TerraPeak serves
+type Policy struct {
+	rules        []rule
+	defaultAllow bool
+}
+
+type rule struct {
+	namespace  string
+	name       string
+	constraint *Constraint
+	allow      bool
+	reason     string
+}
+
+// New compiles the policy section of the configuration
+func New(cfg config.PolicyConfig) (*Policy, error) {
+	p := &Policy{defaultAllow: !strings.EqualFold(cfg.Default, "deny")}
+
+	for i, rc := range cfg.Rules {
+		constraint, err := ParseConstraint(rc.Versions)
+		if err != nil {
+			return nil, fmt.Errorf("policy.rules[%d]: %w", i, err)
+		}
+		for _, pattern := range []string{rc.Namespace, rc.Type} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("policy.rules[%d]: invalid pattern %q", i, pattern)
+			}
+		}
+		p.rules = append(p.rules, rule{
+			namespace:  strings.ToLower(rc.Namespace),
+			name:       strings.ToLower(rc.Type),
+			constraint: constraint,
+			allow:      strings.EqualFold(rc.Action, "allow"),
+			reason:     rc.Reason,
+		})
+	}
+	return p, nil
+}
+
+// Evaluate decides on one provider version. The first rule matching the
+// namespace, type and version wins; otherwise the default action applies.
+// Versions that cannot be parsed only match rules without a constraint.
+func (p *Policy) Evaluate(namespace, name, version string) Decision {
+	namespace, name = strings.ToLower(namespace), strings.ToLower(name)
+	v, versionErr := ParseVersion(version)
+
+	for i, r := range p.rules {
+		if !matches(r.namespace, namespace) || !matches(r.name, name) {
+			continue
+		}
+		if len(r.constraint.conditions) > 0 && (versionErr != nil || !r.constraint.Check(v)) {
+			continue
+		}
+
+		reason := r.reason
+		if reason == "" {
+			reason = fmt.Sprintf("%s by policy rule %d", actionVerb(r.allow), i)
+		}
+		return Decision{Allowed: r.allow, Reason: reason, Rule: i}
+	}
+
+	return Decision{
+		Allowed: p.defaultAllow,
+		Reason:  fmt.Sprintf("%s by default policy", actionVerb(p.defaultAllow)),
+		Rule:    -1,
+	}
+}
+
+// Empty reports whether the policy allows everything without any rules
+func (p *Policy) Empty() bool {
+	return p == nil || (len(p.rules) == 0 && p.defaultAllow)
+}
+
+// matches compares a rule pattern to a value; an empty pattern matches anything
+func matches(pattern, value string) bool {
+	if pattern == "" {
+		return true
+	}
+	ok, _ := path.Match(pattern, value)
+	return ok
+}
+
+func actionVerb(allow bool) string {
+	if allow {
+		return "allowed"
+	}
+	return "denied"
+}
@@ -0,0 +1,114 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/aliharirian/TerraPeak/config"
+)
+
+func TestConstraintCheck(t *testing.T) {
+	tests := []struct {
+		constraint string
+		version    string
+		expected   bool
+	}{
+		{"", "1.0.0", true},
+		{"1.2.3", "1.2.3", true},
+		{"= 1.2.3", "1.2.4", false},
+		{"!= 5.1.2", "5.1.2", false},
+		{"!= 5.1.2", "5.1.3", true},
+		{"> 1.0", "1.0.1", true},
+		{">= 4.0.0, < 5.0.0", "4.67.0", true},
+		{">= 4.0.0, < 5.0.0", "5.0.0", false},
+		{"<= 2.1", "2.1.0", true},
+		{"~> 1.2", "1.9.0", true},
+		{"~> 1.2", "2.0.0", false},
+		{"~> 1.2", "1.1.0", false},
+		{"~> 1.2.3", "1.2.9", true},
+		{"~> 1.2.3", "1.3.0", false},
+		{"~> 1", "1.5.0", true},
+		{"~> 1", "2.0.0", false},
+		{">= 1.0.0", "1.0.0-beta1", false},
+		{"< 1.0.0", "1.0.0-beta1", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.constraint+" "+tt.version, func(t *testing.T) {
+			c, err := ParseConstraint(tt.constraint)
+			if err != nil {
+				t.Fatalf("Failed to parse constraint: %v", err)
+			}
+			v, err := ParseVersion(tt.version)
+			if err != nil {
+				t.Fatalf("Failed to parse version: %v", err)
+			}
+			if got := c.Check(v); got != tt.expected {
+				t.Errorf("Expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestParseConstraintInvalid(t *testing.T) {
+	for _, constraint := range []string{">= x.y", "1.2.3.4", "~>", "1.0-"} {
+		if _, err := ParseConstraint(constraint); err == nil {
+			t.Errorf("Expected error for %q, got none", constraint)
+		}
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	p, err := New(config.PolicyConfig{
+		Default: "deny",
+		Rules: []config.PolicyRule{
+			{Namespace: "hashicorp", Type: "aws", Versions: "5.1.2", Action: "deny", Reason: "CVE-2024-0001"},
+			{Namespace: "hashicorp", Action: "allow"},
+			{Namespace: "corp-*", Versions: ">= 2.0", Action: "allow"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create policy: %v", err)
+	}
+
+	tests := []struct {
+		name            string
+		namespace       string
+		provider        string
+		version         string
+		expectedAllowed bool
+		expectedRule    int
+	}{
+		{"known bad version", "hashicorp", "aws", "5.1.2", false, 0},
+		{"other version", "hashicorp", "aws", "5.1.3", true, 1},
+		{"namespace is case insensitive", "HashiCorp", "google", "4.0.0", true, 1},
+		{"glob namespace", "corp-network", "firewall", "2.1.0", true, 2},
+		{"glob namespace, old version", "corp-network", "firewall", "1.9.0", false, -1},
+		{"unlisted namespace", "someone", "random", "1.0.0", false, -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decision := p.Evaluate(tt.namespace, tt.provider, tt.version)
+			if decision.Allowed != tt.expectedAllowed {
+				t.Errorf("Expected allowed=%v, got %v (%s)", tt.expectedAllowed, decision.Allowed, decision.Reason)
+			}
+			if decision.Rule != tt.expectedRule {
+				t.Errorf("Expected rule %d, got %d", tt.expectedRule, decision.Rule)
+			}
+			if decision.Reason == "" {
+				t.Error("Expected a reason")
+			}
+		})
+	}
+
+	if decision := p.Evaluate("hashicorp", "aws", "5.1.2"); decision.Reason != "CVE-2024-0001" {
+		t.Errorf("Expected configured reason, got %s", decision.Reason)
+	}
+}
+
+func TestNewInvalidRule(t *testing.T) {
+	_, err := New(config.PolicyConfig{Rules: []config.PolicyRule{{Versions: ">= nope", Action: "deny"}}})
+	if err == nil {
+		t.Error("Expected error for invalid constraint, got none")
+	}
+}
@@ -0,0 +1,184 @@
+package policy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version is a semantic version as published by provider registries
+type Version struct {
+	segments   [3]int
+	given      int // number of segments written, for "~>"
+	prerelease string
+}
+
+// ParseVersion parses "1.2.3", "1.2", "v1" or "1.2.3-beta1" (build metadata
+// after "+" is ignored)
+func ParseVersion(s string) (Version, error) {
+	var v Version
+	raw := strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if i := strings.Index(raw, "+"); i >= 0 {
+		raw = raw[:i]
+	}
+	if i := strings.Index(raw, "-"); i >= 0 {
+		raw, v.prerelease = raw[:i], raw[i+1:]
+		if v.prerelease == "" {
+			return Version{}, fmt.Errorf("invalid version %q", s)
+		}
+	}
+
+	parts := strings.Split(raw, ".")
+	if len(parts) > 3 {
+		return Version{}, fmt.Errorf("invalid version %q", s)
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return Version{}, fmt.Errorf("invalid version %q", s)
+		}
+		v.segments[i] = n
+	}
+	v.given = len(parts)
+	return v, nil
+}
+
+// Compare returns -1, 0 or 1. A pre-release sorts before its release.
+func (v Version) Compare(o Version) int {
+	for i := range v.segments {
+		if v.segments[i] != o.segments[i] {
+			if v.segments[i] < o.segments[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return comparePrerelease(v.prerelease, o.prerelease)
+}
+
+func comparePrerelease(a, b string) int {
+	switch {
+	case a == b:
+		return 0
+	case a == "":
+		return 1
+	case b == "":
+		return -1
+	}
+
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] == bs[i] {
+			continue
+		}
+		an, aErr := strconv.Atoi(as[i])
+		bn, bErr := strconv.Atoi(bs[i])
+		switch {
+		case aErr == nil && bErr == nil:
+			if an < bn {
+				return -1
+			}
+			return 1
+		case aErr == nil:
+			// Numeric identifiers sort before alphanumeric ones
+			return -1
+		case bErr == nil:
+			return 1
+		case as[i] < bs[i]:
+			return -1
+		default:
+			return 1
+		}
+	}
+	switch {
+	case len(as) < len(bs):
+		return -1
+	case len(as) > len(bs):
+		return 1
+	}
+	return 0
+}
+
+// Constraint is a comma separated list of version conditions that must all
+// hold, in Terraform syntax: "= 1.0", "!= 1.2.3", "> 1", ">= 1.2", "< 2",
+// "<= 2.1", "~> 1.2". A bare version means "=".
+type Constraint struct {
+	conditions []condition
+}
+
+type condition struct {
+	op      string
+	version Version
+}
+
+// ParseConstraint parses a version constraint; an empty string matches any version
+func ParseConstraint(s string) (*Constraint, error) {
+	c := &Constraint{}
+	if strings.TrimSpace(s) == "" {
+		return c, nil
+	}
+
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		op := "="
+		for _, candidate := range []string{"~>", ">=", "<=", "!=", ">", "<", "="} {
+			if strings.HasPrefix(part, candidate) {
+				op = candidate
+				part = strings.TrimSpace(part[len(candidate):])
+				break
+			}
+		}
+
+		v, err := ParseVersion(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid constraint %q: %w", s, err)
+		}
+		c.conditions = append(c.conditions, condition{op: op, version: v})
+	}
+	return c, nil
+}
+
+// Check reports whether v satisfies every condition
+func (c *Constraint) Check(v Version) bool {
+	for _, cond := range c.conditions {
+		if !cond.check(v) {
+			return false
+		}
+	}
+	return true
+}
+
+func (cond condition) check(v Version) bool {
+	cmp := v.Compare(cond.version)
+	switch cond.op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case "~>":
+		// Only the right-most given segment may increase: "~> 1.2" allows
+		// 1.x from 1.2 on, "~> 1.2.3" allows 1.2.x from 1.2.3 on
+		if cmp < 0 {
+			return false
+		}
+		fixed := cond.version.given - 1
+		if fixed < 1 {
+			fixed = 1
+		}
+		for i := 0; i < fixed; i++ {
+			if v.segments[i] != cond.version.segments[i] {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
@@ -106,11 +106,17 @@ func (h *Handler) handleHTTPRequest(w http.ResponseWriter, r *http.Request) {
 
 	logger.Infof("HTTP proxy request: %s %s", r.Method, r.URL.String())
 
-	// Forward request through proxy client
-	resp, err := h.client.Do(r)
+	// Forward request through proxy client, which retries it and rejects it
+	// while the circuit breaker of the target host is open, like any other
+	// upstream request. A server request cannot be sent as it is.
+	outReq := r.Clone(r.Context())
+	outReq.RequestURI = ""
+	resp, err := h.client.Do(outReq)
 	if err != nil {
 		logger.Errorf("Failed to forward request: %v", err)
-		http.Error(w, "Proxy request failed", http.StatusBadGateway)
+		if !WriteCircuitOpen(w, err) {
+			http.Error(w, "Proxy request failed", http.StatusBadGateway)
+		}
 		return
 	}
 	defer resp.Body.Close()
@@ -136,8 +142,7 @@ func (h *Handler) handleHTTPRequest(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) connectToTarget(target string) (net.Conn, error) {
 	// Use proxy client's transport if proxy is enabled
 	if h.client.IsProxyEnabled() {
-		transport := h.client.GetClient().Transport.(*http.Transport)
-		return transport.DialContext(context.Background(), "tcp", target)
+		return h.client.transport().DialContext(context.Background(), "tcp", target)
 	}
 
 	// Direct connection
@@ -3,6 +3,7 @@ package proxy
 import (
 	"context"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
@@ -13,7 +14,18 @@ import (
 	"golang.org/x/net/proxy"
 )
 
-// Client wraps an HTTP client with proxy support
+// Per-attempt timeouts of upstream requests. A whole request, its retries and
+// their backoff included, is bounded by the context of the request instead.
+const (
+	dialTimeout           = 30 * time.Second
+	responseHeaderTimeout = 30 * time.Second
+)
+
+// requestTimeout bounds a request made with Get, retries included
+const requestTimeout = 2 * time.Minute
+
+// Client wraps an HTTP client with proxy support, retries and per-host
+// circuit breakers
 type Client struct {
 	httpClient *http.Client
 	config     *config.Config
@@ -39,13 +51,14 @@ func New(cfg *config.Config) (*Client, error) {
 func (c *Client) createHTTPClient() (*http.Client, error) {
 	transport := &http.Transport{
 		DialContext: (&net.Dialer{
-			Timeout:   30 * time.Second,
+			Timeout:   dialTimeout,
 			KeepAlive: 30 * time.Second,
 		}).DialContext,
 		ForceAttemptHTTP2:     true,
 		MaxIdleConns:          100,
 		IdleConnTimeout:       90 * time.Second,
 		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: responseHeaderTimeout,
 		ExpectContinueTimeout: 1 * time.Second,
 	}
 
@@ -59,9 +72,11 @@ func (c *Client) createHTTPClient() (*http.Client, error) {
 		logger.Debugf("Proxy disabled")
 	}
 
+	// Retries and circuit breakers apply to every request, proxied or not.
+	// There is no overall client timeout, which would also cut short the
+	// backoff between retries and large artifact downloads.
 	return &http.Client{
-		Transport: transport,
-		Timeout:   30 * time.Second,
+		Transport: newResilientTransport(transport, c.config.Upstream),
 	}, nil
 }
 
@@ -154,16 +169,53 @@ func (c *Client) configureSOCKS4Proxy(transport *http.Transport, cfg *config.Con
 	return nil
 }
 
-// Get performs an HTTP GET request through the proxy
+// Get performs an HTTP GET request through the proxy, giving up once
+// requestTimeout passed. The caller must close the body.
 func (c *Client) Get(url string) (*http.Response, error) {
-	return c.httpClient.Get(url)
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
 }
 
-// Do performs an HTTP request through the proxy
+// Do performs an HTTP request through the proxy, bounded by the context of
+// req
 func (c *Client) Do(req *http.Request) (*http.Response, error) {
 	return c.httpClient.Do(req)
 }
 
+// cancelOnClose releases the context of a request once its body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// transport returns the transport the retries and circuit breakers wrap
+func (c *Client) transport() *http.Transport {
+	if rt, ok := c.httpClient.Transport.(*resilientTransport); ok {
+		if t, ok := rt.next.(*http.Transport); ok {
+			return t
+		}
+	}
+	t, _ := c.httpClient.Transport.(*http.Transport)
+	return t
+}
+
 // GetClient returns the underlying HTTP client
 func (c *Client) GetClient() *http.Client {
 	return c.httpClient
@@ -4,7 +4,6 @@ import (
 	"net/http"
 	"net/url"
 	"testing"
-	"time"
 
 	"github.com/aliharirian/TerraPeak/config"
 )
@@ -161,9 +160,13 @@ func TestHTTPClientWithProxy(t *testing.T) {
 		t.Error("HTTP client should not be nil")
 	}
 
-	// Test that the client has a timeout
-	if httpClient.Timeout != 30*time.Second {
-		t.Errorf("Expected timeout 30s, got %v", httpClient.Timeout)
+	// Attempts are bounded by the transport; an overall client timeout would
+	// also cut short retries and large downloads
+	if httpClient.Timeout != 0 {
+		t.Errorf("Expected no overall timeout, got %v", httpClient.Timeout)
+	}
+	if transport := client.transport(); transport == nil || transport.ResponseHeaderTimeout != responseHeaderTimeout {
+		t.Errorf("Expected a response header timeout of %s on the transport", responseHeaderTimeout)
 	}
 }
 
@@ -183,7 +186,7 @@ func TestProxyURLGeneration(t *testing.T) {
 
 	// Test that the transport is configured
 	httpClient := client.GetClient()
-	transport := httpClient.Transport.(*http.Transport)
+	transport := httpClient.Transport.(*resilientTransport).next.(*http.Transport)
 
 	if transport.Proxy == nil {
 		t.Error("Transport should have proxy configured")
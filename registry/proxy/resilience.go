@@ -0,0 +1,298 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aliharirian/TerraPeak/config"
+	"github.com/aliharirian/TerraPeak/logger"
+	"github.com/aliharirian/TerraPeak/metrics"
+)
+
+// Defaults for the zero values of config.UpstreamConfig
+const (
+	defaultRetries         = 2
+	defaultRetryBackoff    = 200 * time.Millisecond
+	defaultMaxBackoff      = 10 * time.Second
+	defaultBreakerFailures = 5
+	defaultBreakerCooldown = 30 * time.Second
+)
+
+// ErrCircuitOpen is returned for requests to a host whose circuit breaker is
+// open after repeated failures. Callers with a cached copy serve that instead;
+// RetryAfter tells the others when to try again.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// circuitOpenError is ErrCircuitOpen for one host, until its breaker lets a
+// request through again
+type circuitOpenError struct {
+	host  string
+	until time.Time
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("%v for %s", ErrCircuitOpen, e.host)
+}
+
+func (e *circuitOpenError) Unwrap() error { return ErrCircuitOpen }
+
+// WriteCircuitOpen answers a request that could not be sent upstream because
+// of err with 503 and a Retry-After for the end of the cooldown, when err is
+// a rejection by an open circuit breaker. It reports whether it answered.
+func WriteCircuitOpen(w http.ResponseWriter, err error) bool {
+	var open *circuitOpenError
+	if !errors.As(err, &open) {
+		return false
+	}
+	seconds := int(math.Ceil(time.Until(open.until).Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+	http.Error(w, fmt.Sprintf("Upstream %s is unavailable, try again later", open.host), http.StatusServiceUnavailable)
+	return true
+}
+
+// resilientTransport retries failed GET and HEAD requests with jittered
+// exponential backoff, waits as long as a 429 or 503 asks with Retry-After,
+// and stops sending requests to a host for a while once it failed too often
+// in a row
+type resilientTransport struct {
+	next            http.RoundTripper
+	retries         int
+	backoff         time.Duration
+	maxBackoff      time.Duration
+	breakerFailures int // -1 disables the circuit breakers
+	breakerCooldown time.Duration
+
+	mu       sync.Mutex
+	breakers map[string]*breaker // by upstream host
+}
+
+// newResilientTransport wraps next with the retries and circuit breakers of cfg
+func newResilientTransport(next http.RoundTripper, cfg config.UpstreamConfig) *resilientTransport {
+	t := &resilientTransport{
+		next:            next,
+		retries:         cfg.Retries,
+		backoff:         cfg.RetryBackoff,
+		maxBackoff:      cfg.MaxBackoff,
+		breakerFailures: cfg.BreakerFailures,
+		breakerCooldown: cfg.BreakerCooldown,
+		breakers:        make(map[string]*breaker),
+	}
+	switch {
+	case t.retries == 0:
+		t.retries = defaultRetries
+	case t.retries < 0:
+		t.retries = 0
+	}
+	if t.backoff == 0 {
+		t.backoff = defaultRetryBackoff
+	}
+	if t.maxBackoff == 0 {
+		t.maxBackoff = defaultMaxBackoff
+	}
+	if t.breakerFailures == 0 {
+		t.breakerFailures = defaultBreakerFailures
+	}
+	if t.breakerCooldown == 0 {
+		t.breakerCooldown = defaultBreakerCooldown
+	}
+	return t
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *resilientTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	b := t.breaker(host)
+	retries := t.retries
+	if !isRetryable(req) {
+		retries = 0
+	}
+
+	for attempt := 0; ; attempt++ {
+		if until, ok := b.allow(); !ok {
+			metrics.UpstreamCircuitRejections.Inc(host)
+			return nil, &circuitOpenError{host: host, until: until}
+		}
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+
+		resp, err := t.next.RoundTrip(req)
+		if req.Context().Err() != nil {
+			// The caller gave up, which says nothing about the host
+			return resp, err
+		}
+		b.record(err != nil || isServerFailure(resp.StatusCode))
+
+		if attempt >= retries || (err == nil && !isRetryableStatus(resp.StatusCode)) {
+			return resp, err
+		}
+		delay, ok := t.delay(attempt, resp)
+		if !ok {
+			logger.Warnf("Upstream %s asked to retry after more than %s, not retrying", host, t.maxBackoff)
+			return resp, err
+		}
+
+		reason := fmt.Sprint(err)
+		if resp != nil {
+			reason = resp.Status
+			// Drain the body so the connection can be reused
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+			resp.Body.Close()
+		}
+		logger.Warnf("Upstream %s %s%s failed (%s), retry %d of %d in %s", req.Method, host, req.URL.Path, reason, attempt+1, retries, delay)
+		metrics.UpstreamRetries.Inc(host)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// delay returns how long to wait before retry attempt+1. A Retry-After on a
+// 429 or 503 is honored as is; when it asks for more than maxBackoff the
+// response is passed on instead, reported by ok being false.
+func (t *resilientTransport) delay(attempt int, resp *http.Response) (d time.Duration, ok bool) {
+	if resp != nil && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) {
+		if after, found := retryAfter(resp.Header.Get("Retry-After")); found {
+			return after, after <= t.maxBackoff
+		}
+	}
+
+	d = t.backoff << attempt
+	if d <= 0 || d > t.maxBackoff {
+		d = t.maxBackoff
+	}
+	// Spread retries of concurrent requests between half and all of d
+	return d/2 + rand.N(d/2+1), true
+}
+
+// breaker returns the circuit breaker of host, nil when they are disabled
+func (t *resilientTransport) breaker(host string) *breaker {
+	if t.breakerFailures < 0 {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b, ok := t.breakers[host]
+	if !ok {
+		b = &breaker{host: host, threshold: t.breakerFailures, cooldown: t.breakerCooldown}
+		t.breakers[host] = b
+	}
+	return b
+}
+
+// isRetryable reports whether req may be sent again: GET and HEAD requests
+// whose body, if any, can be replayed
+func isRetryable(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// isRetryableStatus reports whether a response with status is worth retrying
+func isRetryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || isServerFailure(status)
+}
+
+// isServerFailure reports whether status means the upstream host is failing,
+// as opposed to rejecting the request
+func isServerFailure(status int) bool {
+	switch status {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryAfter parses a Retry-After header, in seconds or as an HTTP date
+func retryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(time.Until(at), 0), true
+	}
+	return 0, false
+}
+
+// breaker is the circuit breaker of one upstream host. It opens after
+// threshold failures in a row and then rejects requests for cooldown. After
+// that a single probe request is let through: its success closes the circuit,
+// its failure opens it again.
+type breaker struct {
+	host      string
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int       // consecutive failures
+	openUntil time.Time // end of the cooldown of an open circuit
+	probe     time.Time // start of the probe of a half-open circuit
+}
+
+// allow reports whether a request may be sent to the host now, and if not,
+// until when it is rejected
+func (b *breaker) allow() (until time.Time, ok bool) {
+	if b == nil {
+		return time.Time{}, true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return time.Time{}, true
+	}
+	now := time.Now()
+	if now.Before(b.openUntil) {
+		return b.openUntil, false
+	}
+	// A probe that never reported back, e.g. canceled by its caller, is
+	// replaced after a cooldown
+	if !b.probe.IsZero() && now.Sub(b.probe) < b.cooldown {
+		return b.probe.Add(b.cooldown), false
+	}
+	b.probe = now
+	return time.Time{}, true
+}
+
+// record counts the outcome of a request sent to the host
+func (b *breaker) record(failed bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !failed {
+		if b.failures >= b.threshold {
+			logger.Infof("Upstream %s recovered, closing its circuit breaker", b.host)
+		}
+		b.failures, b.probe = 0, time.Time{}
+		return
+	}
+
+	b.failures++
+	if b.failures == b.threshold || !b.probe.IsZero() {
+		logger.Warnf("Upstream %s failed %d times in a row, opening its circuit breaker for %s", b.host, b.failures, b.cooldown)
+		b.openUntil, b.probe = time.Now().Add(b.cooldown), time.Time{}
+	}
+}
@@ -0,0 +1,233 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aliharirian/TerraPeak/config"
+)
+
+// newTestClient returns a client of cfg with short backoffs
+func newTestClient(t *testing.T, upstream config.UpstreamConfig) *Client {
+	cfg := &config.Config{}
+	cfg.Upstream = upstream
+	if cfg.Upstream.RetryBackoff == 0 {
+		cfg.Upstream.RetryBackoff = time.Millisecond
+	}
+	client, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	return client
+}
+
+// failingServer answers the first failures requests with status, the rest
+// with 200 and "ok"
+func failingServer(t *testing.T, failures int32, status int, header http.Header) (*httptest.Server, *atomic.Int32) {
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) <= failures {
+			for name, values := range header {
+				w.Header()[name] = values
+			}
+			w.WriteHeader(status)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	t.Cleanup(server.Close)
+	return server, &hits
+}
+
+func TestResilientTransport_Retries(t *testing.T) {
+	tests := []struct {
+		name         string
+		method       string
+		failures     int32
+		status       int
+		retries      int
+		expectedCode int
+		expectedHits int32
+	}{
+		{"recovers from a 502", http.MethodGet, 2, http.StatusBadGateway, 0, http.StatusOK, 3},
+		{"recovers from a 429", http.MethodGet, 1, http.StatusTooManyRequests, 0, http.StatusOK, 2},
+		{"gives up after the retries", http.MethodGet, 5, http.StatusServiceUnavailable, 0, http.StatusServiceUnavailable, 3},
+		{"retries disabled", http.MethodGet, 1, http.StatusBadGateway, -1, http.StatusBadGateway, 1},
+		{"client errors are not retried", http.MethodGet, 1, http.StatusNotFound, 0, http.StatusNotFound, 1},
+		{"POST is not retried", http.MethodPost, 1, http.StatusBadGateway, 0, http.StatusBadGateway, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, hits := failingServer(t, tt.failures, tt.status, nil)
+			client := newTestClient(t, config.UpstreamConfig{Retries: tt.retries, BreakerFailures: -1})
+
+			req, _ := http.NewRequest(tt.method, server.URL, strings.NewReader(""))
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("Do() error = %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.expectedCode {
+				t.Errorf("Expected status %d, got %d", tt.expectedCode, resp.StatusCode)
+			}
+			if hits.Load() != tt.expectedHits {
+				t.Errorf("Expected %d upstream requests, got %d", tt.expectedHits, hits.Load())
+			}
+		})
+	}
+}
+
+func TestResilientTransport_RetryAfter(t *testing.T) {
+	t.Run("waits as asked", func(t *testing.T) {
+		server, hits := failingServer(t, 1, http.StatusServiceUnavailable, http.Header{"Retry-After": {"1"}})
+		client := newTestClient(t, config.UpstreamConfig{MaxBackoff: 2 * time.Second})
+
+		start := time.Now()
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("Get() error = %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || hits.Load() != 2 {
+			t.Errorf("Expected 200 after 2 requests, got %d after %d", resp.StatusCode, hits.Load())
+		}
+		if elapsed := time.Since(start); elapsed < time.Second {
+			t.Errorf("Expected the retry after at least 1s, got %s", elapsed)
+		}
+	})
+
+	t.Run("longer than max_backoff is passed on", func(t *testing.T) {
+		server, hits := failingServer(t, 1, http.StatusTooManyRequests, http.Header{"Retry-After": {"120"}})
+		client := newTestClient(t, config.UpstreamConfig{MaxBackoff: time.Second})
+
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("Get() error = %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusTooManyRequests || hits.Load() != 1 {
+			t.Errorf("Expected the 429 without retries, got %d after %d requests", resp.StatusCode, hits.Load())
+		}
+		if resp.Header.Get("Retry-After") != "120" {
+			t.Errorf("Expected Retry-After passed on, got %q", resp.Header.Get("Retry-After"))
+		}
+	})
+}
+
+func TestResilientTransport_CircuitBreaker(t *testing.T) {
+	var down atomic.Bool
+	down.Store(true)
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if down.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	cooldown := 100 * time.Millisecond
+	client := newTestClient(t, config.UpstreamConfig{Retries: -1, BreakerFailures: 3, BreakerCooldown: cooldown})
+	get := func() (int, error) {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			return 0, err
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body)
+		return resp.StatusCode, nil
+	}
+
+	for i := 0; i < 3; i++ {
+		if status, err := get(); err != nil || status != http.StatusBadGateway {
+			t.Fatalf("Expected request %d to reach upstream, got %d, %v", i+1, status, err)
+		}
+	}
+	if _, err := get(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Expected ErrCircuitOpen once the breaker opened, got %v", err)
+	}
+	if hits.Load() != 3 {
+		t.Errorf("Expected an open circuit to keep requests from upstream, got %d requests", hits.Load())
+	}
+
+	// After the cooldown a failed probe opens the circuit again
+	time.Sleep(cooldown + 20*time.Millisecond)
+	if status, err := get(); err != nil || status != http.StatusBadGateway {
+		t.Fatalf("Expected the probe to reach upstream, got %d, %v", status, err)
+	}
+	if _, err := get(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Expected a failed probe to open the circuit again, got %v", err)
+	}
+
+	// A successful probe closes it
+	down.Store(false)
+	time.Sleep(cooldown + 20*time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if status, err := get(); err != nil || status != http.StatusOK {
+			t.Fatalf("Expected the circuit closed after a successful probe, got %d, %v", status, err)
+		}
+	}
+}
+
+func TestResilientTransport_AttemptTimeout(t *testing.T) {
+	// The first attempt hangs; its header timeout fails only that attempt,
+	// and the retry gets the answer
+	var hits atomic.Int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) == 1 {
+			<-release
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	defer close(release)
+
+	client := newTestClient(t, config.UpstreamConfig{})
+	client.transport().ResponseHeaderTimeout = 100 * time.Millisecond
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Expected the retry to succeed, got %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || hits.Load() != 2 {
+		t.Errorf("Expected 200 after 2 requests, got %d after %d", resp.StatusCode, hits.Load())
+	}
+}
+
+func TestHTTPProxyCircuitBreaker(t *testing.T) {
+	server, hits := failingServer(t, 100, http.StatusBadGateway, nil)
+	cfg := &config.Config{}
+	cfg.Upstream = config.UpstreamConfig{Retries: -1, BreakerFailures: 1, BreakerCooldown: time.Minute}
+	handler, err := NewHandler(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+
+	// Passthrough requests count towards the breaker of their target host
+	// and are rejected while it is open
+	for i, expected := range []int{http.StatusBadGateway, http.StatusServiceUnavailable} {
+		w := httptest.NewRecorder()
+		handler.HandleHTTPProxy(w, httptest.NewRequest(http.MethodGet, server.URL+"/file", nil))
+		if w.Code != expected {
+			t.Errorf("Request %d: expected status %d, got %d", i+1, expected, w.Code)
+		}
+		if expected == http.StatusServiceUnavailable && w.Header().Get("Retry-After") == "" {
+			t.Errorf("Request %d: expected a Retry-After for the end of the cooldown", i+1)
+		}
+	}
+	if hits.Load() != 1 {
+		t.Errorf("Expected the open circuit to keep the request from upstream, got %d requests", hits.Load())
+	}
+}
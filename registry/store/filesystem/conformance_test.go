@@ -0,0 +1,22 @@
+package filesystem_test
+
+import (
+	"testing"
+
+	"github.com/aliharirian/TerraPeak/config"
+	"github.com/aliharirian/TerraPeak/store"
+	"github.com/aliharirian/TerraPeak/store/filesystem"
+	"github.com/aliharirian/TerraPeak/store/storetest"
+)
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Storage {
+		cfg := &config.Config{}
+		cfg.Storage.File.Path = t.TempDir()
+		storage, err := filesystem.New(cfg)
+		if err != nil {
+			t.Fatalf("Failed to create storage: %v", err)
+		}
+		return storage
+	})
+}
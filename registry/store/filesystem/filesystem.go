@@ -1,19 +1,42 @@
 package filesystem
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/aliharirian/TerraPeak/config"
 	"github.com/aliharirian/TerraPeak/logger"
+	"github.com/aliharirian/TerraPeak/store/metadata"
 )
 
+// tempMarker is part of the name of every temporary file a write in
+// progress uses, e.g. ".provider.zip.tmp-123456"
+const tempMarker = ".tmp-"
+
+// orphanAge is how old a temporary file must be to be removed at startup.
+// Younger ones may belong to another instance sharing the directory.
+const orphanAge = time.Hour
+
+// errOutsideRoot rejects keys that resolve outside of the storage root
+var errOutsideRoot = errors.New("key is outside of the storage root")
+
+// errSizeMismatch fails writes that did not get the announced number of bytes
+var errSizeMismatch = errors.New("size mismatch")
+
 // Storage implements local filesystem storage backend
 type Storage struct {
 	basePath string
+	lru      *lru // nil when the size is not limited
 }
 
 // New creates a new filesystem storage instance
@@ -31,14 +54,72 @@ func New(cfg *config.Config) (*Storage, error) {
 		return nil, err
 	}
 
+	removeOrphanedTemps(basePath)
+
+	storage := &Storage{basePath: basePath}
+	if maxSize := int64(cfg.Storage.File.MaxSize); maxSize > 0 {
+		// Verification expectations are always pinned
+		pinned := append([]string{metadata.VerificationPrefix}, cfg.Storage.File.Pinned...)
+		index, err := newLRU(basePath, maxSize, int64(cfg.Storage.File.LowWatermark), pinned)
+		if err != nil {
+			logger.Errorf("Failed to index %s: %v", basePath, err)
+			return nil, err
+		}
+		storage.lru = index
+		if index.total > maxSize {
+			index.evicting = true
+			index.evict("")
+		}
+	}
+
 	logger.Infof("FileSystem storage initialized successfully")
-	return &Storage{basePath: basePath}, nil
+	return storage, nil
+}
+
+// removeOrphanedTemps deletes the temporary files of writes that never
+// completed, e.g. because the process crashed while downloading
+func removeOrphanedTemps(basePath string) {
+	removed := 0
+	filepath.WalkDir(basePath, func(fullPath string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !isTempFile(d.Name()) {
+			return nil
+		}
+		if info, err := d.Info(); err != nil || time.Since(info.ModTime()) < orphanAge {
+			return nil
+		}
+		if err := os.Remove(fullPath); err != nil {
+			logger.Warnf("Failed to remove orphaned temporary file %s: %v", fullPath, err)
+			return nil
+		}
+		removed++
+		return nil
+	})
+	if removed > 0 {
+		logger.Infof("Removed %d orphaned temporary files from %s", removed, basePath)
+	}
+}
+
+// isTempFile reports whether name is the temporary file of a write
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.Contains(name, tempMarker)
+}
+
+// fullPath maps a key to its file below the storage root, rejecting keys
+// that would end up outside of it
+func (s *Storage) fullPath(filePath string) (string, error) {
+	if !filepath.IsLocal(filepath.FromSlash(filePath)) {
+		return "", fmt.Errorf("%w: %q", errOutsideRoot, filePath)
+	}
+	return filepath.Join(s.basePath, filePath), nil
 }
 
 // Exists checks if file exists in filesystem
-func (s *Storage) Exists(filePath string) bool {
-	fullPath := filepath.Join(s.basePath, filePath)
-	_, err := os.Stat(fullPath)
+func (s *Storage) Exists(ctx context.Context, filePath string) bool {
+	fullPath, err := s.fullPath(filePath)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(fullPath)
 	if err != nil {
 		logger.Debugf("File %s not found in filesystem: %v", filePath, err)
 		return false
@@ -48,8 +129,14 @@ func (s *Storage) Exists(filePath string) bool {
 }
 
 // Read reads file from filesystem
-func (s *Storage) Read(filePath string) ([]byte, error) {
-	fullPath := filepath.Join(s.basePath, filePath)
+func (s *Storage) Read(ctx context.Context, filePath string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	fullPath, err := s.fullPath(filePath)
+	if err != nil {
+		return nil, err
+	}
 	logger.Debugf("Reading file %s from filesystem", fullPath)
 
 	data, err := os.ReadFile(fullPath)
@@ -57,14 +144,21 @@ func (s *Storage) Read(filePath string) ([]byte, error) {
 		logger.Errorf("Failed to read file from filesystem: %v", err)
 		return nil, err
 	}
+	s.lru.touch(filePath)
 
 	logger.Infof("Successfully read file %s from filesystem (%d bytes)", filePath, len(data))
 	return data, nil
 }
 
 // Write writes file to filesystem
-func (s *Storage) Write(filePath string, data []byte) error {
-	fullPath := filepath.Join(s.basePath, filePath)
+func (s *Storage) Write(ctx context.Context, filePath string, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	fullPath, err := s.fullPath(filePath)
+	if err != nil {
+		return err
+	}
 	logger.Debugf("Writing %s to filesystem at %s", filePath, fullPath)
 
 	// Ensure directory exists
@@ -73,7 +167,7 @@ func (s *Storage) Write(filePath string, data []byte) error {
 		return err
 	}
 
-	if err := os.WriteFile(fullPath, data, 0644); err != nil {
+	if _, err := s.writeObject(filePath, fullPath, bytes.NewReader(data), int64(len(data))); err != nil {
 		logger.Errorf("Failed to write file %s: %v", fullPath, err)
 		return err
 	}
@@ -82,9 +176,15 @@ func (s *Storage) Write(filePath string, data []byte) error {
 	return nil
 }
 
-// StreamWrite streams data to filesystem
-func (s *Storage) StreamWrite(filePath string, reader io.Reader, size int64) error {
-	fullPath := filepath.Join(s.basePath, filePath)
+// StreamWrite streams data to filesystem. The data goes to a temporary file
+// that replaces filePath only once reader is exhausted, so a failed stream
+// never leaves a partial file behind. Canceling ctx stops the stream, and a
+// stream that does not deliver size bytes (when size >= 0) is discarded.
+func (s *Storage) StreamWrite(ctx context.Context, filePath string, reader io.Reader, size int64) error {
+	fullPath, err := s.fullPath(filePath)
+	if err != nil {
+		return err
+	}
 	logger.Debugf("Streaming %s to filesystem at %s", filePath, fullPath)
 
 	// Ensure directory exists
@@ -93,28 +193,114 @@ func (s *Storage) StreamWrite(filePath string, reader io.Reader, size int64) err
 		return err
 	}
 
-	// Create file
-	file, err := os.Create(fullPath)
+	bytesWritten, err := s.writeObject(filePath, fullPath, &contextReader{ctx: ctx, r: reader}, size)
 	if err != nil {
-		logger.Errorf("Failed to create file %s: %v", fullPath, err)
+		logger.Errorf("Failed to stream to file %s: %v", fullPath, err)
 		return err
 	}
-	defer file.Close()
 
-	// Stream to file
+	logger.Infof("Successfully streamed %s to filesystem (%d bytes)", filePath, bytesWritten)
+	return nil
+}
+
+// writeObject writes the file of key atomically, putting it in place under
+// the key's eviction guard
+func (s *Storage) writeObject(key, fullPath string, reader io.Reader, size int64) (int64, error) {
+	tmpPath, bytesWritten, err := stageFile(fullPath, reader, size)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.lru.replace(key, func() error { return commitFile(tmpPath, fullPath) }); err != nil {
+		return 0, err
+	}
+	return bytesWritten, nil
+}
+
+// writeFileAtomic writes reader to a temporary file next to fullPath and
+// renames it into place once complete and synced to disk, so a crash leaves
+// either the previous file or the new one. The write fails when size >= 0
+// and reader delivered another number of bytes.
+func writeFileAtomic(fullPath string, reader io.Reader, size int64) (int64, error) {
+	tmpPath, bytesWritten, err := stageFile(fullPath, reader, size)
+	if err != nil {
+		return 0, err
+	}
+	return bytesWritten, commitFile(tmpPath, fullPath)
+}
+
+// stageFile writes reader to a temporary file next to fullPath, synced to
+// disk and ready to be renamed into place by commitFile
+func stageFile(fullPath string, reader io.Reader, size int64) (string, int64, error) {
+	dir, pattern := filepath.Dir(fullPath), "."+filepath.Base(fullPath)+tempMarker+"*"
+	file, err := os.CreateTemp(dir, pattern)
+	if errors.Is(err, fs.ErrNotExist) {
+		// An eviction may have pruned the directory since it was created
+		if err = os.MkdirAll(dir, 0755); err == nil {
+			file, err = os.CreateTemp(dir, pattern)
+		}
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	tmpPath := file.Name()
+
 	bytesWritten, err := io.Copy(file, reader)
+	if err == nil && size >= 0 && bytesWritten != size {
+		err = fmt.Errorf("%w: got %d of %d bytes", errSizeMismatch, bytesWritten, size)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpPath, 0644)
+	}
 	if err != nil {
-		logger.Errorf("Failed to stream to file %s: %v", fullPath, err)
+		os.Remove(tmpPath)
+		return "", 0, err
+	}
+	return tmpPath, bytesWritten, nil
+}
+
+// commitFile renames a file staged by stageFile into place
+func commitFile(tmpPath, fullPath string) error {
+	if err := os.Rename(tmpPath, fullPath); err != nil {
+		os.Remove(tmpPath)
 		return err
 	}
 
-	logger.Infof("Successfully streamed %s to filesystem (%d bytes)", filePath, bytesWritten)
+	// Persist the rename itself; not every platform can sync a directory
+	if dir, err := os.Open(filepath.Dir(fullPath)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
 	return nil
 }
 
+// contextReader fails reads once ctx is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
 // StreamRead streams data from filesystem
-func (s *Storage) StreamRead(filePath string) (io.ReadCloser, error) {
-	fullPath := filepath.Join(s.basePath, filePath)
+func (s *Storage) StreamRead(ctx context.Context, filePath string) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	fullPath, err := s.fullPath(filePath)
+	if err != nil {
+		return nil, err
+	}
 	logger.Debugf("Opening stream for file %s from filesystem", fullPath)
 
 	file, err := os.Open(fullPath)
@@ -122,26 +308,30 @@ func (s *Storage) StreamRead(filePath string) (io.ReadCloser, error) {
 		logger.Errorf("Failed to open file %s: %v", fullPath, err)
 		return nil, err
 	}
+	s.lru.touch(filePath)
 
 	logger.Debugf("Successfully opened stream for file %s", filePath)
 	return file, nil
 }
 
-// SaveMetadata saves metadata to filesystem
-func (s *Storage) SaveMetadata(filePath, md5Sum, sha256Sum string, size int64) error {
-	fullPath := filepath.Join(s.basePath, filePath)
+// SaveMetadata saves the metadata record of filePath to filesystem, replacing
+// the previous record atomically
+func (s *Storage) SaveMetadata(ctx context.Context, filePath string, record *metadata.Record) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	fullPath, err := s.fullPath(filePath)
+	if err != nil {
+		return err
+	}
 
-	metadata := fmt.Sprintf(`{
-  "file": "%s",
-  "timestamp": "%s",
-  "size": %d,
-  "md5": "%s",
-  "sha256": "%s",
-  "status": "success"
-}`, filepath.Base(fullPath), time.Now().Format(time.RFC3339), size, md5Sum, sha256Sum)
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
 
-	metadataPath := fullPath + ".metadata.json"
-	err := os.WriteFile(metadataPath, []byte(metadata), 0644)
+	metadataPath := fullPath + metadata.Suffix
+	metadataTmp, _, err := stageFile(metadataPath, bytes.NewReader(data), int64(len(data)))
 	if err != nil {
 		return err
 	}
@@ -149,13 +339,165 @@ func (s *Storage) SaveMetadata(filePath, md5Sum, sha256Sum string, size int64) e
 	// Also create a simple success tag file
 	successTagPath := fullPath + ".success"
 	successTag := fmt.Sprintf("File successfully saved at %s\nMD5: %s\nSHA256: %s",
-		time.Now().Format(time.RFC3339), md5Sum, sha256Sum)
+		time.Now().Format(time.RFC3339), record.MD5, record.SHA256)
 
-	err = os.WriteFile(successTagPath, []byte(successTag), 0644)
+	successTmp, _, err := stageFile(successTagPath, strings.NewReader(successTag), int64(len(successTag)))
 	if err != nil {
 		logger.Warnf("Failed to create success tag: %v", err)
 	}
 
+	err = s.lru.replace(filePath, func() error {
+		if err := commitFile(metadataTmp, metadataPath); err != nil {
+			if successTmp != "" {
+				os.Remove(successTmp)
+			}
+			return err
+		}
+		if successTmp != "" {
+			if err := commitFile(successTmp, successTagPath); err != nil {
+				logger.Warnf("Failed to create success tag: %v", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
 	logger.Debugf("Metadata and success tag saved: %s", metadataPath)
 	return nil
 }
+
+// Stat returns the size and modification time of a file in filesystem
+func (s *Storage) Stat(ctx context.Context, filePath string) (*metadata.ObjectInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	fullPath, err := s.fullPath(filePath)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	return &metadata.ObjectInfo{Key: filePath, Size: info.Size(), Modified: info.ModTime()}, nil
+}
+
+// Delete removes a file from filesystem
+func (s *Storage) Delete(ctx context.Context, filePath string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	fullPath, err := s.fullPath(filePath)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(fullPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		logger.Errorf("Failed to delete file %s: %v", fullPath, err)
+		return err
+	}
+	s.lru.deleted(filePath)
+
+	logger.Infof("Deleted %s from filesystem", filePath)
+	return nil
+}
+
+// errPageFull stops a listing once its page is complete
+var errPageFull = errors.New("page full")
+
+// List returns the page of keys starting with prefix after startAfter. The
+// tree is walked in key order, so a page skips the directories before
+// startAfter and stops reading once it is full.
+func (s *Storage) List(ctx context.Context, prefix, startAfter string, limit int) ([]string, error) {
+	infos, err := s.ListInfo(ctx, prefix, startAfter, limit)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, len(infos))
+	for i, info := range infos {
+		keys[i] = info.Key
+	}
+	return keys, nil
+}
+
+// ListInfo is List with the size and modification time of every key, taken
+// from the directory entries it walks
+func (s *Storage) ListInfo(ctx context.Context, prefix, startAfter string, limit int) ([]metadata.ObjectInfo, error) {
+	// Only walk the deepest directory the prefix is certain to be inside
+	dir := ""
+	if i := strings.LastIndex(prefix, "/"); i > 0 {
+		if _, err := s.fullPath(prefix[:i]); err != nil {
+			return nil, err
+		}
+		dir = prefix[:i]
+	}
+
+	var infos []metadata.ObjectInfo
+	if err := s.listDir(ctx, dir, prefix, startAfter, limit, &infos); err != nil && !errors.Is(err, errPageFull) {
+		logger.Errorf("Failed to list %s in filesystem: %v", prefix, err)
+		return nil, err
+	}
+	logger.Debugf("Listed %d files with prefix %s in filesystem", len(infos), prefix)
+	return infos, nil
+}
+
+// listDir appends the keys below dir, a key or "" for the root, that start
+// with prefix and sort after startAfter to infos, in sorted order. It
+// returns errPageFull once infos holds limit keys.
+func (s *Storage) listDir(ctx context.Context, dir, prefix, startAfter string, limit int, infos *[]metadata.ObjectInfo) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(filepath.Join(s.basePath, filepath.FromSlash(dir)))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	// The keys of a directory sort like its name followed by "/"
+	base := ""
+	if dir != "" {
+		base = dir + "/"
+	}
+	entryKey := func(entry fs.DirEntry) string {
+		if entry.IsDir() {
+			return base + entry.Name() + "/"
+		}
+		return base + entry.Name()
+	}
+	sort.Slice(entries, func(i, j int) bool { return entryKey(entries[i]) < entryKey(entries[j]) })
+
+	for _, entry := range entries {
+		key := entryKey(entry)
+		if entry.IsDir() {
+			before := key <= startAfter && !strings.HasPrefix(startAfter, key)
+			outside := !strings.HasPrefix(key, prefix) && !strings.HasPrefix(prefix, key)
+			if before || outside {
+				continue
+			}
+			if err := s.listDir(ctx, strings.TrimSuffix(key, "/"), prefix, startAfter, limit, infos); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if isInternalFile(entry.Name()) || key <= startAfter || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		info, err := entry.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			// Removed since the directory was read
+			continue
+		} else if err != nil {
+			return err
+		}
+		*infos = append(*infos, metadata.ObjectInfo{Key: key, Size: info.Size(), Modified: info.ModTime()})
+		if limit > 0 && len(*infos) == limit {
+			return errPageFull
+		}
+	}
+	return nil
+}
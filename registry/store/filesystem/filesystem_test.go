@@ -2,13 +2,18 @@ package filesystem
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/aliharirian/TerraPeak/config"
+	"github.com/aliharirian/TerraPeak/store/metadata"
 )
 
 // setupTestStorage creates a temporary storage instance for testing
@@ -117,17 +122,17 @@ func TestExists(t *testing.T) {
 		// Create a test file
 		testPath := "test/file.txt"
 		data := []byte("test content")
-		if err := storage.Write(testPath, data); err != nil {
+		if err := storage.Write(context.Background(), testPath, data); err != nil {
 			t.Fatalf("Failed to write test file: %v", err)
 		}
 
-		if !storage.Exists(testPath) {
+		if !storage.Exists(context.Background(), testPath) {
 			t.Error("Exists() = false, want true for existing file")
 		}
 	})
 
 	t.Run("file_not_exists", func(t *testing.T) {
-		if storage.Exists("nonexistent/file.txt") {
+		if storage.Exists(context.Background(), "nonexistent/file.txt") {
 			t.Error("Exists() = true, want false for nonexistent file")
 		}
 	})
@@ -141,7 +146,7 @@ func TestWrite(t *testing.T) {
 		testPath := "test/write.txt"
 		testData := []byte("test write content")
 
-		err := storage.Write(testPath, testData)
+		err := storage.Write(context.Background(), testPath, testData)
 		if err != nil {
 			t.Errorf("Write() error = %v, want nil", err)
 		}
@@ -161,7 +166,7 @@ func TestWrite(t *testing.T) {
 		testPath := "deep/nested/path/file.txt"
 		testData := []byte("nested content")
 
-		err := storage.Write(testPath, testData)
+		err := storage.Write(context.Background(), testPath, testData)
 		if err != nil {
 			t.Errorf("Write() error = %v, want nil", err)
 		}
@@ -179,12 +184,12 @@ func TestWrite(t *testing.T) {
 		newData := []byte("updated")
 
 		// Write original
-		if err := storage.Write(testPath, originalData); err != nil {
+		if err := storage.Write(context.Background(), testPath, originalData); err != nil {
 			t.Fatalf("Failed to write original: %v", err)
 		}
 
 		// Overwrite
-		if err := storage.Write(testPath, newData); err != nil {
+		if err := storage.Write(context.Background(), testPath, newData); err != nil {
 			t.Errorf("Write() error = %v, want nil", err)
 		}
 
@@ -209,12 +214,12 @@ func TestRead(t *testing.T) {
 		testData := []byte("test read content")
 
 		// Write file first
-		if err := storage.Write(testPath, testData); err != nil {
+		if err := storage.Write(context.Background(), testPath, testData); err != nil {
 			t.Fatalf("Failed to write test file: %v", err)
 		}
 
 		// Read it back
-		data, err := storage.Read(testPath)
+		data, err := storage.Read(context.Background(), testPath)
 		if err != nil {
 			t.Errorf("Read() error = %v, want nil", err)
 		}
@@ -224,7 +229,7 @@ func TestRead(t *testing.T) {
 	})
 
 	t.Run("file_not_found", func(t *testing.T) {
-		_, err := storage.Read("nonexistent/file.txt")
+		_, err := storage.Read(context.Background(), "nonexistent/file.txt")
 		if err == nil {
 			t.Error("Read() error = nil, want error for nonexistent file")
 		}
@@ -240,7 +245,7 @@ func TestStreamWrite(t *testing.T) {
 		testData := []byte("stream write content")
 		reader := bytes.NewReader(testData)
 
-		err := storage.StreamWrite(testPath, reader, int64(len(testData)))
+		err := storage.StreamWrite(context.Background(), testPath, reader, int64(len(testData)))
 		if err != nil {
 			t.Errorf("StreamWrite() error = %v, want nil", err)
 		}
@@ -262,7 +267,7 @@ func TestStreamWrite(t *testing.T) {
 		testData := bytes.Repeat([]byte("A"), 1024*1024)
 		reader := bytes.NewReader(testData)
 
-		err := storage.StreamWrite(testPath, reader, int64(len(testData)))
+		err := storage.StreamWrite(context.Background(), testPath, reader, int64(len(testData)))
 		if err != nil {
 			t.Errorf("StreamWrite() error = %v, want nil", err)
 		}
@@ -277,6 +282,79 @@ func TestStreamWrite(t *testing.T) {
 			t.Errorf("File size = %d, want %d", stat.Size(), len(testData))
 		}
 	})
+
+	t.Run("failed_stream_leaves_nothing", func(t *testing.T) {
+		testPath := "test/broken-stream.bin"
+		reader := io.MultiReader(bytes.NewReader([]byte("partial")), iotest.ErrReader(io.ErrUnexpectedEOF))
+
+		if err := storage.StreamWrite(context.Background(), testPath, reader, 100); err == nil {
+			t.Error("StreamWrite() error = nil, want the reader's error")
+		}
+
+		entries, err := os.ReadDir(filepath.Join(tempDir, "test"))
+		if err != nil {
+			t.Fatalf("Failed to read directory: %v", err)
+		}
+		for _, entry := range entries {
+			if strings.Contains(entry.Name(), "broken-stream") {
+				t.Errorf("Failed stream left %s behind", entry.Name())
+			}
+		}
+	})
+
+	t.Run("short_stream_is_discarded", func(t *testing.T) {
+		testPath := "test/short-stream.bin"
+		if err := storage.Write(context.Background(), testPath, []byte("previous")); err != nil {
+			t.Fatalf("Failed to write test file: %v", err)
+		}
+
+		err := storage.StreamWrite(context.Background(), testPath, strings.NewReader("truncated"), 100)
+		if !errors.Is(err, errSizeMismatch) {
+			t.Errorf("StreamWrite() error = %v, want %v", err, errSizeMismatch)
+		}
+		data, err := storage.Read(context.Background(), testPath)
+		if err != nil || string(data) != "previous" {
+			t.Errorf("Read() = %q, %v, want the previous content kept", data, err)
+		}
+	})
+}
+
+func TestRemoveOrphanedTemps(t *testing.T) {
+	tempDir := t.TempDir()
+	dir := filepath.Join(tempDir, "releases.hashicorp.com")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+
+	orphan := filepath.Join(dir, ".provider.zip.tmp-123")
+	recent := filepath.Join(dir, ".other.zip.tmp-456")
+	object := filepath.Join(dir, "provider.zip")
+	for _, path := range []string{orphan, recent, object} {
+		if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", path, err)
+		}
+	}
+	old := time.Now().Add(-2 * orphanAge)
+	for _, path := range []string{orphan, object} {
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatalf("Failed to age %s: %v", path, err)
+		}
+	}
+
+	cfg := &config.Config{}
+	cfg.Storage.File.Path = tempDir
+	if _, err := New(cfg); err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Error("Expected the orphaned temporary file to be removed")
+	}
+	for _, path := range []string{recent, object} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("Expected %s to be kept: %v", filepath.Base(path), err)
+		}
+	}
 }
 
 func TestStreamRead(t *testing.T) {
@@ -288,12 +366,12 @@ func TestStreamRead(t *testing.T) {
 		testData := []byte("stream read content")
 
 		// Write file first
-		if err := storage.Write(testPath, testData); err != nil {
+		if err := storage.Write(context.Background(), testPath, testData); err != nil {
 			t.Fatalf("Failed to write test file: %v", err)
 		}
 
 		// Stream read
-		reader, err := storage.StreamRead(testPath)
+		reader, err := storage.StreamRead(context.Background(), testPath)
 		if err != nil {
 			t.Errorf("StreamRead() error = %v, want nil", err)
 		}
@@ -310,7 +388,7 @@ func TestStreamRead(t *testing.T) {
 	})
 
 	t.Run("file_not_found", func(t *testing.T) {
-		_, err := storage.StreamRead("nonexistent/file.txt")
+		_, err := storage.StreamRead(context.Background(), "nonexistent/file.txt")
 		if err == nil {
 			t.Error("StreamRead() error = nil, want error for nonexistent file")
 		}
@@ -321,11 +399,11 @@ func TestStreamRead(t *testing.T) {
 		// Create 2MB of data
 		testData := bytes.Repeat([]byte("B"), 2*1024*1024)
 
-		if err := storage.Write(testPath, testData); err != nil {
+		if err := storage.Write(context.Background(), testPath, testData); err != nil {
 			t.Fatalf("Failed to write test file: %v", err)
 		}
 
-		reader, err := storage.StreamRead(testPath)
+		reader, err := storage.StreamRead(context.Background(), testPath)
 		if err != nil {
 			t.Errorf("StreamRead() error = %v, want nil", err)
 		}
@@ -364,12 +442,12 @@ func TestSaveMetadata(t *testing.T) {
 		size := int64(len(testData))
 
 		// Write file first
-		if err := storage.Write(testPath, testData); err != nil {
+		if err := storage.Write(context.Background(), testPath, testData); err != nil {
 			t.Fatalf("Failed to write test file: %v", err)
 		}
 
 		// Save metadata
-		err := storage.SaveMetadata(testPath, md5Sum, sha256Sum, size)
+		err := storage.SaveMetadata(context.Background(), testPath, &metadata.Record{MD5: md5Sum, SHA256: sha256Sum, Size: size, Status: "success"})
 		if err != nil {
 			t.Errorf("SaveMetadata() error = %v, want nil", err)
 		}
@@ -423,11 +501,11 @@ func TestSaveMetadata(t *testing.T) {
 		size := int64(100)
 
 		// Write file first
-		if err := storage.Write(testPath, []byte("test")); err != nil {
+		if err := storage.Write(context.Background(), testPath, []byte("test")); err != nil {
 			t.Fatalf("Failed to write test file: %v", err)
 		}
 
-		err := storage.SaveMetadata(testPath, md5Sum, sha256Sum, size)
+		err := storage.SaveMetadata(context.Background(), testPath, &metadata.Record{MD5: md5Sum, SHA256: sha256Sum, Size: size, Status: "success"})
 		if err != nil {
 			t.Errorf("SaveMetadata() error = %v, want nil", err)
 		}
@@ -440,6 +518,189 @@ func TestSaveMetadata(t *testing.T) {
 	})
 }
 
+// waitForEviction waits for the eviction run a write started in the
+// background to finish
+func waitForEviction(t *testing.T, storage *Storage) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		storage.lru.mu.Lock()
+		evicting := storage.lru.evicting
+		storage.lru.mu.Unlock()
+		if !evicting {
+			return
+		}
+	}
+	t.Fatal("Eviction did not finish")
+}
+
+func TestEviction(t *testing.T) {
+	tempDir := t.TempDir()
+	newStorage := func(maxSize, lowWatermark config.ByteSize) *Storage {
+		t.Helper()
+		cfg := &config.Config{}
+		cfg.Storage.File.Path = tempDir
+		cfg.Storage.File.MaxSize = maxSize
+		cfg.Storage.File.LowWatermark = lowWatermark
+		cfg.Storage.File.Pinned = []string{"registry/"}
+		storage, err := New(cfg)
+		if err != nil {
+			t.Fatalf("Failed to create storage: %v", err)
+		}
+		return storage
+	}
+	data := bytes.Repeat([]byte("x"), 1000)
+
+	storage := newStorage(4000, 3500)
+	for _, key := range []string{"registry/pinned", "hosts/b", "hosts/a"} {
+		if err := storage.Write(context.Background(), key, data); err != nil {
+			t.Fatalf("Failed to write %s: %v", key, err)
+		}
+	}
+	if err := storage.SaveMetadata(context.Background(), "hosts/b", &metadata.Record{Size: 1000, Status: "success"}); err != nil {
+		t.Fatalf("Failed to save metadata: %v", err)
+	}
+	// Reading makes hosts/a recently used; hosts/b was last used when its metadata was saved
+	if _, err := storage.Read(context.Background(), "hosts/a"); err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if err := storage.Write(context.Background(), "hosts/c", data); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	waitForEviction(t, storage)
+
+	expected := map[string]bool{
+		"registry/pinned":        true,
+		"hosts/a":                true,
+		"hosts/c":                true,
+		"hosts/b":                false,
+		"hosts/b.metadata.json":  false,
+		"hosts/b.success":        false,
+		".terrapeak-access.json": true,
+	}
+	for key, exists := range expected {
+		if storage.Exists(context.Background(), key) != exists {
+			t.Errorf("Expected Exists(%s) = %v after eviction", key, exists)
+		}
+	}
+
+	keys, err := storage.List(context.Background(), "", "", 0)
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if strings.Join(keys, ",") != "hosts/a,hosts/c,registry/pinned" {
+		t.Errorf("Expected the access index to stay out of listings, got %v", keys)
+	}
+
+	t.Run("evicts on startup", func(t *testing.T) {
+		storage := newStorage(2500, 2000)
+		if storage.Exists(context.Background(), "hosts/a") {
+			t.Error("Expected the least recently used object to be evicted")
+		}
+		if !storage.Exists(context.Background(), "hosts/c") || !storage.Exists(context.Background(), "registry/pinned") {
+			t.Error("Expected the recent and pinned objects to be kept")
+		}
+	})
+
+	t.Run("pinned objects are never evicted", func(t *testing.T) {
+		storage := newStorage(500, 100)
+		if !storage.Exists(context.Background(), "registry/pinned") {
+			t.Error("Expected the pinned object to be kept")
+		}
+		if storage.Exists(context.Background(), "hosts/c") {
+			t.Error("Expected every unpinned object to be evicted")
+		}
+		if _, err := os.Stat(filepath.Join(tempDir, "hosts")); !os.IsNotExist(err) {
+			t.Errorf("Expected the emptied directory to be removed, got %v", err)
+		}
+	})
+
+	t.Run("verification expectations are never evicted", func(t *testing.T) {
+		storage := newStorage(2500, 1500)
+		key := metadata.VerificationPrefix + "hosts/a.zip.json"
+		for _, k := range []string{key, "hosts/d", "hosts/e"} {
+			if err := storage.Write(context.Background(), k, data); err != nil {
+				t.Fatalf("Failed to write %s: %v", k, err)
+			}
+			waitForEviction(t, storage)
+		}
+		if !storage.Exists(context.Background(), key) {
+			t.Error("Expected the verification expectation to be kept")
+		}
+		if storage.Exists(context.Background(), "hosts/d") {
+			t.Error("Expected the least recently used object to be evicted")
+		}
+	})
+
+	t.Run("overlapping runs are skipped", func(t *testing.T) {
+		storage := newStorage(500, 100)
+		storage.lru.evicting = true
+		for _, key := range []string{"hosts/d", "hosts/e"} {
+			if err := storage.Write(context.Background(), key, data); err != nil {
+				t.Fatalf("Failed to write %s: %v", key, err)
+			}
+		}
+		if !storage.Exists(context.Background(), "hosts/d") {
+			t.Error("Expected no eviction while another run is under way")
+		}
+
+		storage.lru.evicting = false
+		if err := storage.Write(context.Background(), "hosts/f", data); err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+		waitForEviction(t, storage)
+		if storage.Exists(context.Background(), "hosts/d") || storage.Exists(context.Background(), "hosts/e") {
+			t.Error("Expected the next run to evict the older objects")
+		}
+		if !storage.Exists(context.Background(), "hosts/f") {
+			t.Error("Expected the object just written to be kept")
+		}
+	})
+
+	t.Run("eviction leaves a save in progress alone", func(t *testing.T) {
+		storage := newStorage(500, 100)
+		storage.lru.saving = true
+		if err := storage.Write(context.Background(), "hosts/g", data); err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+		waitForEviction(t, storage)
+		if err := storage.Write(context.Background(), "hosts/h", data); err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+		waitForEviction(t, storage)
+		if storage.Exists(context.Background(), "hosts/g") {
+			t.Error("Expected the older object to be evicted")
+		}
+		if !storage.lru.saving {
+			t.Error("Expected the eviction not to clear the flag of the save it did not start")
+		}
+	})
+
+	t.Run("objects rewritten after being picked are kept", func(t *testing.T) {
+		storage := newStorage(500, 100)
+		if err := storage.Write(context.Background(), "hosts/i", data); err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+		waitForEviction(t, storage)
+
+		// Take hosts/i out of the index as an eviction picking it would,
+		// then write it again before its files are removed
+		storage.lru.mu.Lock()
+		storage.lru.total -= storage.lru.objects["hosts/i"].size
+		delete(storage.lru.objects, "hosts/i")
+		storage.lru.evicting = true
+		storage.lru.mu.Unlock()
+		if err := storage.Write(context.Background(), "hosts/i", data); err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+		storage.lru.remove("hosts/i")
+		storage.lru.evicting = false
+
+		if !storage.Exists(context.Background(), "hosts/i") {
+			t.Error("Expected the rewritten object to be kept")
+		}
+	})
+}
+
 func TestIntegration(t *testing.T) {
 	storage, _, cleanup := setupTestStorage(t)
 	defer cleanup()
@@ -449,22 +710,22 @@ func TestIntegration(t *testing.T) {
 		testData := []byte("integration test content")
 
 		// 1. Verify file doesn't exist
-		if storage.Exists(testPath) {
+		if storage.Exists(context.Background(), testPath) {
 			t.Error("File should not exist initially")
 		}
 
 		// 2. Write file
-		if err := storage.Write(testPath, testData); err != nil {
+		if err := storage.Write(context.Background(), testPath, testData); err != nil {
 			t.Fatalf("Failed to write: %v", err)
 		}
 
 		// 3. Verify file exists
-		if !storage.Exists(testPath) {
+		if !storage.Exists(context.Background(), testPath) {
 			t.Error("File should exist after write")
 		}
 
 		// 4. Read file back
-		readData, err := storage.Read(testPath)
+		readData, err := storage.Read(context.Background(), testPath)
 		if err != nil {
 			t.Fatalf("Failed to read: %v", err)
 		}
@@ -475,12 +736,12 @@ func TestIntegration(t *testing.T) {
 		// 5. Save metadata
 		md5Sum := "integration-md5"
 		sha256Sum := "integration-sha256"
-		if err := storage.SaveMetadata(testPath, md5Sum, sha256Sum, int64(len(testData))); err != nil {
+		if err := storage.SaveMetadata(context.Background(), testPath, &metadata.Record{MD5: md5Sum, SHA256: sha256Sum, Size: int64(len(testData)), Status: "success"}); err != nil {
 			t.Fatalf("Failed to save metadata: %v", err)
 		}
 
 		// 6. Stream read
-		reader, err := storage.StreamRead(testPath)
+		reader, err := storage.StreamRead(context.Background(), testPath)
 		if err != nil {
 			t.Fatalf("Failed to stream read: %v", err)
 		}
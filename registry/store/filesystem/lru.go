@@ -0,0 +1,358 @@
+package filesystem
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aliharirian/TerraPeak/logger"
+	"github.com/aliharirian/TerraPeak/store/metadata"
+)
+
+// accessIndexName is the file at the storage root that keeps the last access
+// time of every object between restarts
+const accessIndexName = ".terrapeak-access.json"
+
+// accessSaveInterval limits how often access times are written back
+const accessSaveInterval = time.Minute
+
+// sidecarSuffixes name the files kept next to an object, which are counted
+// and evicted together with it
+var sidecarSuffixes = []string{metadata.Suffix, ".success"}
+
+// guardCount is the number of per-key guards, which keys share by hash
+const guardCount = 64
+
+// lru tracks the size and last access of every stored object, so the least
+// recently used ones can be evicted once the storage grows beyond maxSize.
+// Access times are recorded by TerraPeak itself, not taken from atime, which
+// is often disabled or coarse.
+type lru struct {
+	basePath     string
+	maxSize      int64
+	lowWatermark int64
+	pinned       []string
+
+	mu       sync.Mutex
+	objects  map[string]*lruObject
+	total    int64
+	dirty    bool      // access times changed since the last save
+	savedAt  time.Time // last time access times were saved
+	saving   bool
+	evicting bool
+
+	// guards serialize putting the files of an object in place with their
+	// removal by an eviction
+	guards [guardCount]sync.Mutex
+}
+
+type lruObject struct {
+	size   int64 // object plus sidecars
+	access time.Time
+}
+
+// newLRU indexes the objects under basePath, taking their access times from
+// the saved index and the modification time for objects it does not know
+func newLRU(basePath string, maxSize, lowWatermark int64, pinned []string) (*lru, error) {
+	if lowWatermark <= 0 {
+		lowWatermark = maxSize / 10 * 9
+	}
+	l := &lru{
+		basePath:     basePath,
+		maxSize:      maxSize,
+		lowWatermark: lowWatermark,
+		pinned:       pinned,
+		objects:      make(map[string]*lruObject),
+		savedAt:      time.Now(),
+	}
+
+	var saved map[string]time.Time
+	if data, err := os.ReadFile(filepath.Join(basePath, accessIndexName)); err == nil {
+		if err := json.Unmarshal(data, &saved); err != nil {
+			logger.Warnf("Ignoring unreadable access index in %s: %v", basePath, err)
+		}
+	}
+
+	err := filepath.WalkDir(basePath, func(fullPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || isInternalFile(d.Name()) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(basePath, fullPath)
+		if err != nil {
+			return err
+		}
+
+		key := objectKey(filepath.ToSlash(rel))
+		object, ok := l.objects[key]
+		if !ok {
+			object = &lruObject{access: info.ModTime()}
+			if access, known := saved[key]; known {
+				object.access = access
+			}
+			l.objects[key] = object
+		}
+		object.size += info.Size()
+		l.total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Infof("FileSystem storage holds %d objects (%d of max %d bytes)", len(l.objects), l.total, l.maxSize)
+	return l, nil
+}
+
+// isInternalFile reports whether name is the access index or a temporary
+// file of a write in progress rather than part of an object
+func isInternalFile(name string) bool {
+	return name == accessIndexName || isTempFile(name)
+}
+
+// objectKey returns the object a key belongs to, which for sidecars is the
+// object they are kept next to
+func objectKey(key string) string {
+	for _, suffix := range sidecarSuffixes {
+		if strings.HasSuffix(key, suffix) {
+			return strings.TrimSuffix(key, suffix)
+		}
+	}
+	return key
+}
+
+// isPinned reports whether the object is exempt from eviction
+func (l *lru) isPinned(key string) bool {
+	for _, prefix := range l.pinned {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// touch records an access to the object key belongs to
+func (l *lru) touch(key string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	if object, ok := l.objects[objectKey(key)]; ok {
+		object.access = time.Now()
+		l.dirty = true
+	}
+	save := l.dirty && !l.saving && time.Since(l.savedAt) > accessSaveInterval
+	if save {
+		l.saving = true
+	}
+	l.mu.Unlock()
+
+	if save {
+		go func() {
+			l.save()
+			l.mu.Lock()
+			l.saving = false
+			l.mu.Unlock()
+		}()
+	}
+}
+
+// guard returns the guard of the object key belongs to
+func (l *lru) guard(key string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(objectKey(key)))
+	return &l.guards[h.Sum32()%guardCount]
+}
+
+// replace puts the files of key in place with commit and records the write.
+// Both happen under the key's guard, so an eviction that picked the previous
+// version of the object cannot remove the new files.
+func (l *lru) replace(key string, commit func() error) error {
+	if l == nil {
+		return commit()
+	}
+	guard := l.guard(key)
+	guard.Lock()
+	defer guard.Unlock()
+
+	if err := commit(); err != nil {
+		return err
+	}
+	l.written(key)
+	return nil
+}
+
+// written records that key was (re)written and starts an eviction in the
+// background when the storage grew beyond its maximum size, unless a run is
+// already under way
+func (l *lru) written(key string) {
+	key = objectKey(key)
+	size := l.sizeOf(key)
+
+	l.mu.Lock()
+	object, ok := l.objects[key]
+	if !ok {
+		object = &lruObject{}
+		l.objects[key] = object
+	}
+	l.total += size - object.size
+	object.size, object.access = size, time.Now()
+	l.dirty = true
+	start := l.total > l.maxSize && !l.evicting
+	if start {
+		l.evicting = true
+	}
+	l.mu.Unlock()
+
+	if start {
+		go l.evict(key)
+	}
+}
+
+// deleted records that key was removed
+func (l *lru) deleted(key string) {
+	if l == nil {
+		return
+	}
+	key = objectKey(key)
+	size := l.sizeOf(key)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if object, ok := l.objects[key]; ok {
+		l.total += size - object.size
+		object.size = size
+		if size == 0 {
+			delete(l.objects, key)
+		}
+	}
+}
+
+// sizeOf adds up the size of an object and its sidecars on disk
+func (l *lru) sizeOf(key string) int64 {
+	var size int64
+	for _, suffix := range append([]string{""}, sidecarSuffixes...) {
+		if info, err := os.Stat(filepath.Join(l.basePath, filepath.FromSlash(key+suffix))); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+// evict removes the least recently used objects that are neither pinned nor
+// the one just written until the storage is below its low watermark. The
+// victims are taken out of the index under the lock and their files removed
+// after it is released. The caller sets evicting, which is cleared once the
+// run is done.
+func (l *lru) evict(written string) {
+	defer func() {
+		l.mu.Lock()
+		l.evicting = false
+		l.mu.Unlock()
+	}()
+
+	l.mu.Lock()
+
+	candidates := make([]string, 0, len(l.objects))
+	for key := range l.objects {
+		if key != written && !l.isPinned(key) {
+			candidates = append(candidates, key)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return l.objects[candidates[i]].access.Before(l.objects[candidates[j]].access)
+	})
+
+	var evicted []string
+	var freed int64
+	for _, key := range candidates {
+		if l.total <= l.lowWatermark {
+			break
+		}
+		freed += l.objects[key].size
+		l.total -= l.objects[key].size
+		delete(l.objects, key)
+		evicted = append(evicted, key)
+	}
+	total := l.total
+	l.mu.Unlock()
+
+	for _, key := range evicted {
+		l.remove(key)
+	}
+	if total > l.lowWatermark {
+		logger.Warnf("FileSystem storage is still at %d bytes after eviction, the rest is pinned or in use", total)
+	}
+	logger.Infof("Evicted %d least recently used objects from filesystem storage (%d bytes freed, %d bytes in use)", len(evicted), freed, total)
+	l.save()
+}
+
+// remove deletes the files of an evicted object, unless it was written again
+// since it was picked, and the directories it leaves empty. The check and the
+// removal happen under the key's guard, which writes hold while putting their
+// files in place.
+func (l *lru) remove(key string) {
+	guard := l.guard(key)
+	guard.Lock()
+	defer guard.Unlock()
+
+	l.mu.Lock()
+	_, rewritten := l.objects[key]
+	l.mu.Unlock()
+	if rewritten {
+		return
+	}
+
+	fullPath := filepath.Join(l.basePath, filepath.FromSlash(key))
+	for _, suffix := range append([]string{""}, sidecarSuffixes...) {
+		if err := os.Remove(fullPath + suffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			logger.Warnf("Failed to evict %s: %v", key+suffix, err)
+		}
+	}
+	logger.Debugf("Evicted %s from filesystem storage", key)
+
+	// Removing a directory fails once anything is in it, which ends the
+	// pruning at the first one still in use
+	root := filepath.Clean(l.basePath)
+	for dir := filepath.Dir(fullPath); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+}
+
+// save writes the access times to the index at the storage root
+func (l *lru) save() {
+	l.mu.Lock()
+	accesses := make(map[string]time.Time, len(l.objects))
+	for key, object := range l.objects {
+		accesses[key] = object.access
+	}
+	l.dirty, l.savedAt = false, time.Now()
+	l.mu.Unlock()
+
+	data, err := json.Marshal(accesses)
+	if err == nil {
+		_, err = writeFileAtomic(filepath.Join(l.basePath, accessIndexName), bytes.NewReader(data), int64(len(data)))
+	}
+	if err != nil {
+		logger.Warnf("Failed to save the access index of %s: %v", l.basePath, err)
+	}
+}
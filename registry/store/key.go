@@ -0,0 +1,96 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxSegmentLength caps every segment of a canonical key, leaving room
+// within the usual 255 byte file name limit for sidecar suffixes and the
+// names of temporary files
+const maxSegmentLength = 200
+
+// ErrInvalidKey is returned for keys that would escape the storage root
+var ErrInvalidKey = errors.New("invalid storage key")
+
+// NormalizeKey returns the canonical form of key, which every backend stores
+// under the same name:
+//   - empty and "." segments are dropped and ".." segments rejected
+//   - control characters, backslashes and invalid UTF-8 are %XX escaped
+//   - segments longer than maxSegmentLength, e.g. with a long query
+//     string, are cut and suffixed with the SHA256 of the whole segment
+//
+// Canonical keys normalize to themselves.
+func NormalizeKey(key string) (string, error) {
+	var segments []string
+	for _, segment := range strings.Split(key, "/") {
+		switch segment {
+		case "", ".":
+			continue
+		case "..":
+			return "", fmt.Errorf("%w: %q contains a parent directory segment", ErrInvalidKey, key)
+		}
+		segments = append(segments, shortenSegment(escapeSegment(segment)))
+	}
+	if len(segments) == 0 {
+		return "", fmt.Errorf("%w: %q is empty", ErrInvalidKey, key)
+	}
+	return strings.Join(segments, "/"), nil
+}
+
+// URLKey returns the key content fetched from host, urlPath and query is
+// stored under: "{host}{path}", plus "?" and the escaped query if there is
+// one, in canonical form. Keys that cannot be normalized are returned as they
+// are, for the store to reject.
+func URLKey(host, urlPath, query string) string {
+	key := host + urlPath
+	if query != "" {
+		// URL encode the query string to make it filesystem-safe
+		key += "?" + url.QueryEscape(query)
+	}
+	// Remove leading slash if present to make it a valid file path
+	key = strings.TrimPrefix(key, "/")
+
+	if canonical, err := NormalizeKey(key); err == nil {
+		return canonical
+	}
+	return key
+}
+
+// escapeSegment %XX escapes the bytes of segment no backend or filesystem
+// can be trusted with
+func escapeSegment(segment string) string {
+	var b strings.Builder
+	for i := 0; i < len(segment); {
+		r, size := utf8.DecodeRuneInString(segment[i:])
+		if (r == utf8.RuneError && size == 1) || r < 0x20 || r == 0x7f || r == '\\' {
+			fmt.Fprintf(&b, "%%%02X", segment[i])
+			i++
+			continue
+		}
+		b.WriteString(segment[i : i+size])
+		i += size
+	}
+	return b.String()
+}
+
+// shortenSegment keeps segments within maxSegmentLength. Long segments keep
+// a readable prefix and end in "~" and the SHA256 of the whole segment.
+func shortenSegment(segment string) string {
+	if len(segment) <= maxSegmentLength {
+		return segment
+	}
+	sum := sha256.Sum256([]byte(segment))
+	suffix := "~" + hex.EncodeToString(sum[:])
+	prefix := segment[:maxSegmentLength-len(suffix)]
+	// Do not cut a UTF-8 sequence in half
+	for len(prefix) > 0 && !utf8.ValidString(prefix) {
+		prefix = prefix[:len(prefix)-1]
+	}
+	return prefix + suffix
+}
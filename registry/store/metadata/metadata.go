@@ -0,0 +1,38 @@
+package metadata
+
+import (
+	"net/http"
+	"time"
+)
+
+// Suffix is appended to an object path to name its metadata record
+const Suffix = ".metadata.json"
+
+// VerificationPrefix holds the checksum expectations of provider archives.
+// They are what an archive fetched later is checked against, so they are
+// never evicted or purged like cached content.
+const VerificationPrefix = "verification/"
+
+// Record describes a stored object. The backends keep it as JSON next to the
+// object, under the object path plus Suffix.
+type Record struct {
+	File       string      `json:"file"`
+	Timestamp  time.Time   `json:"timestamp"` // when the object was fetched
+	Size       int64       `json:"size"`
+	MD5        string      `json:"md5"`
+	SHA256     string      `json:"sha256"`
+	Status     string      `json:"status"`
+	StatusCode int         `json:"status_code,omitempty"` // upstream status
+	SourceURL  string      `json:"source_url,omitempty"`
+	Header     http.Header `json:"header,omitempty"` // upstream headers replayed on hits
+}
+
+// ObjectInfo is what a backend knows about a stored key without reading it
+type ObjectInfo struct {
+	Key      string    `json:"key"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	// UserMetadata holds the metadata the backend keeps with the object
+	// itself (x-amz-meta-* on S3); the filesystem backend keeps none
+	UserMetadata map[string]string `json:"user_metadata,omitempty"`
+}
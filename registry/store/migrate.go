@@ -0,0 +1,154 @@
+package store
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aliharirian/TerraPeak/logger"
+)
+
+// KeyMove is an object MigrateKeys moved to its canonical key
+type KeyMove struct {
+	From string
+	To   string
+}
+
+// Migration is what MigrateKeys changed, or would change in a dry run
+type Migration struct {
+	Moves      []KeyMove // objects and sidecars moved to their canonical key
+	Backfilled []string  // canonical keys of objects given a metadata record
+}
+
+// MigrateKeys moves every object of backend that was saved before keys were
+// normalized, along with its metadata record, to its canonical key. Registry
+// responses saved before every registry had its own namespace, under
+// registry/v1/..., move into the namespace of the default registry,
+// registryName. Objects whose new key is already taken were fetched again
+// since and are removed instead. Objects saved before metadata records were kept get one
+// from their content and modification time. With dryRun nothing is changed,
+// the changes are only reported.
+func MigrateKeys(ctx context.Context, backend Storage, registryName string, dryRun bool) (*Migration, error) {
+	keys, err := ListAll(ctx, backend, "")
+	if err != nil {
+		return nil, err
+	}
+
+	migration := &Migration{}
+	var objects []string
+	recorded := make(map[string]bool)
+	for _, key := range keys {
+		object, suffix := splitSidecar(key)
+		canonical, err := NormalizeKey(object)
+		if err != nil {
+			logger.Warnf("Skipping %s, it has no canonical key: %v", key, err)
+			continue
+		}
+		if rest, ok := strings.CutPrefix(canonical, legacyRegistryPrefix); ok && registryName != "" {
+			canonical = "registry/" + registryName + "/v1/" + rest
+		}
+		switch suffix {
+		case "":
+			objects = append(objects, canonical)
+		case metadataSuffix:
+			recorded[canonical] = true
+		}
+		canonical += suffix
+		if canonical == key {
+			continue
+		}
+
+		migration.Moves = append(migration.Moves, KeyMove{From: key, To: canonical})
+		if dryRun {
+			continue
+		}
+		if err := moveKey(ctx, backend, key, canonical); err != nil {
+			return migration, fmt.Errorf("failed to move %s to %s: %w", key, canonical, err)
+		}
+		logger.Infof("Moved %s to %s", key, canonical)
+	}
+
+	for _, object := range objects {
+		if recorded[object] {
+			continue
+		}
+		// A legacy key and its canonical key may both have held the object
+		recorded[object] = true
+
+		migration.Backfilled = append(migration.Backfilled, object)
+		if dryRun {
+			continue
+		}
+		if err := backfillMetadata(ctx, backend, object); err != nil {
+			return migration, fmt.Errorf("failed to write metadata of %s: %w", object, err)
+		}
+		logger.Infof("Wrote missing metadata record of %s", object)
+	}
+	return migration, nil
+}
+
+// backfillMetadata writes a metadata record for an object saved without
+// one, with its checksums and size and its modification time as the time
+// it was fetched
+func backfillMetadata(ctx context.Context, backend Storage, key string) error {
+	info, err := backend.Stat(ctx, key)
+	if err != nil {
+		return err
+	}
+	reader, err := backend.StreamRead(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	md5Hash, sha256Hash := md5.New(), sha256.New()
+	size, err := io.Copy(io.MultiWriter(md5Hash, sha256Hash), reader)
+	if err != nil {
+		return err
+	}
+	return WriteMetadata(ctx, backend, key, &Metadata{
+		MD5:       hex.EncodeToString(md5Hash.Sum(nil)),
+		SHA256:    hex.EncodeToString(sha256Hash.Sum(nil)),
+		Size:      size,
+		Timestamp: info.Modified.UTC(),
+	})
+}
+
+// legacyRegistryPrefix holds the registry responses of the default registry
+// saved before registries had their own namespace
+const legacyRegistryPrefix = "registry/v1/"
+
+// moveKey copies from to to, unless to exists already, and removes from
+func moveKey(ctx context.Context, backend Storage, from, to string) error {
+	if !backend.Exists(ctx, to) {
+		info, err := backend.Stat(ctx, from)
+		if err != nil {
+			return err
+		}
+		reader, err := backend.StreamRead(ctx, from)
+		if err != nil {
+			return err
+		}
+		err = backend.StreamWrite(ctx, to, reader, info.Size)
+		reader.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return backend.Delete(ctx, from)
+}
+
+// splitSidecar splits a metadata record or success tag key into the key of
+// its object and the suffix; other keys are returned with an empty suffix
+func splitSidecar(key string) (object, suffix string) {
+	for _, suffix := range []string{metadataSuffix, ".success"} {
+		if strings.HasSuffix(key, suffix) {
+			return strings.TrimSuffix(key, suffix), suffix
+		}
+	}
+	return key, ""
+}
@@ -1,26 +1,65 @@
 package store
 
 import (
+	"context"
 	"io"
+
+	"github.com/aliharirian/TerraPeak/store/metadata"
 )
 
-// Storage defines the interface for storage backends (S3, FileSystem, etc.)
+// Storage defines the interface for storage backends (S3, FileSystem, etc.).
+// Every call takes a context: a canceled context stops the operation, and a
+// write stopped that way leaves nothing behind.
 type Storage interface {
 	// Check if file exists
-	Exists(filePath string) bool
+	Exists(ctx context.Context, filePath string) bool
 
 	// Read file data
-	Read(filePath string) ([]byte, error)
+	Read(ctx context.Context, filePath string) ([]byte, error)
 
 	// Write file data
-	Write(filePath string, data []byte) error
+	Write(ctx context.Context, filePath string, data []byte) error
 
 	// Stream write (for large files)
-	StreamWrite(filePath string, reader io.Reader, size int64) error
+	StreamWrite(ctx context.Context, filePath string, reader io.Reader, size int64) error
 
 	// Stream read (for large files)
-	StreamRead(filePath string) (io.ReadCloser, error)
+	StreamRead(ctx context.Context, filePath string) (io.ReadCloser, error)
+
+	// Save the metadata record (checksums, upstream headers, etc.)
+	SaveMetadata(ctx context.Context, filePath string, record *metadata.Record) error
+
+	// List one page of the keys starting with prefix, sorted: at most limit
+	// keys (all of them when limit <= 0) that sort after startAfter
+	List(ctx context.Context, prefix, startAfter string, limit int) ([]string, error)
+
+	// ListInfo is List with the size and modification time of every key,
+	// taken from the listing rather than a Stat per key
+	ListInfo(ctx context.Context, prefix, startAfter string, limit int) ([]metadata.ObjectInfo, error)
+
+	// Stat returns the size, modification time and user metadata of a key
+	Stat(ctx context.Context, filePath string) (*metadata.ObjectInfo, error)
+
+	// Delete removes a key; deleting a missing key is not an error
+	Delete(ctx context.Context, filePath string) error
+}
+
+// listPageSize is the page size ListAll requests from a backend
+const listPageSize = 1000
 
-	// Save metadata (checksums, etc.)
-	SaveMetadata(filePath, md5Sum, sha256Sum string, size int64) error
+// ListAll pages through every key of backend starting with prefix
+func ListAll(ctx context.Context, backend Storage, prefix string) ([]string, error) {
+	var keys []string
+	startAfter := ""
+	for {
+		page, err := backend.List(ctx, prefix, startAfter, listPageSize)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, page...)
+		if len(page) < listPageSize {
+			return keys, nil
+		}
+		startAfter = page[len(page)-1]
+	}
 }
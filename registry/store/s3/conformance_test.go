@@ -0,0 +1,48 @@
+package s3_test
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/aliharirian/TerraPeak/config"
+	"github.com/aliharirian/TerraPeak/store"
+	"github.com/aliharirian/TerraPeak/store/s3"
+	"github.com/aliharirian/TerraPeak/store/storetest"
+)
+
+// TestConformance runs against a real S3 service, e.g. a local MinIO, set by
+// TERRAPEAK_S3_TEST_ENDPOINT, _BUCKET, _ACCESS_KEY and _SECRET_KEY. The bucket
+// must be dedicated to the test: it is emptied after every subtest.
+func TestConformance(t *testing.T) {
+	endpoint := os.Getenv("TERRAPEAK_S3_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("TERRAPEAK_S3_TEST_ENDPOINT is not set")
+	}
+
+	cfg := &config.Config{}
+	cfg.Storage.S3.Enabled = true
+	cfg.Storage.S3.Endpoint = endpoint
+	cfg.Storage.S3.Region = os.Getenv("TERRAPEAK_S3_TEST_REGION")
+	cfg.Storage.S3.Bucket = os.Getenv("TERRAPEAK_S3_TEST_BUCKET")
+	cfg.Storage.S3.AccessKey = os.Getenv("TERRAPEAK_S3_TEST_ACCESS_KEY")
+	cfg.Storage.S3.SecretKey = os.Getenv("TERRAPEAK_S3_TEST_SECRET_KEY")
+
+	storetest.Run(t, func(t *testing.T) store.Storage {
+		storage, err := s3.New(cfg)
+		if err != nil {
+			t.Fatalf("Failed to create storage: %v", err)
+		}
+		t.Cleanup(func() {
+			ctx := context.Background()
+			keys, err := storage.List(ctx, "", "", 0)
+			if err != nil {
+				t.Errorf("Failed to empty the test bucket: %v", err)
+			}
+			for _, key := range keys {
+				storage.Delete(ctx, key)
+			}
+		})
+		return storage
+	})
+}
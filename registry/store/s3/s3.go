@@ -3,13 +3,15 @@ package s3
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/url"
-	"time"
+	"sort"
 
 	"github.com/aliharirian/TerraPeak/config"
 	"github.com/aliharirian/TerraPeak/logger"
+	"github.com/aliharirian/TerraPeak/store/metadata"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
 )
@@ -80,8 +82,7 @@ func New(cfg *config.Config) (*Storage, error) {
 }
 
 // Exists checks if file exists in S3
-func (s *Storage) Exists(filePath string) bool {
-	ctx := context.Background()
+func (s *Storage) Exists(ctx context.Context, filePath string) bool {
 	_, err := s.client.StatObject(ctx, s.bucket, filePath, minio.StatObjectOptions{})
 	if err != nil {
 		logger.Debugf("File %s not found in S3: %v", filePath, err)
@@ -92,8 +93,7 @@ func (s *Storage) Exists(filePath string) bool {
 }
 
 // Read reads file from S3
-func (s *Storage) Read(filePath string) ([]byte, error) {
-	ctx := context.Background()
+func (s *Storage) Read(ctx context.Context, filePath string) ([]byte, error) {
 	logger.Debugf("Reading file %s from S3", filePath)
 
 	object, err := s.client.GetObject(ctx, s.bucket, filePath, minio.GetObjectOptions{})
@@ -114,8 +114,7 @@ func (s *Storage) Read(filePath string) ([]byte, error) {
 }
 
 // Write writes file to S3
-func (s *Storage) Write(filePath string, data []byte) error {
-	ctx := context.Background()
+func (s *Storage) Write(ctx context.Context, filePath string, data []byte) error {
 	logger.Debugf("Writing %s to S3 (%d bytes)", filePath, len(data))
 
 	_, err := s.client.PutObject(ctx, s.bucket, filePath, bytes.NewReader(data),
@@ -130,8 +129,7 @@ func (s *Storage) Write(filePath string, data []byte) error {
 }
 
 // StreamWrite streams data to S3
-func (s *Storage) StreamWrite(filePath string, reader io.Reader, size int64) error {
-	ctx := context.Background()
+func (s *Storage) StreamWrite(ctx context.Context, filePath string, reader io.Reader, size int64) error {
 	logger.Debugf("Streaming %s to S3 (size: %d bytes)", filePath, size)
 
 	_, err := s.client.PutObject(ctx, s.bucket, filePath, reader, size, minio.PutObjectOptions{})
@@ -145,8 +143,7 @@ func (s *Storage) StreamWrite(filePath string, reader io.Reader, size int64) err
 }
 
 // StreamRead streams data from S3
-func (s *Storage) StreamRead(filePath string) (io.ReadCloser, error) {
-	ctx := context.Background()
+func (s *Storage) StreamRead(ctx context.Context, filePath string) (io.ReadCloser, error) {
 	logger.Debugf("Opening stream for file %s from S3", filePath)
 
 	object, err := s.client.GetObject(ctx, s.bucket, filePath, minio.GetObjectOptions{})
@@ -159,22 +156,17 @@ func (s *Storage) StreamRead(filePath string) (io.ReadCloser, error) {
 	return object, nil
 }
 
-// SaveMetadata saves metadata to S3
-func (s *Storage) SaveMetadata(filePath, md5Sum, sha256Sum string, size int64) error {
-	ctx := context.Background()
-
-	metadata := fmt.Sprintf(`{
-  "file": "%s",
-  "timestamp": "%s",
-  "size": %d,
-  "md5": "%s",
-  "sha256": "%s",
-  "status": "success"
-}`, filePath, time.Now().Format(time.RFC3339), size, md5Sum, sha256Sum)
+// SaveMetadata saves the metadata record of filePath to S3. Objects are
+// replaced atomically, so readers see either the old or the new record.
+func (s *Storage) SaveMetadata(ctx context.Context, filePath string, record *metadata.Record) error {
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
 
-	metadataPath := filePath + ".metadata.json"
-	_, err := s.client.PutObject(ctx, s.bucket, metadataPath,
-		bytes.NewReader([]byte(metadata)), int64(len(metadata)), minio.PutObjectOptions{})
+	metadataPath := filePath + metadata.Suffix
+	_, err = s.client.PutObject(ctx, s.bucket, metadataPath,
+		bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{ContentType: "application/json"})
 
 	if err != nil {
 		return err
@@ -184,6 +176,69 @@ func (s *Storage) SaveMetadata(filePath, md5Sum, sha256Sum string, size int64) e
 	return nil
 }
 
+// List lists the page of objects with keys starting with prefix after
+// startAfter in S3
+func (s *Storage) List(ctx context.Context, prefix, startAfter string, limit int) ([]string, error) {
+	infos, err := s.ListInfo(ctx, prefix, startAfter, limit)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, len(infos))
+	for i, info := range infos {
+		keys[i] = info.Key
+	}
+	return keys, nil
+}
+
+// ListInfo is List with the size and modification time of every object, as
+// reported by the listing itself
+func (s *Storage) ListInfo(ctx context.Context, prefix, startAfter string, limit int) ([]metadata.ObjectInfo, error) {
+	logger.Debugf("Listing objects with prefix %s after %q in S3", prefix, startAfter)
+
+	// Stop listing once the page is full
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var infos []metadata.ObjectInfo
+	options := minio.ListObjectsOptions{Prefix: prefix, StartAfter: startAfter, Recursive: true}
+	for object := range s.client.ListObjects(ctx, s.bucket, options) {
+		if object.Err != nil {
+			logger.Errorf("Failed to list objects in S3: %v", object.Err)
+			return nil, object.Err
+		}
+		infos = append(infos, metadata.ObjectInfo{Key: object.Key, Size: object.Size, Modified: object.LastModified})
+		if limit > 0 && len(infos) == limit {
+			break
+		}
+	}
+
+	// S3 already lists keys in order; other implementations may not
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+	logger.Debugf("Listed %d objects with prefix %s in S3", len(infos), prefix)
+	return infos, nil
+}
+
+// Stat returns the size and modification time of an object in S3
+func (s *Storage) Stat(ctx context.Context, filePath string) (*metadata.ObjectInfo, error) {
+	info, err := s.client.StatObject(ctx, s.bucket, filePath, minio.StatObjectOptions{})
+	if err != nil {
+		logger.Debugf("Failed to stat object %s in S3: %v", filePath, err)
+		return nil, err
+	}
+	return &metadata.ObjectInfo{Key: filePath, Size: info.Size, Modified: info.LastModified, UserMetadata: info.UserMetadata}, nil
+}
+
+// Delete removes an object from S3
+func (s *Storage) Delete(ctx context.Context, filePath string) error {
+	if err := s.client.RemoveObject(ctx, s.bucket, filePath, minio.RemoveObjectOptions{}); err != nil {
+		logger.Errorf("Failed to delete object %s from S3: %v", filePath, err)
+		return err
+	}
+
+	logger.Infof("Deleted %s from S3", filePath)
+	return nil
+}
+
 // parseEndpoint parses S3 endpoint URL and returns host:port and SSL flag
 func parseEndpoint(endpointURL string, skipSSL bool) (string, bool, error) {
 	parsedURL, err := url.Parse(endpointURL)
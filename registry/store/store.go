@@ -1,8 +1,20 @@
 package store
 
 import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
 	"github.com/aliharirian/TerraPeak/config"
 	"github.com/aliharirian/TerraPeak/store/filesystem"
+	"github.com/aliharirian/TerraPeak/store/metadata"
 	"github.com/aliharirian/TerraPeak/store/s3"
 )
 
@@ -34,19 +46,254 @@ func New(cfg *config.Config) (*Store, error) {
 	return &Store{config: cfg, backend: backend}, nil
 }
 
+// Backend returns the storage backend the store writes to
+func (s *Store) Backend() Storage {
+	return s.backend
+}
+
+// IsMetadataKey reports whether key is a sidecar record the backends keep
+// next to a saved object rather than an object of its own
+func IsMetadataKey(key string) bool {
+	return strings.HasSuffix(key, metadataSuffix) || strings.HasSuffix(key, ".success")
+}
+
 // Store now only provides storage operations; HTTP caching and proxy are handled in cache package.
+//
+// Every key passed to a Store is normalized with NormalizeKey first, so keys
+// that would escape the storage root are rejected. Objects saved before keys
+// were normalized are still found under their old key until MigrateKeys
+// moves them.
+
+// lookup returns the key the object filename is stored under: its canonical
+// key, or the key it was saved under before normalization
+func (s *Store) lookup(ctx context.Context, filename string) (string, error) {
+	key, err := NormalizeKey(filename)
+	if err != nil {
+		return "", err
+	}
+	if key != filename && !s.backend.Exists(ctx, key) && s.backend.Exists(ctx, filename) {
+		return filename, nil
+	}
+	return key, nil
+}
 
-// FileExists checks if a file exists in storage
-func (s *Store) FileExists(filePath string) bool {
-	return s.backend.Exists(filePath)
+// FileExists checks if a file exists in storage. Objects without a metadata
+// record, e.g. saved before records were kept, still count; Metadata fails
+// for them, so callers treat them as expired and revalidate them.
+func (s *Store) FileExists(ctx context.Context, filePath string) bool {
+	key, err := s.lookup(ctx, filePath)
+	return err == nil && s.backend.Exists(ctx, key)
 }
 
 // ReadFromStorage reads file from storage and returns the data
-func (s *Store) ReadFromStorage(filePath string) ([]byte, error) {
-	return s.backend.Read(filePath)
+func (s *Store) ReadFromStorage(ctx context.Context, filePath string) ([]byte, error) {
+	key, err := s.lookup(ctx, filePath)
+	if err != nil {
+		return nil, err
+	}
+	return s.backend.Read(ctx, key)
 }
 
-// Save saves data to storage
-func (s *Store) Save(filename string, data []byte) error {
-	return s.backend.Write(filename, data)
+// StreamFromStorage opens a stored file for reading. The caller must close it.
+func (s *Store) StreamFromStorage(ctx context.Context, filePath string) (io.ReadCloser, error) {
+	key, err := s.lookup(ctx, filePath)
+	if err != nil {
+		return nil, err
+	}
+	return s.backend.StreamRead(ctx, key)
 }
+
+// Save saves data to storage along with its metadata record
+func (s *Store) Save(ctx context.Context, filename string, data []byte) error {
+	filename, err := NormalizeKey(filename)
+	if err != nil {
+		return err
+	}
+	if err := s.backend.Write(ctx, filename, data); err != nil {
+		return err
+	}
+
+	md5Sum := md5.Sum(data)
+	sha256Sum := sha256.Sum256(data)
+	return s.commit(ctx, filename, &Metadata{
+		MD5:    hex.EncodeToString(md5Sum[:]),
+		SHA256: hex.EncodeToString(sha256Sum[:]),
+		Size:   int64(len(data)),
+	})
+}
+
+// SaveStream streams reader to storage along with its metadata record, which
+// starts from info (upstream status, headers and source URL; may be nil).
+// The object is committed only when reader ends without an error.
+func (s *Store) SaveStream(ctx context.Context, filename string, reader io.Reader, size int64, info *Metadata) error {
+	filename, err := NormalizeKey(filename)
+	if err != nil {
+		return err
+	}
+	md5Hash, sha256Hash := md5.New(), sha256.New()
+	counter := &countingWriter{}
+	tee := io.TeeReader(reader, io.MultiWriter(md5Hash, sha256Hash, counter))
+	if err := s.backend.StreamWrite(ctx, filename, tee, size); err != nil {
+		return err
+	}
+
+	record := &Metadata{}
+	if info != nil {
+		*record = *info
+	}
+	record.MD5 = hex.EncodeToString(md5Hash.Sum(nil))
+	record.SHA256 = hex.EncodeToString(sha256Hash.Sum(nil))
+	record.Size = counter.n
+	return s.commit(ctx, filename, record)
+}
+
+// commit saves the metadata record of the object just written to filename,
+// which makes it count as stored. When that fails the object is removed
+// again rather than left behind without a record.
+func (s *Store) commit(ctx context.Context, filename string, record *Metadata) error {
+	err := WriteMetadata(ctx, s.backend, filename, record)
+	if err == nil {
+		return nil
+	}
+	// Remove the object even when ctx was what made the record fail
+	if deleteErr := s.backend.Delete(context.WithoutCancel(ctx), filename); deleteErr != nil {
+		return fmt.Errorf("saving metadata of %s: %w (removing the object failed too: %v)", filename, err, deleteErr)
+	}
+	return fmt.Errorf("saving metadata of %s: %w", filename, err)
+}
+
+// countingWriter counts the bytes written to it
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// Metadata is the record the backends keep next to every saved object
+type Metadata = metadata.Record
+
+// ObjectInfo is the size and modification time of a stored key
+type ObjectInfo = metadata.ObjectInfo
+
+// List returns the saved objects whose keys start with prefix, sorted and
+// without their metadata records
+func (s *Store) List(ctx context.Context, prefix string) ([]string, error) {
+	keys, err := ListAll(ctx, s.backend, prefix)
+	if err != nil {
+		return nil, err
+	}
+	objects := keys[:0]
+	for _, key := range keys {
+		if !IsMetadataKey(key) {
+			objects = append(objects, key)
+		}
+	}
+	return objects, nil
+}
+
+// ListPage returns at most limit saved objects whose keys start with
+// prefix and sort after startAfter, with their size and modification time
+// but without their metadata records. next is the startAfter of the
+// following page, or empty after the last one.
+func (s *Store) ListPage(ctx context.Context, prefix, startAfter string, limit int) (objects []ObjectInfo, next string, err error) {
+	for {
+		// One key more than asked for tells whether another page follows
+		page, err := s.backend.ListInfo(ctx, prefix, startAfter, limit+1)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, info := range page {
+			if !IsMetadataKey(info.Key) {
+				objects = append(objects, info)
+			}
+		}
+		if len(objects) > limit {
+			return objects[:limit], objects[limit-1].Key, nil
+		}
+		if len(page) <= limit {
+			return objects, "", nil
+		}
+		startAfter = page[len(page)-1].Key
+	}
+}
+
+// Stat returns the size and modification time of a saved object
+func (s *Store) Stat(ctx context.Context, filename string) (*ObjectInfo, error) {
+	key, err := s.lookup(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+	return s.backend.Stat(ctx, key)
+}
+
+// Delete removes a saved object along with its metadata record, under its
+// canonical key as well as the key it was saved under before normalization
+func (s *Store) Delete(ctx context.Context, filename string) error {
+	canonical, err := NormalizeKey(filename)
+	if err != nil {
+		return err
+	}
+	keys := []string{canonical}
+	if filename != canonical {
+		keys = append(keys, filename)
+	}
+	for _, key := range keys {
+		for _, suffix := range []string{"", metadataSuffix, ".success"} {
+			if err := s.backend.Delete(ctx, key+suffix); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// WriteMetadata completes record for the object saved under filename and
+// saves it in backend. The Timestamp defaults to now.
+func WriteMetadata(ctx context.Context, backend Storage, filename string, record *Metadata) error {
+	record.File = path.Base(filename)
+	record.Status = "success"
+	if record.Timestamp.IsZero() {
+		record.Timestamp = time.Now().UTC()
+	}
+	return backend.SaveMetadata(ctx, filename, record)
+}
+
+// SaveMetadata replaces the metadata record of a saved object, e.g. after
+// upstream confirmed it is still current
+func (s *Store) SaveMetadata(ctx context.Context, filename string, record *Metadata) error {
+	key, err := s.lookup(ctx, filename)
+	if err != nil {
+		return err
+	}
+	return WriteMetadata(ctx, s.backend, key, record)
+}
+
+// Metadata returns the metadata record of a saved object. The Timestamp is
+// the last time the object was fetched.
+func (s *Store) Metadata(ctx context.Context, filename string) (*Metadata, error) {
+	key, err := s.lookup(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+	return ReadMetadata(ctx, s.backend, key)
+}
+
+// ReadMetadata returns the metadata record backend keeps for filename
+func ReadMetadata(ctx context.Context, backend Storage, filename string) (*Metadata, error) {
+	data, err := backend.Read(ctx, filename+metadataSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	var record Metadata
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// metadataSuffix is appended to an object path by SaveMetadata
+const metadataSuffix = metadata.Suffix
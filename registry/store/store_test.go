@@ -2,47 +2,24 @@ package store
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/aliharirian/TerraPeak/config"
 )
 
 func createTestConfig(tempDir string) *config.Config {
-	return &config.Config{
-		Storage: struct {
-			S3 struct {
-				Enabled   bool   `yaml:"enabled"`
-				Endpoint  string `yaml:"endpoint"`
-				Region    string `yaml:"region"`
-				AccessKey string `yaml:"access_key"`
-				SecretKey string `yaml:"secret_key"`
-				Bucket    string `yaml:"bucket"`
-				SkipSSL   bool   `yaml:"skip_ssl_verify"`
-			} `yaml:"s3"`
-			File struct {
-				Path string `yaml:"path"`
-			} `yaml:"file"`
-		}{
-			S3: struct {
-				Enabled   bool   `yaml:"enabled"`
-				Endpoint  string `yaml:"endpoint"`
-				Region    string `yaml:"region"`
-				AccessKey string `yaml:"access_key"`
-				SecretKey string `yaml:"secret_key"`
-				Bucket    string `yaml:"bucket"`
-				SkipSSL   bool   `yaml:"skip_ssl_verify"`
-			}{
-				Enabled: false,
-			},
-			File: struct {
-				Path string `yaml:"path"`
-			}{
-				Path: tempDir,
-			},
-		},
-	}
+	cfg := &config.Config{}
+	cfg.Storage.S3.Enabled = false
+	cfg.Storage.File.Path = tempDir
+	return cfg
 }
 
 func TestNew(t *testing.T) {
@@ -84,7 +61,7 @@ func TestFileExists(t *testing.T) {
 	}
 
 	// Test non-existent file
-	exists := store.FileExists("nonexistent/file.txt")
+	exists := store.FileExists(context.Background(), "nonexistent/file.txt")
 	if exists {
 		t.Error("Expected false for non-existent file")
 	}
@@ -103,12 +80,77 @@ func TestFileExists(t *testing.T) {
 	}
 
 	// Test existing file
-	exists = store.FileExists(testFilePath)
+	exists = store.FileExists(context.Background(), testFilePath)
 	if !exists {
 		t.Error("Expected true for existing file")
 	}
 }
 
+func TestObjectWithoutMetadata(t *testing.T) {
+	store, err := New(createTestConfig(t.TempDir()))
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	ctx := context.Background()
+
+	// Saved by a version that did not keep metadata records
+	key := "host/v1/providers/hashicorp/aws/versions"
+	if err := store.Backend().Write(ctx, key, []byte("baseline")); err != nil {
+		t.Fatalf("Failed to write object: %v", err)
+	}
+
+	if !store.FileExists(ctx, key) {
+		t.Error("Expected an object without metadata to exist")
+	}
+	if data, err := store.ReadFromStorage(ctx, key); err != nil || string(data) != "baseline" {
+		t.Errorf("Expected the object to be served, got %q, %v", data, err)
+	}
+	if _, err := store.Metadata(ctx, key); err == nil {
+		t.Error("Expected no metadata, so the object counts as expired")
+	}
+}
+
+// failingMetadata is a backend whose metadata records cannot be saved
+type failingMetadata struct {
+	Storage
+}
+
+func (failingMetadata) SaveMetadata(context.Context, string, *Metadata) error {
+	return errors.New("disk full")
+}
+
+func TestSaveMetadataFailure(t *testing.T) {
+	s, err := New(createTestConfig(t.TempDir()))
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	s.backend = failingMetadata{Storage: s.backend}
+	ctx := context.Background()
+
+	saves := map[string]func(key string) error{
+		"Save": func(key string) error {
+			return s.Save(ctx, key, []byte("content"))
+		},
+		"SaveStream": func(key string) error {
+			return s.SaveStream(ctx, key, strings.NewReader("content"), 7, nil)
+		},
+	}
+	for name, save := range saves {
+		t.Run(name, func(t *testing.T) {
+			key := "host/" + name + ".zip"
+			if err := save(key); err == nil {
+				t.Fatal("Expected the save to fail with its metadata")
+			}
+			if s.FileExists(ctx, key) {
+				t.Error("Expected the object to be missing")
+			}
+			if s.backend.Exists(ctx, key) {
+				t.Error("Expected the object to be removed again")
+			}
+		})
+	}
+}
+
 func TestSave(t *testing.T) {
 	// Create temporary directory for testing
 	tempDir, err := os.MkdirTemp("", "store-test-")
@@ -126,7 +168,7 @@ func TestSave(t *testing.T) {
 	testData := []byte("test file content")
 	testPath := "test/save/file.txt"
 
-	err = store.Save(testPath, testData)
+	err = store.Save(context.Background(), testPath, testData)
 	if err != nil {
 		t.Fatalf("Failed to save file: %v", err)
 	}
@@ -143,6 +185,43 @@ func TestSave(t *testing.T) {
 	}
 }
 
+func TestMetadata(t *testing.T) {
+	tempDir := t.TempDir()
+
+	cfg := createTestConfig(tempDir)
+	store, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+
+	testData := []byte("test file content")
+	testPath := "test/metadata/file.txt"
+
+	if _, err := store.Metadata(context.Background(), testPath); err == nil {
+		t.Error("Expected error for missing metadata, got nil")
+	}
+
+	before := time.Now().Add(-time.Second)
+	if err := store.Save(context.Background(), testPath, testData); err != nil {
+		t.Fatalf("Failed to save file: %v", err)
+	}
+
+	metadata, err := store.Metadata(context.Background(), testPath)
+	if err != nil {
+		t.Fatalf("Failed to read metadata: %v", err)
+	}
+	if metadata.Size != int64(len(testData)) {
+		t.Errorf("Expected size %d, got %d", len(testData), metadata.Size)
+	}
+	expectedSHA256 := sha256.Sum256(testData)
+	if metadata.SHA256 != hex.EncodeToString(expectedSHA256[:]) {
+		t.Errorf("Expected sha256 %x, got %s", expectedSHA256, metadata.SHA256)
+	}
+	if metadata.Timestamp.Before(before) {
+		t.Errorf("Expected timestamp after %v, got %v", before, metadata.Timestamp)
+	}
+}
+
 func TestReadFromStorage(t *testing.T) {
 	// Create temporary directory for testing
 	tempDir, err := os.MkdirTemp("", "store-test-")
@@ -161,13 +240,13 @@ func TestReadFromStorage(t *testing.T) {
 	testPath := "test/read/file.txt"
 
 	// First save a file
-	err = store.Save(testPath, testData)
+	err = store.Save(context.Background(), testPath, testData)
 	if err != nil {
 		t.Fatalf("Failed to save test file: %v", err)
 	}
 
 	// Then read it back
-	readData, err := store.ReadFromStorage(testPath)
+	readData, err := store.ReadFromStorage(context.Background(), testPath)
 	if err != nil {
 		t.Fatalf("Failed to read from storage: %v", err)
 	}
@@ -177,7 +256,7 @@ func TestReadFromStorage(t *testing.T) {
 	}
 
 	// Test reading non-existent file
-	_, err = store.ReadFromStorage("nonexistent/file.txt")
+	_, err = store.ReadFromStorage(context.Background(), "nonexistent/file.txt")
 	if err == nil {
 		t.Error("Expected error when reading non-existent file")
 	}
@@ -206,18 +285,18 @@ func TestStoreIntegration(t *testing.T) {
 	testData := []byte("integration test content")
 
 	// Save file
-	err = store.Save(testPath, testData)
+	err = store.Save(context.Background(), testPath, testData)
 	if err != nil {
 		t.Fatalf("Failed to save test file: %v", err)
 	}
 
 	// Test that FileExists works
-	if !store.FileExists(testPath) {
+	if !store.FileExists(context.Background(), testPath) {
 		t.Error("File should exist after saving")
 	}
 
 	// Test ReadFromStorage
-	readData, err := store.ReadFromStorage(testPath)
+	readData, err := store.ReadFromStorage(context.Background(), testPath)
 	if err != nil {
 		t.Fatalf("Failed to read from storage: %v", err)
 	}
@@ -226,3 +305,203 @@ func TestStoreIntegration(t *testing.T) {
 		t.Errorf("Read data doesn't match saved data")
 	}
 }
+
+func TestNormalizeKey(t *testing.T) {
+	tests := []struct {
+		key      string
+		expected string
+		wantErr  bool
+	}{
+		{"github.com/owner/repo/archive/v1.tar.gz", "github.com/owner/repo/archive/v1.tar.gz", false},
+		{"/github.com//owner/./repo/", "github.com/owner/repo", false},
+		{"api.github.com/search?q%3Dterraform", "api.github.com/search?q%3Dterraform", false},
+		{"host/back\\slash/nul\x00/\xff", "host/back%5Cslash/nul%00/%FF", false},
+		{"host/ünïcode", "host/ünïcode", false},
+		{"github.com/../../etc/passwd", "", true},
+		{"..", "", true},
+		{"/./", "", true},
+	}
+
+	for _, tt := range tests {
+		key, err := NormalizeKey(tt.key)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("NormalizeKey(%q) error = %v, wantErr %v", tt.key, err, tt.wantErr)
+			continue
+		}
+		if key != tt.expected {
+			t.Errorf("NormalizeKey(%q) = %q, expected %q", tt.key, key, tt.expected)
+		}
+		if again, _ := NormalizeKey(key); !tt.wantErr && again != key {
+			t.Errorf("NormalizeKey(%q) = %q, expected canonical keys to be kept", key, again)
+		}
+	}
+
+	long := "host/file?" + strings.Repeat("q", 300)
+	key, err := NormalizeKey(long)
+	if err != nil {
+		t.Fatalf("NormalizeKey() error = %v", err)
+	}
+	if segment := key[len("host/"):]; len(segment) != maxSegmentLength || !strings.HasPrefix(segment, "file?qqq") {
+		t.Errorf("Expected the long segment shortened to %d bytes, got %q", maxSegmentLength, segment)
+	}
+	if again, _ := NormalizeKey(key); again != key {
+		t.Errorf("Expected the shortened key to be canonical, got %q", again)
+	}
+}
+
+func TestStoreRejectsTraversal(t *testing.T) {
+	tempDir := t.TempDir()
+	store, err := New(createTestConfig(filepath.Join(tempDir, "cache")))
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+
+	ctx := context.Background()
+	if err := store.Save(ctx, "github.com/../../escaped", []byte("data")); err == nil {
+		t.Error("Expected Save to reject a key leaving the storage root")
+	}
+	if _, err := os.Stat(filepath.Join(tempDir, "escaped")); !os.IsNotExist(err) {
+		t.Error("Expected nothing written outside the storage root")
+	}
+	if store.FileExists(ctx, "../cache/github.com") {
+		t.Error("Expected FileExists to reject a key leaving the storage root")
+	}
+}
+
+func TestLegacyKeys(t *testing.T) {
+	store, err := New(createTestConfig(t.TempDir()))
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	ctx := context.Background()
+	backend := store.Backend()
+
+	// Saved by a version that did not normalize keys
+	legacy := "host/file?" + strings.Repeat("q", 220)
+	canonical, _ := NormalizeKey(legacy)
+	if err := backend.Write(ctx, legacy, []byte("legacy")); err != nil {
+		t.Fatalf("Failed to write legacy object: %v", err)
+	}
+	if err := WriteMetadata(ctx, backend, legacy, &Metadata{Size: 6}); err != nil {
+		t.Fatalf("Failed to write legacy metadata: %v", err)
+	}
+
+	data, err := store.ReadFromStorage(ctx, legacy)
+	if err != nil || string(data) != "legacy" {
+		t.Errorf("Expected the legacy object to be found, got %q, %v", data, err)
+	}
+	if _, err := store.Metadata(ctx, legacy); err != nil {
+		t.Errorf("Expected the legacy metadata to be found, got %v", err)
+	}
+
+	t.Run("dry run", func(t *testing.T) {
+		migration, err := MigrateKeys(ctx, backend, "registry.terraform.io", true)
+		if err != nil || len(migration.Moves) != 3 {
+			t.Fatalf("Expected 3 moves, got %+v, %v", migration, err)
+		}
+		if !backend.Exists(ctx, legacy) {
+			t.Error("Expected a dry run to leave the objects in place")
+		}
+	})
+
+	t.Run("migration", func(t *testing.T) {
+		if _, err := MigrateKeys(ctx, backend, "registry.terraform.io", false); err != nil {
+			t.Fatalf("MigrateKeys() error = %v", err)
+		}
+		if backend.Exists(ctx, legacy) || backend.Exists(ctx, legacy+metadataSuffix) {
+			t.Error("Expected the legacy keys to be gone")
+		}
+		if data, err := backend.Read(ctx, canonical); err != nil || string(data) != "legacy" {
+			t.Errorf("Expected the object under its canonical key, got %q, %v", data, err)
+		}
+		if record, err := store.Metadata(ctx, legacy); err != nil || record.Size != 6 {
+			t.Errorf("Expected the metadata to move along, got %+v, %v", record, err)
+		}
+		if migration, _ := MigrateKeys(ctx, backend, "registry.terraform.io", true); len(migration.Moves) != 0 || len(migration.Backfilled) != 0 {
+			t.Errorf("Expected nothing left to migrate, got %+v", migration)
+		}
+	})
+}
+
+func TestMigrateKeysBackfillsMetadata(t *testing.T) {
+	store, err := New(createTestConfig(t.TempDir()))
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	ctx := context.Background()
+	backend := store.Backend()
+
+	// Saved by a version that neither normalized keys nor kept metadata
+	legacy := "host//providers/aws.zip"
+	canonical, _ := NormalizeKey(legacy)
+	if err := backend.Write(ctx, legacy, []byte("baseline")); err != nil {
+		t.Fatalf("Failed to write legacy object: %v", err)
+	}
+
+	migration, err := MigrateKeys(ctx, backend, "registry.terraform.io", true)
+	if err != nil || len(migration.Backfilled) != 1 || migration.Backfilled[0] != canonical {
+		t.Fatalf("Expected a dry run to report the record of %s, got %+v, %v", canonical, migration, err)
+	}
+	if backend.Exists(ctx, legacy+metadataSuffix) || backend.Exists(ctx, canonical+metadataSuffix) {
+		t.Error("Expected a dry run to write no metadata")
+	}
+
+	if _, err := MigrateKeys(ctx, backend, "registry.terraform.io", false); err != nil {
+		t.Fatalf("MigrateKeys() error = %v", err)
+	}
+	if !store.FileExists(ctx, legacy) || !store.FileExists(ctx, canonical) {
+		t.Error("Expected the object to be found after the migration")
+	}
+	record, err := store.Metadata(ctx, canonical)
+	if err != nil {
+		t.Fatalf("Expected a metadata record, got %v", err)
+	}
+	sum := sha256.Sum256([]byte("baseline"))
+	if record.Size != 8 || record.SHA256 != hex.EncodeToString(sum[:]) || record.Timestamp.IsZero() {
+		t.Errorf("Unexpected metadata record %+v", record)
+	}
+	if data, err := store.ReadFromStorage(ctx, canonical); err != nil || string(data) != "baseline" {
+		t.Errorf("Expected the object under its canonical key, got %q, %v", data, err)
+	}
+}
+
+func TestMigrateKeysRegistryNamespace(t *testing.T) {
+	store, err := New(createTestConfig(t.TempDir()))
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	ctx := context.Background()
+	backend := store.Backend()
+
+	// Saved before every registry had its own namespace
+	legacy := "registry/v1/versions/hashicorp/aws"
+	if err := store.Save(ctx, legacy, []byte(`{"versions":[]}`)); err != nil {
+		t.Fatalf("Failed to save legacy response: %v", err)
+	}
+	scoped := "registry/private/v1/versions/acme/thing"
+	if err := store.Save(ctx, scoped, []byte(`{"versions":[]}`)); err != nil {
+		t.Fatalf("Failed to save scoped response: %v", err)
+	}
+
+	migration, err := MigrateKeys(ctx, backend, "registry.terraform.io", false)
+	if err != nil {
+		t.Fatalf("MigrateKeys() error = %v", err)
+	}
+	if len(migration.Moves) != 3 {
+		t.Errorf("Expected the response and its 2 sidecars to move, got %+v", migration.Moves)
+	}
+
+	moved := "registry/registry.terraform.io/v1/versions/hashicorp/aws"
+	if data, err := store.ReadFromStorage(ctx, moved); err != nil || string(data) != `{"versions":[]}` {
+		t.Errorf("Expected the response under %s, got %q, %v", moved, data, err)
+	}
+	if _, err := store.Metadata(ctx, moved); err != nil {
+		t.Errorf("Expected the metadata to move along, got %v", err)
+	}
+	if backend.Exists(ctx, legacy) {
+		t.Error("Expected the legacy key to be gone")
+	}
+	if !backend.Exists(ctx, scoped) {
+		t.Error("Expected responses of named registries to stay")
+	}
+}
@@ -0,0 +1,301 @@
+// Package storetest holds the conformance suite every store.Storage backend
+// must pass. Backends run it from their own tests:
+//
+//	func TestConformance(t *testing.T) {
+//		storetest.Run(t, func(t *testing.T) store.Storage { ... })
+//	}
+package storetest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aliharirian/TerraPeak/store"
+	"github.com/aliharirian/TerraPeak/store/metadata"
+)
+
+// Run checks the behavior store.Storage promises against the backends that
+// newStorage creates. Every subtest gets a new, empty backend.
+func Run(t *testing.T, newStorage func(t *testing.T) store.Storage) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, storage store.Storage)
+	}{
+		{"WriteAndRead", testWriteAndRead},
+		{"StreamWriteAndRead", testStreamWriteAndRead},
+		{"SaveMetadata", testSaveMetadata},
+		{"List", testList},
+		{"ListPages", testListPages},
+		{"ListInfo", testListInfo},
+		{"StatAndDelete", testStatAndDelete},
+		{"CanceledContext", testCanceledContext},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newStorage(t))
+		})
+	}
+}
+
+func testWriteAndRead(t *testing.T, storage store.Storage) {
+	ctx := context.Background()
+	key := "conformance/nested/path/file.txt"
+
+	if storage.Exists(ctx, key) {
+		t.Fatalf("Exists(%q) = true before writing", key)
+	}
+	if _, err := storage.Read(ctx, key); err == nil {
+		t.Errorf("Read(%q) error = nil, want error for a missing key", key)
+	}
+
+	for _, data := range [][]byte{[]byte("first version"), []byte("second")} {
+		if err := storage.Write(ctx, key, data); err != nil {
+			t.Fatalf("Write() error = %v, want nil", err)
+		}
+		if !storage.Exists(ctx, key) {
+			t.Fatalf("Exists(%q) = false after writing", key)
+		}
+		got, err := storage.Read(ctx, key)
+		if err != nil {
+			t.Fatalf("Read() error = %v, want nil", err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("Read() = %q, want %q", got, data)
+		}
+	}
+}
+
+func testStreamWriteAndRead(t *testing.T, storage store.Storage) {
+	ctx := context.Background()
+	key := "conformance/stream.bin"
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+
+	if err := storage.StreamWrite(ctx, key, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("StreamWrite() error = %v, want nil", err)
+	}
+
+	reader, err := storage.StreamRead(ctx, key)
+	if err != nil {
+		t.Fatalf("StreamRead() error = %v, want nil", err)
+	}
+	defer reader.Close()
+	got, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Failed to read stream: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("StreamRead() returned %d bytes, want the %d written", len(got), len(data))
+	}
+
+	if _, err := storage.StreamRead(ctx, "conformance/missing.bin"); err == nil {
+		t.Error("StreamRead() error = nil, want error for a missing key")
+	}
+}
+
+func testSaveMetadata(t *testing.T, storage store.Storage) {
+	ctx := context.Background()
+	key := "conformance/with-metadata.txt"
+
+	if err := storage.Write(ctx, key, []byte("data")); err != nil {
+		t.Fatalf("Write() error = %v, want nil", err)
+	}
+	record := &metadata.Record{File: key, Size: 4, SHA256: "sha256", Status: "success", StatusCode: 200}
+	if err := storage.SaveMetadata(ctx, key, record); err != nil {
+		t.Fatalf("SaveMetadata() error = %v, want nil", err)
+	}
+	if !storage.Exists(ctx, key+metadata.Suffix) {
+		t.Errorf("Exists(%q) = false after SaveMetadata()", key+metadata.Suffix)
+	}
+
+	read, err := store.ReadMetadata(ctx, storage, key)
+	if err != nil {
+		t.Fatalf("ReadMetadata() error = %v, want nil", err)
+	}
+	if read.SHA256 != record.SHA256 || read.Size != record.Size || read.StatusCode != record.StatusCode {
+		t.Errorf("ReadMetadata() = %+v, want %+v", read, record)
+	}
+}
+
+func testList(t *testing.T, storage store.Storage) {
+	ctx := context.Background()
+	for _, key := range []string{"a/one.txt", "a/two.txt", "a/sub/three.txt", "ab/four.txt", "b/five.txt"} {
+		if err := storage.Write(ctx, key, []byte("data")); err != nil {
+			t.Fatalf("Failed to write %s: %v", key, err)
+		}
+	}
+
+	tests := []struct {
+		prefix   string
+		expected []string
+	}{
+		{"a/", []string{"a/one.txt", "a/sub/three.txt", "a/two.txt"}},
+		{"a", []string{"a/one.txt", "a/sub/three.txt", "a/two.txt", "ab/four.txt"}},
+		{"a/t", []string{"a/two.txt"}},
+		{"", []string{"a/one.txt", "a/sub/three.txt", "a/two.txt", "ab/four.txt", "b/five.txt"}},
+		{"missing/", nil},
+	}
+
+	for _, tt := range tests {
+		keys, err := storage.List(ctx, tt.prefix, "", 0)
+		if err != nil {
+			t.Fatalf("List(%q) error = %v, want nil", tt.prefix, err)
+		}
+		if strings.Join(keys, ",") != strings.Join(tt.expected, ",") {
+			t.Errorf("List(%q) = %v, want %v", tt.prefix, keys, tt.expected)
+		}
+	}
+}
+
+func testListPages(t *testing.T, storage store.Storage) {
+	ctx := context.Background()
+	var expected []string
+	for i := 0; i < 7; i++ {
+		expected = append(expected, fmt.Sprintf("pages/%02d", i))
+	}
+	// Nested keys that sort apart from their directories' names
+	expected = append(expected, "pages/a-b/x", "pages/a.txt", "pages/a/x", "pages/a/y/z", "pages/b")
+	for _, key := range expected {
+		if err := storage.Write(ctx, key, []byte("data")); err != nil {
+			t.Fatalf("Failed to write %s: %v", key, err)
+		}
+	}
+
+	var listed []string
+	startAfter := ""
+	for pages := 0; ; pages++ {
+		if pages > len(expected) {
+			t.Fatalf("List() kept returning pages, got %v so far", listed)
+		}
+		page, err := storage.List(ctx, "pages/", startAfter, 3)
+		if err != nil {
+			t.Fatalf("List() error = %v, want nil", err)
+		}
+		if len(page) > 3 {
+			t.Fatalf("List() returned %d keys, want at most 3", len(page))
+		}
+		if len(page) == 0 {
+			break
+		}
+		listed = append(listed, page...)
+		startAfter = page[len(page)-1]
+	}
+	if strings.Join(listed, ",") != strings.Join(expected, ",") {
+		t.Errorf("Paging through List() = %v, want %v", listed, expected)
+	}
+
+	all, err := store.ListAll(ctx, storage, "pages/")
+	if err != nil || len(all) != len(expected) {
+		t.Errorf("ListAll() = %v, %v, want %d keys", all, err, len(expected))
+	}
+}
+
+func testListInfo(t *testing.T, storage store.Storage) {
+	ctx := context.Background()
+	sizes := map[string]int{"info/a.txt": 1, "info/b.txt": 22, "info/sub/c.txt": 333}
+	for key, size := range sizes {
+		if err := storage.Write(ctx, key, bytes.Repeat([]byte("x"), size)); err != nil {
+			t.Fatalf("Failed to write %s: %v", key, err)
+		}
+	}
+
+	infos, err := storage.ListInfo(ctx, "info/", "info/a.txt", 0)
+	if err != nil {
+		t.Fatalf("ListInfo() error = %v, want nil", err)
+	}
+	if len(infos) != 2 || infos[0].Key != "info/b.txt" || infos[1].Key != "info/sub/c.txt" {
+		t.Fatalf("ListInfo() = %+v, want info/b.txt and info/sub/c.txt", infos)
+	}
+	for _, info := range infos {
+		if info.Size != int64(sizes[info.Key]) {
+			t.Errorf("ListInfo() size of %s = %d, want %d", info.Key, info.Size, sizes[info.Key])
+		}
+		if info.Modified.IsZero() {
+			t.Errorf("ListInfo() modification time of %s is zero", info.Key)
+		}
+	}
+}
+
+func testStatAndDelete(t *testing.T, storage store.Storage) {
+	ctx := context.Background()
+	key := "conformance/stat.txt"
+
+	before := time.Now().Add(-time.Minute)
+	if err := storage.Write(ctx, key, []byte("twelve bytes")); err != nil {
+		t.Fatalf("Write() error = %v, want nil", err)
+	}
+
+	info, err := storage.Stat(ctx, key)
+	if err != nil {
+		t.Fatalf("Stat() error = %v, want nil", err)
+	}
+	if info.Key != key || info.Size != 12 || info.Modified.Before(before) {
+		t.Errorf("Stat() = %+v, want key %s, size 12 and a recent modification time", info, key)
+	}
+
+	if err := storage.Delete(ctx, key); err != nil {
+		t.Errorf("Delete() error = %v, want nil", err)
+	}
+	if storage.Exists(ctx, key) {
+		t.Error("Exists() = true after Delete()")
+	}
+	if _, err := storage.Stat(ctx, key); err == nil {
+		t.Error("Stat() error = nil, want error for a deleted key")
+	}
+	if err := storage.Delete(ctx, key); err != nil {
+		t.Errorf("Delete() of a missing key error = %v, want nil", err)
+	}
+}
+
+// cancelingReader cancels its context once half of the data was read
+type cancelingReader struct {
+	r      io.Reader
+	cancel context.CancelFunc
+	after  int
+	read   int
+}
+
+func (c *cancelingReader) Read(p []byte) (int, error) {
+	if c.read >= c.after {
+		c.cancel()
+	}
+	if len(p) > 4096 {
+		p = p[:4096]
+	}
+	n, err := c.r.Read(p)
+	c.read += n
+	return n, err
+}
+
+func testCanceledContext(t *testing.T, storage store.Storage) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := storage.Write(canceled, "conformance/canceled.txt", []byte("data")); err == nil {
+		t.Error("Write() error = nil, want error for a canceled context")
+	}
+	if _, err := storage.List(canceled, "", "", 0); err == nil {
+		t.Error("List() error = nil, want error for a canceled context")
+	}
+
+	// A stream canceled halfway must not leave a partial object behind
+	data := bytes.Repeat([]byte("x"), 256*1024)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reader := &cancelingReader{r: bytes.NewReader(data), cancel: cancel, after: len(data) / 2}
+	if err := storage.StreamWrite(ctx, "conformance/interrupted.bin", reader, int64(len(data))); err == nil {
+		t.Error("StreamWrite() error = nil, want error when the context is canceled while writing")
+	}
+
+	background := context.Background()
+	for _, key := range []string{"conformance/canceled.txt", "conformance/interrupted.bin"} {
+		if storage.Exists(background, key) {
+			t.Errorf("Exists(%q) = true, want nothing stored by a canceled write", key)
+		}
+	}
+}
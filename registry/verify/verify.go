@@ -0,0 +1,218 @@
+package verify
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/aliharirian/TerraPeak/logger"
+	"github.com/aliharirian/TerraPeak/store/metadata"
+)
+
+// fetchTimeout bounds the download of a SHASUMS document or its signature
+const fetchTimeout = time.Minute
+
+// StoreInterface is the part of the store the verifier needs
+type StoreInterface interface {
+	FileExists(ctx context.Context, filePath string) bool
+	ReadFromStorage(ctx context.Context, filePath string) ([]byte, error)
+	Save(ctx context.Context, filename string, data []byte) error
+}
+
+// Expectation is what the registry download details promise about a provider
+// archive. It is recorded when the details are fetched and checked once the
+// archive itself is downloaded.
+type Expectation struct {
+	Filename            string   `json:"filename"`
+	Shasum              string   `json:"shasum"`
+	ShasumsURL          string   `json:"shasums_url"`
+	ShasumsSignatureURL string   `json:"shasums_signature_url"`
+	SigningKeys         []string `json:"signing_keys"` // ASCII armored GPG public keys
+}
+
+// Verifier checks provider archives against their registry expectation
+type Verifier struct {
+	store      StoreInterface
+	httpClient *http.Client
+}
+
+// New creates a verifier keeping its expectations in store. A nil client
+// falls back to http.DefaultClient.
+func New(store StoreInterface, httpClient *http.Client) *Verifier {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Verifier{store: store, httpClient: httpClient}
+}
+
+// ExpectationKey returns the storage key of the expectation for an artifact
+// cache key. Expectations live under metadata.VerificationPrefix, which is
+// never evicted or purged.
+func ExpectationKey(artifactKey string) string {
+	return metadata.VerificationPrefix + artifactKey + ".json"
+}
+
+// Expect records the expectation for the artifact cached under artifactKey
+func (v *Verifier) Expect(ctx context.Context, artifactKey string, expectation *Expectation) error {
+	data, err := json.Marshal(expectation)
+	if err != nil {
+		return err
+	}
+	return v.store.Save(ctx, ExpectationKey(artifactKey), data)
+}
+
+// Verify checks data downloaded for artifactKey. Artifacts without a recorded
+// expectation pass unchecked: anything that is not a provider archive, and
+// provider archives whose download details were not fetched through
+// TerraPeak, e.g. a URL from a lock file or another mirror.
+//
+// The SHASUMS document is fetched from upstream and its detached signature is
+// checked against the registry signing keys; the archive must then match both
+// its SHASUMS line and the shasum of the download details. Canceling ctx
+// abandons the upstream fetches, each of which is also bounded by
+// fetchTimeout.
+func (v *Verifier) Verify(ctx context.Context, artifactKey string, data []byte) error {
+	sum := sha256.Sum256(data)
+	return v.VerifySum(ctx, artifactKey, hex.EncodeToString(sum[:]))
+}
+
+// VerifySum is Verify for an artifact known by its hex encoded SHA256, so it
+// can be checked while streaming
+func (v *Verifier) VerifySum(ctx context.Context, artifactKey, actual string) error {
+	expectation, err := v.expectation(ctx, artifactKey)
+	if err != nil {
+		return err
+	}
+	if expectation == nil {
+		if isProviderArchive(artifactKey) {
+			logger.Warnf("No download details recorded for provider archive %s, caching it unchecked", artifactKey)
+		}
+		return nil
+	}
+
+	if expectation.Shasum != "" && !strings.EqualFold(expectation.Shasum, actual) {
+		return fmt.Errorf("checksum mismatch for %s: registry promised %s, got %s", artifactKey, expectation.Shasum, actual)
+	}
+
+	if expectation.ShasumsURL == "" {
+		logger.Warnf("No SHASUMS document known for %s, checked against the registry shasum only", artifactKey)
+		return nil
+	}
+
+	shasums, err := v.fetch(ctx, expectation.ShasumsURL)
+	if err != nil {
+		return err
+	}
+
+	if len(expectation.SigningKeys) == 0 || expectation.ShasumsSignatureURL == "" {
+		logger.Warnf("No signing keys known for %s, SHASUMS signature not checked", artifactKey)
+	} else {
+		signature, err := v.fetch(ctx, expectation.ShasumsSignatureURL)
+		if err != nil {
+			return err
+		}
+		if err := checkSignature(expectation.SigningKeys, shasums, signature); err != nil {
+			return fmt.Errorf("SHASUMS signature for %s: %w", artifactKey, err)
+		}
+	}
+
+	expected, ok := findShasum(shasums, expectation.Filename)
+	if !ok {
+		return fmt.Errorf("%s is not listed in %s", expectation.Filename, expectation.ShasumsURL)
+	}
+	if !strings.EqualFold(expected, actual) {
+		return fmt.Errorf("checksum mismatch for %s: SHASUMS lists %s, got %s", artifactKey, expected, actual)
+	}
+
+	logger.Infof("Verified %s (sha256 %s)", artifactKey, actual)
+	return nil
+}
+
+// expectation loads the recorded expectation, nil when there is none
+func (v *Verifier) expectation(ctx context.Context, artifactKey string) (*Expectation, error) {
+	key := ExpectationKey(artifactKey)
+	if !v.store.FileExists(ctx, key) {
+		return nil, nil
+	}
+
+	data, err := v.store.ReadFromStorage(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read expectation for %s: %w", artifactKey, err)
+	}
+
+	var expectation Expectation
+	if err := json.Unmarshal(data, &expectation); err != nil {
+		return nil, fmt.Errorf("failed to parse expectation for %s: %w", artifactKey, err)
+	}
+	return &expectation, nil
+}
+
+// fetch downloads a SHASUMS document or its signature
+func (v *Verifier) fetch(ctx context.Context, url string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, fetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s: %w", url, err)
+	}
+	resp, err := v.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch %s: status %d", url, resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// checkSignature verifies a detached (binary or armored) signature of
+// shasums made by one of the armored public keys
+func checkSignature(armoredKeys []string, shasums, signature []byte) error {
+	var keyring openpgp.EntityList
+	for _, armored := range armoredKeys {
+		keys, err := openpgp.ReadArmoredKeyRing(strings.NewReader(armored))
+		if err != nil {
+			return fmt.Errorf("invalid signing key: %w", err)
+		}
+		keyring = append(keyring, keys...)
+	}
+
+	if bytes.HasPrefix(bytes.TrimSpace(signature), []byte("-----BEGIN")) {
+		_, err := openpgp.CheckArmoredDetachedSignature(keyring, bytes.NewReader(shasums), bytes.NewReader(signature), nil)
+		return err
+	}
+	_, err := openpgp.CheckDetachedSignature(keyring, bytes.NewReader(shasums), bytes.NewReader(signature), nil)
+	return err
+}
+
+// isProviderArchive reports whether artifactKey names a provider release
+// archive, e.g. terraform-provider-aws_5.0.0_linux_amd64.zip
+func isProviderArchive(artifactKey string) bool {
+	name := path.Base(artifactKey)
+	return strings.HasPrefix(name, "terraform-provider-") && strings.HasSuffix(name, ".zip")
+}
+
+// findShasum looks up a file in a "<sha256>  <filename>" SHASUMS document
+func findShasum(shasums []byte, filename string) (string, bool) {
+	scanner := bufio.NewScanner(bytes.NewReader(shasums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[1] == filename {
+			return fields[0], true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,190 @@
+package verify
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+)
+
+// MockStore implements StoreInterface for testing
+type MockStore struct {
+	files map[string][]byte
+}
+
+func NewMockStore() *MockStore {
+	return &MockStore{files: make(map[string][]byte)}
+}
+
+func (m *MockStore) FileExists(_ context.Context, filePath string) bool {
+	_, exists := m.files[filePath]
+	return exists
+}
+
+func (m *MockStore) ReadFromStorage(_ context.Context, filePath string) ([]byte, error) {
+	data, exists := m.files[filePath]
+	if !exists {
+		return nil, fmt.Errorf("file not found: %s", filePath)
+	}
+	return data, nil
+}
+
+func (m *MockStore) Save(_ context.Context, filename string, data []byte) error {
+	m.files[filename] = data
+	return nil
+}
+
+// newSigningKey creates a GPG key pair and returns it with its armored public key
+func newSigningKey(t *testing.T) (*openpgp.Entity, string) {
+	t.Helper()
+	entity, err := openpgp.NewEntity("Test Signer", "", "signer@example.com", nil)
+	if err != nil {
+		t.Fatalf("Failed to create signing key: %v", err)
+	}
+
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatalf("Failed to armor public key: %v", err)
+	}
+	if err := entity.Serialize(w); err != nil {
+		t.Fatalf("Failed to serialize public key: %v", err)
+	}
+	w.Close()
+	return entity, buf.String()
+}
+
+func TestVerify(t *testing.T) {
+	archive := []byte("provider archive contents")
+	sum := sha256.Sum256(archive)
+	archiveSum := hex.EncodeToString(sum[:])
+	filename := "terraform-provider-test_1.0.0_linux_amd64.zip"
+	shasums := []byte(fmt.Sprintf("%s  other.zip\n%s  %s\n", strings.Repeat("0", 64), archiveSum, filename))
+
+	signer, signerKey := newSigningKey(t)
+	_, otherKey := newSigningKey(t)
+
+	var signature bytes.Buffer
+	if err := openpgp.DetachSign(&signature, signer, bytes.NewReader(shasums), nil); err != nil {
+		t.Fatalf("Failed to sign SHASUMS: %v", err)
+	}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/SHA256SUMS":
+			w.Write(shasums)
+		case "/SHA256SUMS.sig":
+			w.Write(signature.Bytes())
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+
+	expectation := func() *Expectation {
+		return &Expectation{
+			Filename:            filename,
+			Shasum:              archiveSum,
+			ShasumsURL:          upstream.URL + "/SHA256SUMS",
+			ShasumsSignatureURL: upstream.URL + "/SHA256SUMS.sig",
+			SigningKeys:         []string{signerKey},
+		}
+	}
+
+	tests := []struct {
+		name        string
+		expectation func() *Expectation
+		data        []byte
+		canceled    bool
+		wantErr     bool
+	}{
+		{
+			name:        "valid archive",
+			expectation: expectation,
+			data:        archive,
+		},
+		{
+			name:        "no expectation",
+			expectation: func() *Expectation { return nil },
+			data:        []byte("anything"),
+		},
+		{
+			name:        "tampered archive",
+			expectation: expectation,
+			data:        []byte("tampered archive contents"),
+			wantErr:     true,
+		},
+		{
+			name: "signed by an unknown key",
+			expectation: func() *Expectation {
+				e := expectation()
+				e.SigningKeys = []string{otherKey}
+				return e
+			},
+			data:    archive,
+			wantErr: true,
+		},
+		{
+			name: "file missing from SHASUMS",
+			expectation: func() *Expectation {
+				e := expectation()
+				e.Filename = "terraform-provider-test_1.0.0_darwin_arm64.zip"
+				return e
+			},
+			data:    archive,
+			wantErr: true,
+		},
+		{
+			name: "SHASUMS unavailable",
+			expectation: func() *Expectation {
+				e := expectation()
+				e.ShasumsURL = upstream.URL + "/missing"
+				return e
+			},
+			data:    archive,
+			wantErr: true,
+		},
+		{
+			name:        "request canceled",
+			expectation: expectation,
+			data:        archive,
+			canceled:    true,
+			wantErr:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verifier := New(NewMockStore(), upstream.Client())
+			artifactKey := "releases.example.com/" + filename
+
+			if e := tt.expectation(); e != nil {
+				if err := verifier.Expect(context.Background(), artifactKey, e); err != nil {
+					t.Fatalf("Failed to record expectation: %v", err)
+				}
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			if tt.canceled {
+				cancel()
+			}
+			defer cancel()
+
+			err := verifier.Verify(ctx, artifactKey, tt.data)
+			if tt.wantErr && err == nil {
+				t.Error("Expected verification error, got nil")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("Expected no error, got %v", err)
+			}
+		})
+	}
+}